@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// `sshmirror agent` runs on remote host, reading requests from stdin and writing responses to stdout. Each message is
+// a frame: uint32 length of the rest, then fields in fixed order (integers are big-endian, strings and byte slices
+// are prefixed with uint32 length). Responses come in the order of requests. Listing is streamed in several responses
+// to one request, all but the last of which have `more` set
+
+const AgentGreeting = "sshmirror-agent 3\n" // written on start. Changes along with protocol
+const AgentChunkSize = 1 << 20                // of written file per request
+const AgentMaxFrame = AgentChunkSize + 1 << 16
+
+type AgentOp uint8
+const (
+	AgentWrite    AgentOp = iota + 1 // chunk of regular file. Written to a temporary file until `last`
+	AgentMkdir                       // with parents
+	AgentSymlink                     // `path` points to `target`
+	AgentMove                        // from `path` to `target`, with parents of target
+	AgentDelete                      // recursively
+	AgentStat
+	AgentChecksum                    // sha1 of regular file
+	AgentList                        // regular files in directory, as "size mtime checksum relative\0" records. Streamed
+)
+func (op AgentOp) String() string {
+	switch op {
+		case AgentWrite:    return "write"
+		case AgentMkdir:    return "mkdir"
+		case AgentSymlink:  return "symlink"
+		case AgentMove:     return "move"
+		case AgentDelete:   return "delete"
+		case AgentStat:     return "stat"
+		case AgentChecksum: return "checksum"
+		case AgentList:     return "list"
+		default:            return fmt.Sprintf("op%d", uint8(op))
+	}
+}
+
+type AgentStatus uint8
+const (
+	AgentOK AgentStatus = iota
+	AgentNotExist
+	AgentFailed
+)
+
+type AgentRequest struct {
+	id     uint32
+	op     AgentOp
+	path   string // absolute
+	target string
+	mode   uint32 // permissions
+	mtime  int64  // unix nanoseconds
+	offset uint64
+	last   bool   // chunk of `AgentWrite`. For `AgentList`: with checksums
+	data   []byte
+}
+func (request AgentRequest) String() string {
+	if request.target != "" { return fmt.Sprintf("%s %s %s", request.op, request.path, request.target) }
+	return fmt.Sprintf("%s %s", request.op, request.path)
+}
+
+type AgentResponse struct {
+	id      uint32
+	status  AgentStatus
+	message string // of error
+	isDir   bool
+	size    uint64
+	mode    uint32
+	mtime   int64
+	more    bool // further responses to the same request follow
+	data    []byte
+	request AgentRequest // not transferred. Filled by client, without data
+}
+func (response *AgentResponse) fail(err error) { // if any
+	switch {
+		case err == nil:
+		case errors.Is(err, fs.ErrNotExist):
+			response.status = AgentNotExist
+			response.message = err.Error()
+		default:
+			response.status = AgentFailed
+			response.message = err.Error()
+	}
+}
+func (response AgentResponse) Err() error {
+	switch response.status {
+		case AgentOK:       return nil
+		case AgentNotExist: return fmt.Errorf("%w: %s", os.ErrNotExist, response.message)
+		default:            return errors.New(response.message)
+	}
+}
+
+type AgentEncoder struct {
+	writer *bufio.Writer
+	frame  []byte
+}
+func (AgentEncoder) New(writer io.Writer) *AgentEncoder {
+	return &AgentEncoder{writer: bufio.NewWriterSize(writer, 64 << 10)}
+}
+func (encoder *AgentEncoder) Request(request AgentRequest) error {
+	encoder.frame = encoder.frame[:0]
+	encoder.uint32(request.id)
+	encoder.frame = append(encoder.frame, byte(request.op))
+	encoder.string(request.path)
+	encoder.string(request.target)
+	encoder.uint32(request.mode)
+	encoder.uint64(uint64(request.mtime))
+	encoder.uint64(request.offset)
+	encoder.bool(request.last)
+	encoder.bytes(request.data)
+	return encoder.flushFrame()
+}
+func (encoder *AgentEncoder) Response(response AgentResponse) error {
+	encoder.frame = encoder.frame[:0]
+	encoder.uint32(response.id)
+	encoder.frame = append(encoder.frame, byte(response.status))
+	encoder.string(response.message)
+	encoder.bool(response.isDir)
+	encoder.uint64(response.size)
+	encoder.uint32(response.mode)
+	encoder.uint64(uint64(response.mtime))
+	encoder.bool(response.more)
+	encoder.bytes(response.data)
+	return encoder.flushFrame()
+}
+func (encoder *AgentEncoder) Flush() error {
+	return encoder.writer.Flush()
+}
+func (encoder *AgentEncoder) flushFrame() error {
+	// refused before anything is written, so that stream stays readable. Decoder would reject it anyway
+	if len(encoder.frame) > AgentMaxFrame { return fmt.Errorf("agent frame too big: %d", len(encoder.frame)) }
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(encoder.frame)))
+	if _, err := encoder.writer.Write(length); err != nil { return err }
+	_, err := encoder.writer.Write(encoder.frame)
+	return err
+}
+func (encoder *AgentEncoder) uint32(value uint32) {
+	encoder.frame = binary.BigEndian.AppendUint32(encoder.frame, value)
+}
+func (encoder *AgentEncoder) uint64(value uint64) {
+	encoder.frame = binary.BigEndian.AppendUint64(encoder.frame, value)
+}
+func (encoder *AgentEncoder) bool(value bool) {
+	if value {
+		encoder.frame = append(encoder.frame, 1)
+	} else {
+		encoder.frame = append(encoder.frame, 0)
+	}
+}
+func (encoder *AgentEncoder) string(value string) {
+	encoder.uint32(uint32(len(value)))
+	encoder.frame = append(encoder.frame, value...)
+}
+func (encoder *AgentEncoder) bytes(value []byte) {
+	encoder.uint32(uint32(len(value)))
+	encoder.frame = append(encoder.frame, value...)
+}
+
+type AgentDecoder struct {
+	reader *bufio.Reader
+	frame  []byte
+	err    error // of parsing current frame
+}
+func (AgentDecoder) New(reader io.Reader) *AgentDecoder {
+	return &AgentDecoder{reader: bufio.NewReaderSize(reader, 64 << 10)}
+}
+func (decoder *AgentDecoder) Request() (AgentRequest, error) {
+	if err := decoder.readFrame(); err != nil { return AgentRequest{}, err }
+	request := AgentRequest{
+		id:     decoder.uint32(),
+		op:     AgentOp(decoder.byte()),
+		path:   decoder.string(),
+		target: decoder.string(),
+		mode:   decoder.uint32(),
+		mtime:  int64(decoder.uint64()),
+		offset: decoder.uint64(),
+		last:   decoder.byte() != 0,
+		data:   decoder.bytes(),
+	}
+	return request, decoder.err
+}
+func (decoder *AgentDecoder) Response() (AgentResponse, error) {
+	if err := decoder.readFrame(); err != nil { return AgentResponse{}, err }
+	response := AgentResponse{
+		id:      decoder.uint32(),
+		status:  AgentStatus(decoder.byte()),
+		message: decoder.string(),
+		isDir:   decoder.byte() != 0,
+		size:    decoder.uint64(),
+		mode:    decoder.uint32(),
+		mtime:   int64(decoder.uint64()),
+		more:    decoder.byte() != 0,
+		data:    decoder.bytes(),
+	}
+	return response, decoder.err
+}
+func (decoder *AgentDecoder) readFrame() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(decoder.reader, header); err != nil { return err }
+	length := binary.BigEndian.Uint32(header)
+	if length > AgentMaxFrame { return fmt.Errorf("agent frame too big: %d", length) }
+	decoder.frame = make([]byte, length) // not reused: `data` of previous message may still be referenced
+	decoder.err = nil
+	_, err := io.ReadFull(decoder.reader, decoder.frame)
+	if errors.Is(err, io.EOF) { err = io.ErrUnexpectedEOF }
+	return err
+}
+func (decoder *AgentDecoder) take(n int) []byte {
+	if decoder.err != nil { return make([]byte, n) }
+	if len(decoder.frame) < n {
+		decoder.err = errors.New("malformed agent frame")
+		return make([]byte, n)
+	}
+	taken := decoder.frame[:n]
+	decoder.frame = decoder.frame[n:]
+	return taken
+}
+func (decoder *AgentDecoder) byte() byte {
+	return decoder.take(1)[0]
+}
+func (decoder *AgentDecoder) uint32() uint32 {
+	return binary.BigEndian.Uint32(decoder.take(4))
+}
+func (decoder *AgentDecoder) uint64() uint64 {
+	return binary.BigEndian.Uint64(decoder.take(8))
+}
+func (decoder *AgentDecoder) string() string {
+	return string(decoder.bytes())
+}
+func (decoder *AgentDecoder) bytes() []byte {
+	length := decoder.uint32()
+	if uint64(length) > uint64(len(decoder.frame)) {
+		if decoder.err == nil { decoder.err = errors.New("malformed agent frame") }
+		return nil
+	}
+	return decoder.take(int(length))
+}
+
+func RunAgent(input io.Reader, output io.Writer) error { // until input is closed
+	if _, err := io.WriteString(output, AgentGreeting); err != nil { return err }
+	decoder := AgentDecoder{}.New(input)
+	encoder := AgentEncoder{}.New(output)
+	agent := Agent{}
+	defer agent.abandon()
+	for {
+		request, err := decoder.Request()
+		if errors.Is(err, io.EOF) { return encoder.Flush() }
+		if err != nil { return err }
+		respond := func(response AgentResponse) error {
+			response.id = request.id
+			return encoder.Response(response)
+		}
+		if request.op == AgentList {
+			err = agent.List(request, respond)
+		} else {
+			err = respond(agent.Handle(request))
+		}
+		if err != nil { return err }
+		if decoder.reader.Buffered() == 0 { // waiting for next request
+			if err = encoder.Flush(); err != nil { return err }
+		}
+	}
+}
+
+type Agent struct {
+	uploading string // destination of unfinished upload. Chunks of one file come in a row
+	temporary string
+}
+func (agent *Agent) Handle(request AgentRequest) AgentResponse {
+	response := AgentResponse{}
+	if agent.uploading != "" && (request.op != AgentWrite || request.path != agent.uploading || request.offset == 0) {
+		agent.abandon() // upload was cancelled
+	}
+	err := func() error {
+		switch request.op {
+			case AgentWrite:
+				err := agent.write(request)
+				if err != nil { agent.abandon() }
+				return err
+			case AgentMkdir:
+				if err := os.MkdirAll(request.path, 0755); err != nil { return err }
+				if err := os.Chmod(request.path, fs.FileMode(request.mode)); err != nil { return err }
+				mtime := time.Unix(0, request.mtime)
+				return os.Chtimes(request.path, mtime, mtime)
+			case AgentSymlink:
+				if err := os.MkdirAll(filepath.Dir(request.path), 0755); err != nil { return err }
+				if err := os.RemoveAll(request.path); err != nil { return err }
+				return os.Symlink(request.target, request.path)
+			case AgentMove:
+				if err := os.MkdirAll(filepath.Dir(request.target), 0755); err != nil { return err }
+				return os.Rename(request.path, request.target)
+			case AgentDelete:
+				if _, err := os.Lstat(request.path); err != nil { return err }
+				return os.RemoveAll(request.path)
+			case AgentStat:
+				info, err := os.Lstat(request.path)
+				if err != nil { return err }
+				response.isDir = info.IsDir()
+				response.size = uint64(info.Size())
+				response.mode = uint32(info.Mode())
+				response.mtime = info.ModTime().UnixNano()
+				return nil
+			case AgentChecksum:
+				checksum, err := fileChecksum(request.path)
+				response.data = []byte(checksum)
+				return err
+			case AgentList:
+				return errors.New("listing is streamed with `List`")
+			default:
+				return fmt.Errorf("unknown agent operation: %s", request.op)
+		}
+	}()
+	response.fail(err)
+	return response
+}
+func (agent *Agent) List(request AgentRequest, respond func(AgentResponse) error) error { // in chunks of records
+	agent.abandon() // upload, if any, was cancelled
+	var errRespond error // sending failed. Returned as is, unlike errors of listing
+	chunk := make([]byte, 0, AgentChunkSize)
+	errList := agent.list(request.path, request.last, func(record []byte) error {
+		if len(chunk) > 0 && len(chunk) + len(record) > AgentChunkSize {
+			if errRespond = respond(AgentResponse{more: true, data: chunk}); errRespond != nil { return errRespond }
+			chunk = make([]byte, 0, AgentChunkSize) // previous one may still be buffered
+		}
+		chunk = append(chunk, record...)
+		return nil
+	})
+	if errRespond != nil { return errRespond }
+	last := AgentResponse{data: chunk}
+	last.fail(errList)
+	return respond(last)
+}
+func (agent *Agent) write(request AgentRequest) error {
+	flags := os.O_WRONLY
+	if request.offset == 0 {
+		if err := os.MkdirAll(filepath.Dir(request.path), 0755); err != nil { return err }
+		agent.uploading = request.path
+		agent.temporary = uploadingName(request.path)
+		flags |= os.O_CREATE | os.O_EXCL
+	} else if request.path != agent.uploading {
+		return fmt.Errorf("upload of %s was not started", request.path)
+	}
+	temporary := agent.temporary
+	file, err := os.OpenFile(temporary, flags, 0600)
+	if err != nil { return err }
+	_, err = file.WriteAt(request.data, int64(request.offset))
+	if errClose := file.Close(); err == nil { err = errClose }
+	if err != nil || !request.last { return err }
+
+	if err = os.Chmod(temporary, fs.FileMode(request.mode)); err != nil { return err }
+	mtime := time.Unix(0, request.mtime)
+	if err = os.Chtimes(temporary, mtime, mtime); err != nil { return err }
+	if existing, errStat := os.Lstat(request.path); errStat == nil && existing.IsDir() { // directory, replaced with file
+		if err = os.RemoveAll(request.path); err != nil { return err }
+	}
+	if err = os.Rename(temporary, request.path); err != nil { return err }
+	agent.uploading = ""
+	agent.temporary = ""
+	return nil
+}
+func (agent *Agent) abandon() { // removes temporary file of unfinished upload
+	if agent.temporary != "" { _ = os.Remove(agent.temporary) }
+	agent.uploading = ""
+	agent.temporary = ""
+}
+func (*Agent) list(dir string, checksums bool, record func([]byte) error) error {
+	return filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) { return nil }
+			return err
+		}
+		relative, errRelative := filepath.Rel(dir, path)
+		if errRelative != nil { return errRelative }
+		if info.Mode() & os.ModeSymlink != 0 && relative != "." {
+			link, errLink := os.Readlink(path)
+			if errLink != nil { return errLink }
+			return record([]byte(fmt.Sprintf("%s%s\x00%s\x00", ManifestLinkPrefix, relative, link)))
+		}
+		if !info.Mode().IsRegular() { return nil }
+		checksum := "-"
+		if checksums {
+			if checksum, err = fileChecksum(path); err != nil { return err }
+		}
+		return record([]byte(fmt.Sprintf("%d %d %s %s\x00", info.Size(), info.ModTime().Unix(), checksum, relative)))
+	})
+}
+
+func executableChecksum() (string, error) { // identifies version of agent
+	executable, err := os.Executable()
+	if err != nil { return "", err }
+	return fileChecksum(executable)
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github.com/0leksandr/my.go"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -10,11 +15,45 @@ const TableModifications = "modifications"
 const ColumnTime = "time"
 const ColumnModification = "modification"
 
+const TableJournal = "journal"
+const ColumnTarget = "target"
+const ColumnQueue = "queue"
+
+const TableSpilled = "spilled"
+const ColumnReservoir = "reservoir"
+const ColumnSeq = "seq"
+
+const ArchiveSchema = `
+CREATE TABLE IF NOT EXISTS "modifications" (
+	"id"	INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"time"	INTEGER NOT NULL,
+	"modification"	TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS "journal" (
+	"target"	TEXT NOT NULL PRIMARY KEY,
+	"queue"	TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS "spilled" (
+	"reservoir"	TEXT NOT NULL,
+	"seq"	INTEGER NOT NULL,
+	"modification"	TEXT NOT NULL,
+	PRIMARY KEY ("reservoir", "seq")
+);`
+
 type Archive struct {
-	db my.DB
+	db   my.DB
+	path string // for statements, which `my.DB` does not support
+}
+func (Archive) New(path string) Archive {
+	return Archive{db: my.DB{}.New(path), path: path}
 }
-func (Archive) New(db my.DB) Archive {
-	return Archive{db}
+func (Archive) Open(path string) (Archive, error) { // creates database, if it does not exist
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil { return Archive{}, err }
+	db, err := sql.Open("sqlite3", path)
+	if err != nil { return Archive{}, err }
+	defer db.Close()
+	if _, err = db.Exec(ArchiveSchema); err != nil { return Archive{}, err }
+	return Archive{}.New(path), nil
 }
 func (archive Archive) Save(modifications <-chan Modification) {
 	for modification := range modifications {
@@ -54,6 +93,84 @@ func (archive Archive) Delete(from, to time.Time) {
 		},
 	)
 }
+func (archive Archive) Journal(target string, queue Serialized) { // replaces previous one atomically
+	db, err := sql.Open("sqlite3", archive.path)
+	PanicIf(err)
+	defer db.Close()
+	_, err = db.Exec(
+		fmt.Sprintf(`INSERT OR REPLACE INTO "%s" ("%s", "%s") VALUES (?, ?)`, TableJournal, ColumnTarget, ColumnQueue),
+		target,
+		jsonSerialize(queue),
+	)
+	PanicIf(err)
+}
+func (archive Archive) Journaled(target string) Serialized { // nil, if nothing was journaled
+	rows := archive.db.SelectMany(
+		TableJournal,
+		[]string{ColumnQueue},
+		map[string]interface{}{ColumnTarget + " = ?": target},
+		nil,
+	)
+	if len(rows) == 0 { return nil }
+	return decodeToSerialized(jsonDeserialize(rows[0][ColumnQueue].(string)))
+}
+func (archive Archive) Spill(reservoir string, seq int, modifications []Modification) { // with sequence numbers from `seq`
+	db, err := sql.Open("sqlite3", archive.path)
+	PanicIf(err)
+	defer db.Close()
+	tx, err := db.Begin()
+	PanicIf(err)
+	defer func() { _ = tx.Rollback() }() // no-op after commit
+	statement, err := tx.Prepare(fmt.Sprintf(
+		`INSERT INTO "%s" ("%s", "%s", "%s") VALUES (?, ?, ?)`,
+		TableSpilled,
+		ColumnReservoir,
+		ColumnSeq,
+		ColumnModification,
+	))
+	PanicIf(err)
+	defer statement.Close()
+	for i, modification := range modifications {
+		_, err = statement.Exec(reservoir, seq + i, jsonSerialize(modification.Serialize()))
+		PanicIf(err)
+	}
+	PanicIf(tx.Commit())
+}
+func (archive Archive) Unspill(reservoir string, from, to int) []Modification { // and forgets them
+	where := map[string]interface{}{
+		ColumnReservoir + " = ?": reservoir,
+		ColumnSeq + " >= ?":      from,
+		ColumnSeq + " < ?":       to,
+	}
+	rows := archive.db.SelectMany(TableSpilled, []string{ColumnModification}, where, []string{ColumnSeq})
+	archive.db.Delete(TableSpilled, where)
+	modifications := make([]Modification, 0, len(rows))
+	for _, row := range rows {
+		modifications = append(
+			modifications,
+			deserializeModification(decodeToSerialized(jsonDeserialize(row[ColumnModification].(string)))),
+		)
+	}
+	return modifications
+}
+func (archive Archive) ForgetSpilled(isStale func(reservoir string) bool) { // f.e. left by crashed processes
+	db, err := sql.Open("sqlite3", archive.path)
+	PanicIf(err)
+	defer db.Close()
+	rows, err := db.Query(fmt.Sprintf(`SELECT DISTINCT "%s" FROM "%s"`, ColumnReservoir, TableSpilled))
+	PanicIf(err)
+	var stale []string
+	for rows.Next() {
+		var reservoir string
+		PanicIf(rows.Scan(&reservoir))
+		if isStale(reservoir) { stale = append(stale, reservoir) }
+	}
+	PanicIf(rows.Err())
+	PanicIf(rows.Close())
+	for _, reservoir := range stale {
+		archive.db.Delete(TableSpilled, map[string]interface{}{ColumnReservoir + " = ?": reservoir})
+	}
+}
 
 func jsonSerialize(v interface{}) string {
 	res, err := json.Marshal(v)
@@ -10,7 +10,7 @@ import (
 func TestArchive(t *testing.T) {
 	currentDir, err := os.Getwd()
 	PanicIf(err)
-	archive := Archive{}.New(my.DB{}.New(currentDir + "/sandbox/test.db"))
+	archive := Archive{}.New(currentDir + "/sandbox/test.db")
 	modifications := []Modification{
 		Updated{Path{}.New("a")},
 		Deleted{Path{}.New("b")},
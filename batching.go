@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var DefaultBatchWindows = BatchWindows{wait: 500 * time.Millisecond, maxWait: 5 * time.Second}
+
+const LinkMeterSmallBatch = 64 << 10 // bytes. Duration of syncing smaller batches is considered round-trip time
+const LinkMeterSmoothing = 0.3       // weight of latest measurement
+const AdaptiveBatchBytes = 1 << 20   // slow links should gather at least this much into one batch
+
+type BatchWindows struct { // modifications are grouped into a batch, until one of windows passes
+	wait     time.Duration // since last modification
+	maxWait  time.Duration // since first modification
+	adaptive bool          // windows are tuned to measured speed of remote host
+}
+func (windows BatchWindows) Adapted(meter *LinkMeter) BatchWindows {
+	if !windows.adaptive || meter == nil { return windows }
+	rtt, throughput := meter.Measured()
+	if rtt == 0 { return windows } // not measured yet
+
+	// while one sync operation takes `rtt` anyway, waiting about as long costs little, but saves operations
+	adapted := windows
+	adapted.wait = clampDuration(2 * rtt, 20 * time.Millisecond, 5 * time.Second)
+	adapted.maxWait = 10 * adapted.wait
+	if throughput > 0 { adapted.maxWait += time.Duration(AdaptiveBatchBytes / throughput * float64(time.Second)) }
+	adapted.maxWait = clampDuration(adapted.maxWait, adapted.wait, time.Minute)
+	return adapted
+}
+
+type LinkMeter struct { // measures speed of remote host. Shared between copies of `RemoteManager`
+	rtt        time.Duration
+	throughput float64 // bytes per second
+	mx         sync.Mutex
+}
+func (meter *LinkMeter) Record(size int64, duration time.Duration) { // of successful sync operation
+	if meter == nil { return }
+	meter.mx.Lock()
+	defer meter.mx.Unlock()
+	if size < LinkMeterSmallBatch {
+		meter.rtt = time.Duration(smooth(float64(meter.rtt), float64(duration)))
+	} else if transfer := duration - meter.rtt; meter.rtt > 0 && transfer > 0 {
+		meter.throughput = smooth(meter.throughput, float64(size) / transfer.Seconds())
+	}
+}
+func (meter *LinkMeter) Measured() (time.Duration, float64) {
+	meter.mx.Lock()
+	defer meter.mx.Unlock()
+	return meter.rtt, meter.throughput
+}
+
+func smooth(average, latest float64) float64 { // exponential moving average
+	if average == 0 { return latest }
+	return average + LinkMeterSmoothing * (latest - average)
+}
+
+func clampDuration(duration, min, max time.Duration) time.Duration {
+	if duration < min { return min }
+	if duration > max { return max }
+	return duration
+}
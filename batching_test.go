@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/0leksandr/my.go"
+	"testing"
+	"time"
+)
+
+func TestBatchWindows_Adapted(t *testing.T) {
+	windows := BatchWindows{wait: time.Second, maxWait: 10 * time.Second, adaptive: true}
+	meter := &LinkMeter{}
+	my.AssertEquals(t, windows.Adapted(meter), windows) // not measured yet
+	my.AssertEquals(t, BatchWindows{wait: time.Second}.Adapted(nil), BatchWindows{wait: time.Second})
+
+	meter.Record(100, 5 * time.Millisecond) // fast link
+	fast := windows.Adapted(meter)
+	my.AssertEquals(t, fast.wait, 20 * time.Millisecond)
+	my.AssertEquals(t, fast.maxWait, 200 * time.Millisecond)
+
+	meter.Record(0, 405 * time.Millisecond)
+	rtt, _ := meter.Measured()
+	my.AssertEquals(t, rtt, 125 * time.Millisecond) // smoothed
+	meter.Record(1 << 20, rtt + 4 * time.Second) // 256Kb/s
+	_, throughput := meter.Measured()
+	my.AssertEquals(t, throughput, float64(256 << 10))
+	slow := windows.Adapted(meter)
+	my.AssertEquals(t, slow.wait, 250 * time.Millisecond)
+	my.AssertEquals(t, slow.maxWait, 2500 * time.Millisecond + 4 * time.Second)
+
+	windows.adaptive = false
+	my.AssertEquals(t, windows.Adapted(meter), windows)
+}
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
+const InPlaceMarker = "sshmirror-inplace" // prefix of lines, reporting outcomes of in-place modifications
+
 type RemoteCommander interface {
 	MoveCommand(from, to Path) string
 	DeleteCommand(path Path) string
+	InPlaceCommand(modifications []InPlaceModification) string
+	ListCommand() string
+	ChecksumsCommand() string
 }
 
 type UnixCommander struct {
@@ -26,6 +36,84 @@ func (commander UnixCommander) DeleteCommand(path Path) string {
 
 	return fmt.Sprintf("rm -rf -- %s", path.original.Escaped())
 }
+func (commander UnixCommander) InPlaceCommand(modifications []InPlaceModification) string {
+	// each modification reports its outcome with a line "<marker> <index> <outcome> [<error>]". Missing source is
+	// reported separately, as it happens in legitimate cases - see test cases
+	commands := make([]string, 0, len(modifications))
+	for i, modification := range modifications {
+		commands = append(commands, fmt.Sprintf(
+			`if [ -e %[1]s ] || [ -L %[1]s ]; then `+
+				`if err=$( { %[2]s ; } 2>&1 ); then echo '%[3]s %[4]d %[5]s'; `+
+				`else echo "%[3]s %[4]d %[6]s $(printf %%s "$err" | tr '\n' ' ')"; fi; `+
+				`else echo '%[3]s %[4]d %[7]s'; fi`,
+			modification.OldFilename().Escaped(),
+			modification.Command(commander),
+			InPlaceMarker,
+			i,
+			InPlaceApplied,
+			InPlaceFailed,
+			InPlaceGone,
+		))
+	}
+	return strings.Join(commands, " ; ")
+}
 func (commander UnixCommander) MkdirCommand(dir Path) string {
 	return fmt.Sprintf("mkdir -p -- %s", dir.original.Escaped())
 }
+func (commander UnixCommander) ListCommand() string {
+	// GNU `find -printf` is fastest. BusyBox and BSD have none, thus files are stat'ed one by one
+	return `if find . -maxdepth 0 -printf '' 2>/dev/null; then ` +
+		`find . -type f -printf '%s %T@ %P\0' -o -type l -printf '` + ManifestLinkPrefix + `%P\0%l\0'; ` +
+		`else ` +
+		`if stat -c %s . >/dev/null 2>&1; then format='-c %s %Y'; ` + // GNU, BusyBox
+		`elif stat -f %z . >/dev/null 2>&1; then format='-f %z %m'; ` + // BSD
+		`else echo 'sshmirror: listing needs GNU find, or stat with -c or -f' >&2; exit 127; fi; ` +
+		`command -v readlink >/dev/null || { echo 'sshmirror: listing needs readlink' >&2; exit 127; }; ` +
+		`find . \( -type f -o -type l \) -exec sh -c '` +
+		`option=${1%% *}; fields=${1#* }; shift; ` +
+		`for file; do ` +
+		`if [ -L "$file" ]; then ` +
+		`printf "%s%s\0%s\0" "` + ManifestLinkPrefix + `" "${file#./}" "$(readlink "$file")"; ` +
+		`else printf "%s %s\0" "$(stat "$option" "$fields" "$file")" "${file#./}"; fi; ` +
+		`done' sh "$format" {} +; ` +
+		`fi`
+}
+func (commander UnixCommander) ChecksumsCommand() string {
+	// `sha1sum -z` is GNU only. Otherwise, checksum of each file is printed in the same format
+	return `if sha1sum -z </dev/null >/dev/null 2>&1; then find . -type f -exec sha1sum -z -- {} +; ` +
+		`else ` +
+		`if command -v sha1sum >/dev/null; then hash=sha1sum; ` + // BusyBox
+		`elif command -v shasum >/dev/null; then hash='shasum -a 1'; ` + // macOS
+		`elif command -v sha1 >/dev/null; then hash=sha1; ` + // BSD
+		`else echo 'sshmirror: checksums need sha1sum, shasum or sha1' >&2; exit 127; fi; ` +
+		`find . -type f -exec sh -c '` +
+		`hash=$1; shift; ` +
+		`for file; do sum=$($hash <"$file") || continue; printf "%s  %s\0" "${sum%% *}" "$file"; done` +
+		`' sh "$hash" {} +; ` +
+		`fi`
+}
+
+func parseInPlaceReport(output []byte, modifications []InPlaceModification) []InPlaceResult {
+	results := InPlaceResult{}.All(modifications, InPlaceFailed)
+	reported := make([]bool, len(modifications))
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", 4)
+		if len(parts) < 3 || parts[0] != InPlaceMarker { continue }
+		index, err := strconv.Atoi(parts[1])
+		if err != nil || index < 0 || index >= len(results) { continue }
+		reported[index] = true
+		switch parts[2] {
+			case InPlaceApplied.String(): results[index].Outcome = InPlaceApplied
+			case InPlaceGone.String():    results[index].Outcome = InPlaceGone
+			default:
+				message := "unknown error"
+				if len(parts) == 4 && strings.TrimSpace(parts[3]) != "" { message = strings.TrimSpace(parts[3]) }
+				results[index].Err = errors.New(message)
+		}
+	}
+	for i := range results {
+		if !reported[i] { results[i].Err = errors.New("outcome was not reported") }
+	}
+	return results
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/0leksandr/my.go"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixCommander_InPlaceCommand(t *testing.T) {
+	dir := t.TempDir()
+	PanicIf(os.WriteFile(filepath.Join(dir, "a"), []byte{}, 0644))
+	PanicIf(os.WriteFile(filepath.Join(dir, "file"), []byte{}, 0644))
+	PanicIf(os.WriteFile(filepath.Join(dir, "it's"), []byte{}, 0644))
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+	modifications := []InPlaceModification{
+		Moved{from: path("a"), to: path("dir/b")},
+		Moved{from: path("missing"), to: path("c")},
+		Moved{from: path("it's"), to: path("file/d")}, // parent is a file
+		Deleted{path("missing")},
+		Deleted{path("dir")},
+	}
+	command := exec.Command("sh", "-c", UnixCommander{}.InPlaceCommand(modifications))
+	command.Dir = dir
+	output, err := command.Output()
+	PanicIf(err)
+	results := parseInPlaceReport(output, modifications)
+
+	outcomes := make([]InPlaceOutcome, 0, len(results))
+	for _, result := range results { outcomes = append(outcomes, result.Outcome) }
+	my.AssertEquals(
+		t,
+		outcomes,
+		[]InPlaceOutcome{InPlaceApplied, InPlaceGone, InPlaceFailed, InPlaceGone, InPlaceApplied},
+	)
+	my.Assert(t, results[2].Err != nil && results[2].Err.Error() != "")
+	_, err = os.Stat(filepath.Join(dir, "dir"))
+	my.Assert(t, os.IsNotExist(err))
+
+	results = parseInPlaceReport([]byte(InPlaceMarker + " 0 ok\n"), modifications[:2]) // interrupted
+	my.AssertEquals(t, results[0].Outcome, InPlaceApplied)
+	my.AssertEquals(t, results[1].Outcome, InPlaceFailed)
+}
+
+func TestUnixCommander_Manifest(t *testing.T) {
+	dir := t.TempDir()
+	PanicIf(os.MkdirAll(filepath.Join(dir, "s p"), 0755))
+	PanicIf(os.WriteFile(filepath.Join(dir, "a"), []byte("abc"), 0644))
+	PanicIf(os.WriteFile(filepath.Join(dir, "s p/b c"), []byte("x"), 0644))
+	PanicIf(os.Symlink("a", filepath.Join(dir, "link")))
+	shims := t.TempDir() // `find` without `-printf` and `sha1sum` without `-z`, like BusyBox ones
+	for name, option := range map[string]string{"find": "-printf", "sha1sum": "-z"} {
+		real, err := exec.LookPath(name)
+		PanicIf(err)
+		PanicIf(os.WriteFile(
+			filepath.Join(shims, name),
+			[]byte("#!/bin/sh\nfor a; do [ \"$a\" = " + option + " ] && exit 1; done\nexec " + real + " \"$@\"\n"),
+			0755,
+		))
+	}
+	manifest := func(path string) (Manifest, error) {
+		output := func(command string) []byte {
+			cmd := exec.Command("sh", "-c", command)
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), "PATH=" + path)
+			output, err := cmd.Output()
+			PanicIf(err)
+			return output
+		}
+		return Manifest{}.Parse(output(UnixCommander{}.ListCommand()), output(UnixCommander{}.ChecksumsCommand()))
+	}
+
+	gnu, err := manifest(os.Getenv("PATH"))
+	PanicIf(err)
+	my.AssertEquals(t, len(gnu), 3)
+	my.AssertEquals(t, gnu["s p/b c"].checksum, "11f6ad8ec52a2984abaafd7c3b516503785c2072")
+	my.AssertEquals(t, gnu["link"], ManifestEntry{link: "a"})
+	portable, err := manifest(shims + string(os.PathListSeparator) + os.Getenv("PATH"))
+	PanicIf(err)
+	my.AssertEquals(t, portable, gnu)
+}
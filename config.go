@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Profile struct { // values of `Config`, that can be set in config file. Empty (nil) value means "not set"
+	LocalDir     string           `toml:"local"             yaml:"local"`
+	RemoteHost   string           `toml:"host"              yaml:"host"`
+	RemoteDir    string           `toml:"remote"            yaml:"remote"`
+	Targets      []ProfileTarget  `toml:"targets"           yaml:"targets"`       // many destinations
+	Mappings     []ProfileMapping `toml:"mappings"          yaml:"mappings"`      // many directories
+	IdentityFile string           `toml:"identity"          yaml:"identity"`
+	Exclude      []string         `toml:"exclude"           yaml:"exclude"`
+	Gitignore    *bool            `toml:"gitignore"         yaml:"gitignore"`
+	Transport    string           `toml:"transport"         yaml:"transport"`
+	SFTP         *bool            `toml:"sftp"              yaml:"sftp"`
+	Agent        *bool            `toml:"agent"             yaml:"agent"`
+	Watcher      string           `toml:"watcher"           yaml:"watcher"`
+	PollInterval string           `toml:"poll-interval"     yaml:"poll-interval"` // f.e. "500ms"
+	ConnTimeout  *int             `toml:"timeout"           yaml:"timeout"`       // seconds
+	BatchSize    *uint64          `toml:"batch-size"        yaml:"batch-size"`    // megabytes
+	Checksums    *bool            `toml:"checksums"         yaml:"checksums"`
+	DeleteExtra  *bool            `toml:"delete-extraneous" yaml:"delete-extraneous"`
+	Verbosity    *int             `toml:"verbosity"         yaml:"verbosity"`
+	ErrorCmd     string           `toml:"error-cmd"         yaml:"error-cmd"`
+
+	RetryAttempts *int   `toml:"retry-attempts"  yaml:"retry-attempts"`
+	RetryDelay    string `toml:"retry-delay"     yaml:"retry-delay"` // f.e. "1s"
+	RetryMaxDelay string `toml:"retry-max-delay" yaml:"retry-max-delay"`
+
+	SyncTimeout    string `toml:"sync-timeout"     yaml:"sync-timeout"` // f.e. "30s"
+	SyncTimeoutMax string `toml:"sync-timeout-max" yaml:"sync-timeout-max"`
+
+	BatchWait        string `toml:"batch-wait"        yaml:"batch-wait"` // f.e. "500ms"
+	BatchMaxWait     string `toml:"batch-max-wait"    yaml:"batch-max-wait"`
+	AdaptiveBatching *bool  `toml:"adaptive-batching" yaml:"adaptive-batching"`
+
+	GuardFiles *int     `toml:"guard-files" yaml:"guard-files"`
+	GuardSize  *uint64  `toml:"guard-size"  yaml:"guard-size"` // megabytes
+	Protect    []string `toml:"protect"     yaml:"protect"`
+
+	Trash        *bool   `toml:"trash"          yaml:"trash"`
+	TrashMaxAge  string  `toml:"trash-max-age"  yaml:"trash-max-age"`  // f.e. "168h"
+	TrashMaxSize *uint64 `toml:"trash-max-size" yaml:"trash-max-size"` // megabytes
+
+	Journal *string `toml:"journal" yaml:"journal"` // empty disables
+	Control string  `toml:"control" yaml:"control"` // "none" disables
+}
+func (profile Profile) Merge(override Profile) Profile {
+	if override.LocalDir     != "" { profile.LocalDir     = override.LocalDir     }
+	if override.RemoteHost   != "" { profile.RemoteHost   = override.RemoteHost   }
+	if override.RemoteDir    != "" { profile.RemoteDir    = override.RemoteDir    }
+	if override.Targets      != nil { profile.Targets     = override.Targets      }
+	if override.Mappings     != nil { profile.Mappings    = override.Mappings     }
+	if override.IdentityFile != "" { profile.IdentityFile = override.IdentityFile }
+	if override.Exclude      != nil { profile.Exclude     = override.Exclude      }
+	if override.Gitignore    != nil { profile.Gitignore   = override.Gitignore    }
+	if override.Transport    != "" { profile.Transport    = override.Transport    }
+	if override.SFTP         != nil { profile.SFTP        = override.SFTP         }
+	if override.Agent        != nil { profile.Agent       = override.Agent        }
+	if override.Watcher      != "" { profile.Watcher      = override.Watcher      }
+	if override.PollInterval != "" { profile.PollInterval = override.PollInterval }
+	if override.ConnTimeout  != nil { profile.ConnTimeout = override.ConnTimeout  }
+	if override.BatchSize    != nil { profile.BatchSize   = override.BatchSize    }
+	if override.Checksums    != nil { profile.Checksums   = override.Checksums    }
+	if override.DeleteExtra  != nil { profile.DeleteExtra = override.DeleteExtra  }
+	if override.Verbosity    != nil { profile.Verbosity   = override.Verbosity    }
+	if override.ErrorCmd     != "" { profile.ErrorCmd     = override.ErrorCmd     }
+
+	if override.RetryAttempts != nil { profile.RetryAttempts = override.RetryAttempts }
+	if override.RetryDelay    != "" { profile.RetryDelay     = override.RetryDelay    }
+	if override.RetryMaxDelay != "" { profile.RetryMaxDelay  = override.RetryMaxDelay }
+
+	if override.SyncTimeout    != "" { profile.SyncTimeout    = override.SyncTimeout    }
+	if override.SyncTimeoutMax != "" { profile.SyncTimeoutMax = override.SyncTimeoutMax }
+
+	if override.BatchWait        != "" { profile.BatchWait         = override.BatchWait        }
+	if override.BatchMaxWait     != "" { profile.BatchMaxWait      = override.BatchMaxWait     }
+	if override.AdaptiveBatching != nil { profile.AdaptiveBatching = override.AdaptiveBatching }
+
+	if override.GuardFiles != nil { profile.GuardFiles = override.GuardFiles }
+	if override.GuardSize  != nil { profile.GuardSize  = override.GuardSize  }
+	if override.Protect    != nil { profile.Protect    = override.Protect    }
+
+	if override.Trash        != nil { profile.Trash        = override.Trash        }
+	if override.TrashMaxAge  != "" { profile.TrashMaxAge   = override.TrashMaxAge  }
+	if override.TrashMaxSize != nil { profile.TrashMaxSize = override.TrashMaxSize }
+
+	if override.Journal != nil { profile.Journal = override.Journal }
+	if override.Control != "" { profile.Control  = override.Control }
+	return profile
+}
+func (profile Profile) GetTargets() []RemoteTarget {
+	if profile.Targets == nil {
+		if profile.RemoteHost == "" && profile.RemoteDir == "" { return nil }
+		return []RemoteTarget{RemoteTarget{host: profile.RemoteHost, dir: profile.RemoteDir}.normalized()}
+	}
+	targets := make([]RemoteTarget, 0, len(profile.Targets))
+	for _, target := range profile.Targets {
+		host, dir := target.Host, target.Remote
+		if host == "" { host = profile.RemoteHost } // f.e. same host, different directories
+		if dir == "" { dir = profile.RemoteDir }
+		targets = append(targets, RemoteTarget{host: host, dir: dir}.normalized())
+	}
+	return targets
+}
+func (profile Profile) GetPollInterval() (time.Duration, error) {
+	if profile.PollInterval == "" { return 0, nil }
+	return time.ParseDuration(profile.PollInterval)
+}
+
+type ProfileTarget struct {
+	Host   string `toml:"host"   yaml:"host"`
+	Remote string `toml:"remote" yaml:"remote"`
+}
+
+type ProfileMapping struct {
+	Local  string `toml:"local"  yaml:"local"`
+	Remote string `toml:"remote" yaml:"remote"`
+}
+
+type ConfigFile struct {
+	Profile  `yaml:",inline"` // defaults for all profiles
+	Profiles map[string]Profile `toml:"profiles" yaml:"profiles"`
+
+	path string
+}
+func (ConfigFile) Find() (string, error) { // empty, if there is no config file
+	var candidates []string
+	for _, name := range []string{".sshmirror.toml", ".sshmirror.yaml", ".sshmirror.yml"} { // project root
+		candidates = append(candidates, name)
+	}
+	if usr, err := user.Current(); err == nil {
+		for _, name := range []string{"config.toml", "config.yaml", "config.yml"} {
+			candidates = append(candidates, filepath.Join(usr.HomeDir, ".config", "sshmirror", name))
+		}
+	}
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err == nil && !info.IsDir() { return filepath.Abs(candidate) }
+		if err != nil && !os.IsNotExist(err) { return "", err }
+	}
+	return "", nil
+}
+func (ConfigFile) Load(path string) (ConfigFile, error) {
+	configFile := ConfigFile{path: path}
+	contents, err := os.ReadFile(path)
+	if err != nil { return configFile, err }
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+		case ".toml":
+			metadata, errDecode := toml.Decode(string(contents), &configFile)
+			if errDecode != nil { return configFile, fmt.Errorf("%s: %w", path, errDecode) }
+			if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+				return configFile, fmt.Errorf("%s: unknown key: %s", path, undecoded[0].String())
+			}
+		case ".yaml", ".yml":
+			decoder := yaml.NewDecoder(strings.NewReader(string(contents)))
+			decoder.KnownFields(true)
+			if errDecode := decoder.Decode(&configFile); errDecode != nil && !errors.Is(errDecode, io.EOF) {
+				return configFile, fmt.Errorf("%s: %w", path, errDecode)
+			}
+		default:
+			return configFile, errors.New("unknown format of config file: " + path)
+	}
+	return configFile, nil
+}
+func (configFile ConfigFile) Get(name string) (Profile, error) { // empty name means defaults
+	profile := configFile.Profile
+	if name != "" {
+		named, ok := configFile.Profiles[name]
+		if !ok {
+			return profile, fmt.Errorf(
+				"profile \"%s\" not found in %s. Available profiles: %s",
+				name,
+				configFile.path,
+				strings.Join(configFile.ProfileNames(), ", "),
+			)
+		}
+		profile = profile.Merge(named)
+	}
+	if profile.LocalDir != "" { // relative to config file
+		profile.LocalDir = expandHome(profile.LocalDir)
+		if !filepath.IsAbs(profile.LocalDir) && configFile.path != "" {
+			profile.LocalDir = filepath.Join(filepath.Dir(configFile.path), profile.LocalDir)
+		}
+	}
+	if profile.IdentityFile != "" { profile.IdentityFile = expandHome(profile.IdentityFile) }
+	return profile, nil
+}
+func (configFile ConfigFile) ProfileNames() []string {
+	names := make([]string, 0, len(configFile.Profiles))
+	for name := range configFile.Profiles { names = append(names, name) }
+	sort.Strings(names)
+	return names
+}
+
+func expandHome(path string) string {
+	if len(path) >= 2 && path[:2] == "~/" {
+		usr, err := user.Current()
+		PanicIf(err)
+		return filepath.Join(usr.HomeDir, path[2:])
+	}
+	return path
+}
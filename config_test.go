@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/0leksandr/my.go"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	formats := map[string]string{
+		".sshmirror.toml": `
+identity = "/keys/id_rsa"
+exclude = ['^\.git/']
+timeout = 10
+
+[profiles.staging]
+local = "src"
+host = "user@staging"
+remote = "/var/www/project"
+exclude = ['^\.git/', '^vendor/']
+verbosity = 3
+
+[profiles.prod]
+local = "/home/user/project"
+host = "prod"
+remote = "/srv/project"
+watcher = "poll"
+poll-interval = "500ms"
+`,
+		".sshmirror.yaml": `
+identity: /keys/id_rsa
+exclude: ['^\.git/']
+timeout: 10
+profiles:
+  staging:
+    local: src
+    host: user@staging
+    remote: /var/www/project
+    exclude: ['^\.git/', '^vendor/']
+    verbosity: 3
+  prod:
+    local: /home/user/project
+    host: prod
+    remote: /srv/project
+    watcher: poll
+    poll-interval: 500ms
+`,
+	}
+	for name, contents := range formats {
+		path := filepath.Join(dir, name)
+		PanicIf(os.WriteFile(path, []byte(contents), 0644))
+		configFile, err := ConfigFile{}.Load(path)
+		PanicIf(err)
+		my.AssertEquals(t, configFile.ProfileNames(), []string{"prod", "staging"})
+
+		staging, err := configFile.Get("staging")
+		PanicIf(err)
+		my.AssertEquals(t, staging.LocalDir, filepath.Join(dir, "src"))
+		my.AssertEquals(t, staging.RemoteHost, "user@staging")
+		my.AssertEquals(t, staging.IdentityFile, "/keys/id_rsa")
+		my.AssertEquals(t, staging.Exclude, []string{`^\.git/`, `^vendor/`})
+		my.AssertEquals(t, *staging.ConnTimeout, 10)
+		my.AssertEquals(t, *staging.Verbosity, 3)
+		my.Assert(t, staging.BatchSize == nil)
+
+		prod, err := configFile.Get("prod")
+		PanicIf(err)
+		my.AssertEquals(t, prod.LocalDir, "/home/user/project")
+		my.AssertEquals(t, prod.Exclude, []string{`^\.git/`})
+		my.AssertEquals(t, prod.Watcher, "poll")
+		interval, err := prod.GetPollInterval()
+		PanicIf(err)
+		my.AssertEquals(t, interval.Milliseconds(), int64(500))
+
+		_, err = configFile.Get("missing")
+		my.Assert(t, err != nil)
+	}
+
+	my.AssertEquals(
+		t,
+		Profile{
+			RemoteHost: "host",
+			RemoteDir:  "/default",
+			Targets:    []ProfileTarget{{Remote: "/a"}, {Host: "other"}, {Remote: "file:///mnt/b"}},
+		}.GetTargets(),
+		[]RemoteTarget{{host: "host", dir: "/a"}, {host: "other", dir: "/default"}, {dir: "/mnt/b"}},
+	)
+
+	unknownKey := filepath.Join(dir, "unknown.toml")
+	PanicIf(os.WriteFile(unknownKey, []byte("hots = \"typo\"\n"), 0644))
+	_, err := ConfigFile{}.Load(unknownKey)
+	my.Assert(t, err != nil)
+}
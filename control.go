@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const CommandCtl = "ctl"
+const ControlNone = "none" // disables control socket
+const ControlErrorPrefix = "error: "
+
+const ControlStatus = "status"
+const ControlPause = "pause"
+const ControlResume = "resume"
+const ControlFlush = "flush"
+const ControlResync = "resync"
+const ControlConfirm = "confirm"
+const ControlStop = "stop"
+const ControlStopTimeout = 5 * time.Minute // for syncing queued modifications
+
+func DefaultControlPath(localDir string) string { // one per local directory
+	if abs, err := filepath.Abs(localDir); err == nil { localDir = abs }
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(localDir))
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" { // private to user
+		return filepath.Join(runtimeDir, fmt.Sprintf("sshmirror-%08x.sock", hash.Sum32()))
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("sshmirror-%d-%08x.sock", os.Getuid(), hash.Sum32()))
+}
+
+type ControlServer struct { // accepts one-line requests: COMMAND [ARGUMENT]. Response is written until closing
+	listener net.Listener
+	handle   func(command string, argument string, out io.Writer) error
+	logger   Logger
+}
+func (ControlServer) Listen(
+	path string,
+	handle func(command string, argument string, out io.Writer) error,
+	logger Logger,
+) (*ControlServer, error) {
+	if _, err := os.Stat(path); err == nil {
+		if connection, errDial := net.Dial("unix", path); errDial == nil {
+			_ = connection.Close()
+			return nil, errors.New("control socket is used by another sshmirror: " + path)
+		}
+		if err = os.Remove(path); err != nil { return nil, err } // left by killed one
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil { return nil, err }
+	if err = os.Chmod(path, 0600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return &ControlServer{listener: listener, handle: handle, logger: logger}, nil
+}
+func (server *ControlServer) Serve() { // until closed
+	for {
+		connection, err := server.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) { server.logger.Error(err.Error()) }
+			return
+		}
+		go server.serve(connection)
+	}
+}
+func (server *ControlServer) Close() error {
+	if server == nil { return nil }
+	return server.listener.Close() // also removes socket file
+}
+func (server *ControlServer) serve(connection net.Conn) {
+	defer connection.Close()
+	request, err := bufio.NewReader(connection).ReadString('\n')
+	if err != nil && (err != io.EOF || request == "") { return } // f.e. probing by another sshmirror
+	command, argument, _ := strings.Cut(strings.TrimSpace(request), " ")
+	server.logger.Debug("control request", command, argument)
+	if err = server.handle(command, strings.TrimSpace(argument), connection); err != nil {
+		_, _ = fmt.Fprintln(connection, ControlErrorPrefix + err.Error())
+	}
+}
+
+func RunCtl(arguments []string, out io.Writer) error { // client of control socket of running sshmirror
+	flags := flag.NewFlagSet(CommandCtl, flag.ContinueOnError)
+	cwd, _ := os.Getwd()
+	path := flags.String("control", DefaultControlPath(cwd), "control socket (default: the one of current directory)")
+	flags.Usage = func() {
+		WriteToStderr(
+			"Usage: " + os.Args[0] + " " + CommandCtl + " [-control=SOCKET] COMMAND [PATH]\n" +
+				"Commands:\n" +
+				"  " + ControlStatus + " - state, last error and queued modifications of each target\n" +
+				"  " + ControlPause + " - stop syncing after current batch. Modifications keep being queued\n" +
+				"  " + ControlResume + " - continue syncing\n" +
+				"  " + ControlFlush + " - sync queued modifications now, without waiting for batch windows\n" +
+				"  " + ControlResync + " PATH - upload (or delete) file or directory PATH (relative to SOURCE) again\n" +
+				"  " + ControlConfirm + " " + ConfirmYes + "|" + ConfirmNo + " - answer on guarded modifications\n" +
+				"  " + ControlStop + " - sync everything queued, and exit",
+		)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(arguments); errors.Is(err, flag.ErrHelp) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("command is required")
+	}
+
+	connection, err := net.Dial("unix", *path)
+	if err != nil { return fmt.Errorf("sshmirror is not running (or started with other -control): %w", err) }
+	defer connection.Close()
+	if _, err = fmt.Fprintln(connection, strings.Join(flags.Args(), " ")); err != nil { return err }
+	failed := false
+	scanner := bufio.NewScanner(connection)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ControlErrorPrefix) { failed = true }
+		_, _ = fmt.Fprintln(out, line)
+	}
+	if err = scanner.Err(); err != nil { return err }
+	if failed { return errors.New(CommandCtl + " " + flags.Arg(0) + " failed") }
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/0leksandr/my.go"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestControlServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	var requests []string
+	server, err := ControlServer{}.Listen(
+		path,
+		func(command string, argument string, out io.Writer) error {
+			requests = append(requests, command + "|" + argument)
+			if command == ControlStop { return errors.New("not now") }
+			_, err := io.WriteString(out, "ok\n")
+			return err
+		},
+		Logger{debug: NullLogger{}, error: &InMemoryErrorLogger{}},
+	)
+	PanicIf(err)
+	go server.Serve()
+	_, errSecond := ControlServer{}.Listen(path, nil, server.logger)
+	my.Assert(t, errSecond != nil) // in use
+
+	var out bytes.Buffer
+	PanicIf(RunCtl([]string{"-control=" + path, ControlResync, "dir/some file"}, &out))
+	my.AssertEquals(t, out.String(), "ok\n")
+	out.Reset()
+	my.Assert(t, RunCtl([]string{"-control=" + path, ControlStop}, &out) != nil)
+	my.AssertEquals(t, out.String(), ControlErrorPrefix + "not now\n")
+	my.AssertEquals(t, requests, []string{ControlResync + "|dir/some file", ControlStop + "|"})
+
+	PanicIf(server.Close())
+	my.Assert(t, RunCtl([]string{"-control=" + path, ControlStatus}, &out) != nil) // not running
+}
+
+func TestSSHMirror_Control(t *testing.T) {
+	target := TargetFixture{}.New(t, TestRemoteClient{updated: make(chan []Updated, 10)}, RemoteManager{})
+	client := &SSHMirror{targets: []*Target{target.Target}, logger: target.logger}
+	var out bytes.Buffer
+	for _, escaping := range []string{"../x", "..", "/etc/passwd", "a/../../x"} {
+		my.Assert(t, client.handleControl(ControlResync, escaping, &out) != nil)
+	}
+	my.AssertEquals(t, out.String(), "")
+
+	my.Assert(t, client.Drain(time.Second))
+	target.syncing.Lock() // f.e. held
+	my.Assert(t, !client.Drain(10 * time.Millisecond))
+	target.syncing.Unlock()
+
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1")
+	my.AssertEquals(t, filepath.Dir(DefaultControlPath("/a")), "/run/user/1")
+	my.Assert(t, DefaultControlPath("/a") != DefaultControlPath("/b"))
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const GitIgnoreFile = ".gitignore"
+const SSHMirrorIgnoreFile = ".sshmirrorignore"
+
+type Excluder interface { // decides, which local files are not mirrored
+	IsExcluded(path Path, isDir bool) bool // path is relative to local root
+	Reload(path Path) bool                 // if path is an ignore file, re-reads it. Returns whether it was
+}
+
+type StaticExcluder interface { // its exclusions never change. Can be passed to external watchers
+	Patterns() []string // regexps
+}
+
+func isExcluded(exclude Excluder, path Path, isDir bool) bool {
+	return exclude != nil && len(path.parts) > 0 && exclude.IsExcluded(path, isDir)
+}
+
+type Exclusions struct { // all configured excluders
+	Excluder
+	excluders []Excluder
+}
+func (Exclusions) New(root string, patterns []string, gitignore bool) (*Exclusions, error) {
+	own := []string{ // sshmirror's files in remote directory. Local ones (f.e. if it is a mirror itself) are not uploaded
+		"^" + regexp.QuoteMeta(TrashDir) + "/",
+		"^" + regexp.QuoteMeta(RemoteLockFile) + "$",
+		"(^|/)" + regexp.QuoteMeta(UploadingPrefix) + "[^/]*$",
+	}
+	regexps, err := RegexpExcluder{}.New(append(own, patterns...))
+	if err != nil { return nil, err }
+	ignoreFiles := []string{SSHMirrorIgnoreFile}
+	if gitignore { ignoreFiles = []string{GitIgnoreFile, SSHMirrorIgnoreFile} }
+	return &Exclusions{
+		excluders: []Excluder{regexps, IgnoreFilesExcluder{}.New(root, ignoreFiles)},
+	}, nil
+}
+func (exclusions *Exclusions) IsExcluded(path Path, isDir bool) bool {
+	for _, excluder := range exclusions.excluders {
+		if excluder.IsExcluded(path, isDir) { return true }
+	}
+	return false
+}
+func (exclusions *Exclusions) Patterns() []string {
+	var patterns []string
+	for _, excluder := range exclusions.excluders {
+		if static, ok := excluder.(StaticExcluder); ok { patterns = append(patterns, static.Patterns()...) }
+	}
+	return patterns
+}
+func (exclusions *Exclusions) Reload(path Path) bool {
+	reloaded := false
+	for _, excluder := range exclusions.excluders {
+		if excluder.Reload(path) { reloaded = true }
+	}
+	return reloaded
+}
+
+type MappedExcluder struct { // for paths, relative to local directory of mapping
+	Excluder
+	exclude Excluder // for paths, relative to local root
+	mapping Mapping
+}
+func (excluder MappedExcluder) IsExcluded(path Path, isDir bool) bool {
+	return excluder.exclude.IsExcluded(excluder.mapping.Unroute(path), isDir)
+}
+func (excluder MappedExcluder) Reload(path Path) bool {
+	return excluder.exclude.Reload(excluder.mapping.Unroute(path))
+}
+
+type RegexpExcluder struct { // `-e` flags
+	Excluder
+	regexps []*regexp.Regexp
+}
+func (RegexpExcluder) New(patterns []string) (RegexpExcluder, error) {
+	excluder := RegexpExcluder{}
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil { return excluder, err }
+		excluder.regexps = append(excluder.regexps, compiled)
+	}
+	return excluder, nil
+}
+func (excluder RegexpExcluder) IsExcluded(path Path, isDir bool) bool {
+	name := path.original.Real()
+	for _, _regexp := range excluder.regexps {
+		if _regexp.MatchString(name) { return true }
+		if isDir && _regexp.MatchString(name + "/") { return true } // f.e. `^\.git/` excludes `.git` itself
+	}
+	return false
+}
+func (excluder RegexpExcluder) Patterns() []string {
+	patterns := make([]string, 0, len(excluder.regexps))
+	for _, _regexp := range excluder.regexps { patterns = append(patterns, _regexp.String()) }
+	return patterns
+}
+func (RegexpExcluder) Reload(Path) bool {
+	return false
+}
+
+type IgnoreFilesExcluder struct { // files with `.gitignore` syntax, in any directory
+	Excluder
+	root  string
+	names []string
+	cache map[Filename][]IgnorePattern // directory => patterns of all its ignore files
+	mx    *sync.Mutex                  // accessing `cache`
+}
+func (IgnoreFilesExcluder) New(root string, names []string) IgnoreFilesExcluder {
+	return IgnoreFilesExcluder{
+		root:  root,
+		names: names,
+		cache: make(map[Filename][]IgnorePattern),
+		mx:    &sync.Mutex{},
+	}
+}
+func (excluder IgnoreFilesExcluder) IsExcluded(path Path, isDir bool) bool {
+	for i := 1; i < len(path.parts); i++ { // files of excluded directory can not be re-included
+		if excluder.matches(path.parts[:i], true) { return true }
+	}
+	return excluder.matches(path.parts, isDir)
+}
+func (excluder IgnoreFilesExcluder) Reload(path Path) bool {
+	if len(path.parts) == 0 || !excluder.isIgnoreFile(path.parts[len(path.parts) - 1]) { return false }
+	excluder.mx.Lock()
+	delete(excluder.cache, path.Parent().original)
+	excluder.mx.Unlock()
+	return true
+}
+func (excluder IgnoreFilesExcluder) matches(parts []string, isDir bool) bool {
+	excluded := false
+	for depth := 0; depth < len(parts); depth++ { // deeper ignore files take precedence
+		relative := strings.Join(parts[depth:], "/")
+		for _, pattern := range excluder.patterns(parts[:depth]) {
+			if pattern.Matches(relative, isDir) { excluded = !pattern.negative }
+		}
+	}
+	return excluded
+}
+func (excluder IgnoreFilesExcluder) patterns(dirParts []string) []IgnorePattern {
+	dir := Filename(strings.Join(dirParts, string(os.PathSeparator)))
+	excluder.mx.Lock()
+	defer excluder.mx.Unlock()
+	if patterns, ok := excluder.cache[dir]; ok { return patterns }
+
+	var patterns []IgnorePattern
+	for _, name := range excluder.names {
+		contents, err := os.ReadFile(filepath.Join(excluder.root, dir.Real(), name))
+		if err != nil { continue } // MAYBE: report errors other than "not exists"
+		patterns = append(patterns, IgnorePattern{}.ParseFile(contents)...)
+	}
+	excluder.cache[dir] = patterns
+	return patterns
+}
+func (excluder IgnoreFilesExcluder) isIgnoreFile(name string) bool {
+	for _, ignoreFile := range excluder.names {
+		if name == ignoreFile { return true }
+	}
+	return false
+}
+
+type IgnorePattern struct { // one line of `.gitignore`
+	regexp   *regexp.Regexp // matches path, relative to directory of ignore file
+	negative bool
+	dirOnly  bool
+}
+func (IgnorePattern) ParseFile(contents []byte) []IgnorePattern {
+	var patterns []IgnorePattern
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		if pattern, ok := (IgnorePattern{}.Parse(scanner.Text())); ok { patterns = append(patterns, pattern) }
+	}
+	return patterns
+}
+func (IgnorePattern) Parse(line string) (IgnorePattern, bool) { // see https://git-scm.com/docs/gitignore
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") { line = line[:len(line) - 1] }
+	if line == "" || line[0] == '#' { return IgnorePattern{}, false }
+
+	pattern := IgnorePattern{}
+	if line[0] == '!' {
+		pattern.negative = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" { return IgnorePattern{}, false }
+	anchored := strings.Contains(line, "/") // otherwise, matches on any level
+	line = strings.TrimPrefix(line, "/")
+
+	var expression strings.Builder
+	expression.WriteString("^")
+	if !anchored { expression.WriteString("(?:.*/)?") }
+	for i := 0; i < len(line); i++ {
+		switch char := line[i]; char {
+			case '*':
+				if i + 1 < len(line) && line[i + 1] == '*' && (i == 0 || line[i - 1] == '/') {
+					switch {
+						case i + 2 == len(line): // `foo/**`
+							expression.WriteString(".*")
+							i++
+							continue
+						case line[i + 2] == '/': // `**/foo`, `foo/**/bar`
+							expression.WriteString("(?:.*/)?")
+							i += 2
+							continue
+					}
+				}
+				expression.WriteString("[^/]*")
+			case '?':
+				expression.WriteString("[^/]")
+			case '[':
+				end := strings.IndexByte(line[i + 1:], ']')
+				if end < 0 {
+					expression.WriteString(regexp.QuoteMeta("["))
+					continue
+				}
+				class := line[i + 1 : i + 1 + end]
+				if strings.HasPrefix(class, "!") { class = "^" + class[1:] }
+				expression.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+				i += end + 1
+			case '\\':
+				if i + 1 < len(line) { i++ }
+				expression.WriteString(regexp.QuoteMeta(string(line[i])))
+			default:
+				expression.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	expression.WriteString("$")
+
+	compiled, err := regexp.Compile(expression.String())
+	if err != nil { return IgnorePattern{}, false } // invalid patterns are ignored, like git does
+	pattern.regexp = compiled
+	return pattern, true
+}
+func (pattern IgnorePattern) Matches(relative string, isDir bool) bool {
+	if pattern.dirOnly && !isDir { return false }
+	return pattern.regexp.MatchString(relative)
+}
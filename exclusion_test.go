@@ -0,0 +1,145 @@
+package main
+
+import (
+	"github.com/0leksandr/my.go"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnorePattern(t *testing.T) {
+	type Case struct {
+		relative string
+		isDir    bool
+		matches  bool
+	}
+	for line, cases := range map[string][]Case{
+		"*.log": {
+			{"debug.log", false, true},
+			{"logs/debug.log", false, true},
+			{"debug.log.txt", false, false},
+		},
+		"/build": {
+			{"build", true, true},
+			{"src/build", true, false},
+		},
+		"tmp/": {
+			{"tmp", true, true},
+			{"a/tmp", true, true},
+			{"tmp", false, false},
+		},
+		"doc/*.txt": {
+			{"doc/notes.txt", false, true},
+			{"doc/server/arch.txt", false, false},
+			{"a/doc/notes.txt", false, false},
+		},
+		"**/cache": {
+			{"cache", true, true},
+			{"a/b/cache", false, true},
+		},
+		"a/**/b": {
+			{"a/b", false, true},
+			{"a/x/y/b", false, true},
+			{"c/a/b", false, false},
+		},
+		"vendor/**": {
+			{"vendor/pkg", true, true},
+			{"vendor", true, false},
+		},
+		"file?.[ch]": {
+			{"file1.c", false, true},
+			{"file1.o", false, false},
+			{"file12.c", false, false},
+		},
+		"\\#hash": {
+			{"#hash", false, true},
+		},
+	} {
+		pattern, ok := IgnorePattern{}.Parse(line)
+		my.Assert(t, ok, line)
+		for _, _case := range cases {
+			my.AssertEquals(t, pattern.Matches(_case.relative, _case.isDir), _case.matches, line, _case.relative)
+		}
+	}
+
+	for _, line := range []string{"", "# comment", "   ", "!", "/"} {
+		_, ok := IgnorePattern{}.Parse(line)
+		my.Assert(t, !ok, line)
+	}
+	negative, ok := IgnorePattern{}.Parse("!important.log ")
+	my.Assert(t, ok)
+	my.Assert(t, negative.negative)
+	my.Assert(t, negative.Matches("important.log", false))
+}
+
+func TestIgnoreFilesExcluder(t *testing.T) {
+	root := t.TempDir()
+	write := func(relative, contents string) {
+		path := filepath.Join(root, relative)
+		PanicIf(os.MkdirAll(filepath.Dir(path), 0755))
+		PanicIf(os.WriteFile(path, []byte(contents), 0644))
+	}
+	write(GitIgnoreFile, "*.log\n!keep.log\nbuild/\n")
+	write("sub/" + SSHMirrorIgnoreFile, "!debug.log\nlocal.txt\n")
+
+	exclusions, err := Exclusions{}.New(root, []string{`^\.git/`}, true)
+	PanicIf(err)
+	excluded := func(relative string, isDir bool) bool {
+		return isExcluded(exclusions, Path{}.New(Filename(relative)), isDir)
+	}
+	my.Assert(t, !excluded(".", true))
+	my.Assert(t, excluded(".git", true))
+	my.Assert(t, excluded("debug.log", false))
+	my.Assert(t, !excluded("keep.log", false))
+	my.Assert(t, excluded("build", true))
+	my.Assert(t, excluded("build/keep.log", false)) // files of excluded directory can not be re-included
+	my.Assert(t, !excluded("sub/debug.log", false)) // deeper file takes precedence
+	my.Assert(t, excluded("sub/other.log", false))
+	my.Assert(t, excluded("sub/local.txt", false))
+	my.Assert(t, !excluded("local.txt", false))
+	my.Assert(t, excluded(TrashDir + "/stamp/a", false))
+	my.Assert(t, excluded(RemoteLockFile, false))
+	my.Assert(t, excluded("sub/" + UploadingPrefix + "a.txt.1", false))
+	my.AssertEquals( // for `inotifywait`
+		t,
+		exclusions.Patterns(),
+		[]string{`^\.sshmirror-trash/`, `^\.sshmirror\.lock$`, `(^|/)\.sshmirror-uploading\.[^/]*$`, `^\.git/`},
+	)
+
+	write(GitIgnoreFile, "build/\n")
+	my.Assert(t, excluded("debug.log", false)) // cached
+	my.Assert(t, !exclusions.Reload(Path{}.New("debug.log")))
+	my.Assert(t, exclusions.Reload(Path{}.New(GitIgnoreFile)))
+	my.Assert(t, !excluded("debug.log", false))
+	my.Assert(t, !excluded("sub/other.log", false))
+
+	withoutGit, err := Exclusions{}.New(root, nil, false)
+	PanicIf(err)
+	my.Assert(t, !isExcluded(withoutGit, Path{}.New("build"), true))
+	my.Assert(t, isExcluded(withoutGit, Path{}.New("sub/local.txt"), false))
+}
+
+func TestWalkUpdated_Exclusions(t *testing.T) {
+	root := t.TempDir()
+	for _, relative := range []string{"web/dir/a.txt", "web/dir/cache/b.txt", "web/dir/c.log", "web/dir/d*.txt"} {
+		path := filepath.Join(root, relative)
+		PanicIf(os.MkdirAll(filepath.Dir(path), 0755))
+		PanicIf(os.WriteFile(path, nil, 0644))
+	}
+	PanicIf(os.WriteFile(filepath.Join(root, "web", SSHMirrorIgnoreFile), []byte("*.log\n"), 0644))
+	exclusions, err := Exclusions{}.New(root, []string{`^web/dir/cache/`, `^web/dir/d\*`}, false)
+	PanicIf(err)
+	mapping, err := Mapping{}.New("web", "/var/www")
+	PanicIf(err)
+	config := Config{localDir: filepath.Join(root, "web"), excluder: MappedExcluder{exclude: exclusions, mapping: mapping}}
+
+	var visited []string
+	PanicIf(walkUpdated(config, []Updated{{Path{}.New("dir")}}, func(_ string, relative string, _ os.FileInfo) error {
+		visited = append(visited, relative)
+		return nil
+	}))
+	my.AssertEquals(t, visited, []string{"dir", "dir/a.txt"})
+	my.AssertEquals(t, excludedUpdated(config, []Updated{{Path{}.New("dir")}}), []string{"dir/c.log", "dir/cache", "dir/d*.txt"})
+	my.AssertEquals(t, rsyncLiteral("dir/c.log"), "dir/c.log")
+	my.AssertEquals(t, rsyncLiteral(`dir/d*[\].txt`), `dir/d\*\[\\].txt`)
+}
@@ -4,16 +4,22 @@ go 1.24.0
 
 require (
 	github.com/0leksandr/my.go v1.10.2
+	github.com/BurntSushi/toml v1.6.0
 	github.com/fsnotify/fsnotify v1.9.0
+	github.com/kevinburke/ssh_config v1.6.0
+	github.com/mattn/go-sqlite3 v1.14.32
+	github.com/pkg/sftp v1.13.9
+	golang.org/x/crypto v0.43.0
+	golang.org/x/sys v0.37.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/go-cmp v0.7.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.32 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	golang.org/x/mod v0.29.0 // indirect
 	golang.org/x/sync v0.17.0 // indirect
-	golang.org/x/sys v0.37.0 // indirect
 	golang.org/x/tools v0.38.0 // indirect
 )
 
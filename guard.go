@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const DefaultGuardFiles = 1000
+const ConfirmYes = "yes"
+const ConfirmNo = "no"
+
+type DeletionGuard struct { // large or protected in-place modifications are applied only after confirmation
+	maxFiles  int              // 0 means unlimited
+	maxBytes  FileSize         // 0 means unlimited
+	protected []*regexp.Regexp // relative to local root
+}
+func (DeletionGuard) New(maxFiles int, maxBytes FileSize, protected []string) (DeletionGuard, error) {
+	guard := DeletionGuard{maxFiles: maxFiles, maxBytes: maxBytes}
+	for _, pattern := range protected {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil { return guard, err }
+		guard.protected = append(guard.protected, compiled)
+	}
+	return guard, nil
+}
+func (guard DeletionGuard) Check( // modifications, which need confirmation, and why
+	batch []InPlaceModification,
+	local func(Path) Path, // from target to local root
+	listed Manifest,       // remote, as listed last time. Nil, if not listed yet
+	remote func(checksums bool) (Manifest, error),
+) ([]InPlaceModification, string) {
+	var deleted []InPlaceModification
+	var protected []InPlaceModification
+	var reasons []string
+	for _, modification := range batch {
+		if _, ok := modification.(Deleted); ok { deleted = append(deleted, modification) }
+		for _, path := range modification.AffectedPaths() {
+			if guard.isProtected(local(path)) {
+				protected = append(protected, modification)
+				reasons = append(reasons, "touching protected " + local(path).original.Real())
+				break
+			}
+		}
+	}
+	if len(deleted) == 0 { return protected, strings.Join(reasons, ", ") }
+
+	nrFiles, size, unlisted := deletedFiles(deleted, listed) // directories, with contents
+	nrFiles += unlisted // at least
+	if unlisted > 0 && guard.isLimited() && !guard.isLarge(nrFiles, size) { // unlisted ones may be new directories
+		if manifest, err := remote(false); err == nil { nrFiles, size, _ = deletedFiles(deleted, manifest) }
+	}
+	large := false
+	if guard.maxFiles > 0 && nrFiles > guard.maxFiles {
+		large = true
+		reasons = append([]string{fmt.Sprintf("deleting %d files", nrFiles)}, reasons...)
+	}
+	if guard.maxBytes.Bytes() > 0 && guard.maxBytes.IsLess(size) {
+		large = true
+		reasons = append([]string{"deleting " + size.String()}, reasons...)
+	}
+	if !large { return protected, strings.Join(reasons, ", ") }
+
+	guarded := deleted
+	for _, modification := range protected {
+		if _, ok := modification.(Deleted); !ok { guarded = append(guarded, modification) }
+	}
+	return guarded, strings.Join(reasons, ", ")
+}
+func (guard DeletionGuard) isLimited() bool {
+	return guard.maxFiles > 0 || guard.maxBytes.Bytes() > 0
+}
+func (guard DeletionGuard) isLarge(nrFiles int, size FileSize) bool {
+	return (guard.maxFiles > 0 && nrFiles > guard.maxFiles) || (guard.maxBytes.Bytes() > 0 && guard.maxBytes.IsLess(size))
+}
+func (guard DeletionGuard) isProtected(path Path) bool {
+	name := path.original.Real()
+	for _, _regexp := range guard.protected {
+		if _regexp.MatchString(name) || _regexp.MatchString(name + "/") { return true } // `^dir/` protects `dir`
+	}
+	return false
+}
+
+func deletedFiles(deleted []InPlaceModification, remote Manifest) (nrFiles int, size FileSize, unlisted int) {
+	found := make(map[Filename]bool, len(deleted)) // in `remote`, as file or directory
+	for _, modification := range deleted { found[modification.OldFilename()] = false }
+	for filename, entry := range remote {
+		for parent := filename; ; {
+			if _, ok := found[parent]; ok {
+				found[parent] = true
+				nrFiles++
+				size = size.Add(FileSize{bytes: uint64(entry.size)})
+				break
+			}
+			i := strings.LastIndex(string(parent), "/")
+			if i < 0 { break }
+			parent = parent[:i]
+		}
+	}
+	for _, isFound := range found {
+		if !isFound { unlisted++ }
+	}
+	return nrFiles, size, unlisted
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"github.com/0leksandr/my.go"
+	"testing"
+)
+
+func TestDeletionGuard_Check(t *testing.T) {
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+	guard, err := DeletionGuard{}.New(2, FileSize{}, []string{`^\.env$`, `^uploads/`})
+	PanicIf(err)
+	root := func(path Path) Path { return path }
+	unlisted := func(bool) (Manifest, error) { return nil, errors.New("not listed") } // deletions are counted as files
+	check := func(local func(Path) Path, batch ...InPlaceModification) ([]InPlaceModification, string) {
+		return guard.Check(batch, local, nil, unlisted)
+	}
+
+	guarded, _ := check(root, Deleted{path("a")}, Deleted{path("b")}, Moved{from: path("c"), to: path("d")})
+	my.AssertEquals(t, len(guarded), 0)
+	guarded, reason := check(
+		root,
+		Deleted{path("a")},
+		Deleted{path("b")},
+		Moved{from: path("c"), to: path("d")},
+		Deleted{path("e")},
+	)
+	my.AssertEquals(t, guarded, []InPlaceModification{Deleted{path("a")}, Deleted{path("b")}, Deleted{path("e")}})
+	my.AssertEquals(t, reason, "deleting 3 files")
+	guarded, reason = check(root, Moved{from: path(".env"), to: path("env")}, Deleted{path("uploads")})
+	my.AssertEquals(t, guarded, []InPlaceModification{Moved{from: path(".env"), to: path("env")}, Deleted{path("uploads")}})
+	my.AssertEquals(t, reason, "touching protected .env, touching protected uploads")
+	mapping, err := Mapping{}.New("web", "/var/www")
+	PanicIf(err)
+	guarded, _ = check(mapping.Unroute, Deleted{path(".env")}) // "web/.env"
+	my.AssertEquals(t, len(guarded), 0)
+
+	guard, err = DeletionGuard{}.New(0, FileSize{megabytes: 1}, nil)
+	PanicIf(err)
+	remote := func(bool) (Manifest, error) {
+		return Manifest{"dir/a": {size: 1 << 20}, "dir/sub/b": {size: 1}, "dir2": {size: 1 << 30}}, nil
+	}
+	guarded, reason = guard.Check([]InPlaceModification{Deleted{path("dir")}}, root, nil, remote)
+	my.AssertEquals(t, guarded, []InPlaceModification{Deleted{path("dir")}})
+	my.AssertEquals(t, reason, "deleting 1.0Mb")
+	guard, err = DeletionGuard{}.New(1, FileSize{}, nil)
+	PanicIf(err)
+	guarded, reason = guard.Check([]InPlaceModification{Deleted{path("dir")}}, root, nil, remote) // f.e. `rm -rf node_modules`
+	my.AssertEquals(t, guarded, []InPlaceModification{Deleted{path("dir")}})
+	my.AssertEquals(t, reason, "deleting 2 files")
+	guarded, _ = guard.Check([]InPlaceModification{Deleted{path("dir/sub")}}, root, nil, remote)
+	my.AssertEquals(t, len(guarded), 0)
+
+	listed, err := remote(false)
+	PanicIf(err)
+	nrListings := 0
+	counted := func(bool) (Manifest, error) {
+		nrListings++
+		return remote(false)
+	}
+	guarded, _ = guard.Check([]InPlaceModification{Deleted{path("dir2")}}, root, listed, counted)
+	my.AssertEquals(t, len(guarded), 0)
+	guarded, _ = guard.Check([]InPlaceModification{Deleted{path("dir")}}, root, listed, counted)
+	my.AssertEquals(t, len(guarded), 1)
+	guarded, _ = guard.Check(
+		[]InPlaceModification{Deleted{path("dir2")}, Deleted{path("new")}, Deleted{path("new2")}}, // too many anyway
+		root,
+		listed,
+		counted,
+	)
+	my.AssertEquals(t, len(guarded), 3)
+	my.AssertEquals(t, nrListings, 0)
+	guarded, _ = guard.Check([]InPlaceModification{Deleted{path("new")}}, root, listed, counted) // may be directory
+	my.AssertEquals(t, len(guarded), 0)
+	my.AssertEquals(t, nrListings, 1)
+}
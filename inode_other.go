@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import (
+	"io/fs"
+)
+
+func fileIdentity(fs.FileInfo) (device uint64, inode uint64) {
+	return 0, 0 // unknown, moves are not detected
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const JournalDelay = time.Second // received modifications are journaled in bulk, after this
+
+func DefaultJournalPath() string { // empty, if there is no cache directory
+	cacheDir, err := os.UserCacheDir()
+	if err != nil { return "" }
+	return filepath.Join(cacheDir, "sshmirror", "journal.db")
+}
+
+type Journal struct { // unfinished modifications of a target, which survive restart of sshmirror
+	archive  Archive
+	key      string // same target of same local directory
+	replayed bool   // previous session's modifications are replayed only once
+	pending  bool   // recording is scheduled
+	mx       sync.Mutex
+}
+func (*Journal) New(archive Archive, localDir string, target string) *Journal {
+	return &Journal{
+		archive: archive,
+		key:     localDir + " => " + target,
+	}
+}
+func (journal *Journal) Record(queue Serializable, parked Serializable) {
+	if journal == nil { return }
+	journal.mx.Lock()
+	defer journal.mx.Unlock()
+	journal.archive.Journal(
+		journal.key,
+		SerializedMap{
+			"queue":  queue.Serialize(),
+			"parked": parked.Serialize(),
+		},
+	)
+}
+func (journal *Journal) RecordLater(record func()) { // debounced
+	if journal == nil { return }
+	journal.mx.Lock()
+	defer journal.mx.Unlock()
+	if journal.pending { return }
+	journal.pending = true
+	time.AfterFunc(JournalDelay, func() {
+		journal.mx.Lock()
+		journal.pending = false
+		journal.mx.Unlock()
+		record()
+	})
+}
+func (journal *Journal) Unfinished() []Modification { // left by previous session. Already routed to target
+	if journal == nil { return nil }
+	journal.mx.Lock()
+	defer journal.mx.Unlock()
+	if journal.replayed { return nil }
+	journal.replayed = true
+
+	serialized, ok := journal.archive.Journaled(journal.key).(SerializedMap)
+	if !ok { return nil }
+	modifications := make([]Modification, 0)
+	for _, name := range []string{"parked", "queue"} { // parked ones are older
+		queue := (&ModificationsQueue{}).Deserialize(serialized[name]).(*ModificationsQueue)
+		for _, modification := range queue.GetInPlace(false) { modifications = append(modifications, modification) }
+		for _, modification := range queue.GetUpdated(false) { modifications = append(modifications, modification) }
+	}
+	return modifications
+}
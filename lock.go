@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RemoteLockFile = ".sshmirror.lock" // in remote directory. Never listed as mirrored file
+const RemoteLockHeartbeat = 30 * time.Second
+const RemoteLockStale = 3 * RemoteLockHeartbeat // lock without heartbeat for this long is taken over
+const RemoteLockRetries = 5 // while lock file is unreadable. F.e. created, but not written yet
+const RemoteLockRetryDelay = 200 * time.Millisecond
+
+type RemoteLockHolder struct { // content of lock file
+	holder    string // user@host
+	pid       int
+	heartbeat int64 // unix time of remote host
+}
+func (RemoteLockHolder) Mine() RemoteLockHolder {
+	holder := "unknown"
+	if usr, err := user.Current(); err == nil { holder = usr.Username }
+	host, err := os.Hostname()
+	if err != nil { host = "unknown" }
+	return RemoteLockHolder{holder: holder + "@" + host, pid: os.Getpid()}
+}
+func (RemoteLockHolder) Parse(line string) (RemoteLockHolder, bool) {
+	lock := RemoteLockHolder{}
+	fields := 0
+	for _, field := range strings.Fields(line) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok { continue }
+		var err error
+		switch key {
+			case "holder":    lock.holder = value
+			case "pid":       lock.pid, err = strconv.Atoi(value)
+			case "heartbeat": lock.heartbeat, err = strconv.ParseInt(value, 10, 64)
+			default: continue
+		}
+		if err != nil { return lock, false }
+		fields++
+	}
+	return lock, fields == 3
+}
+func (lock RemoteLockHolder) Identity() string { // without heartbeat. Prefix of line in lock file
+	return fmt.Sprintf("holder=%s pid=%d ", lock.holder, lock.pid)
+}
+func (lock RemoteLockHolder) IsSame(other RemoteLockHolder) bool {
+	return lock.holder == other.holder && lock.pid == other.pid
+}
+
+type RemoteLockedError struct {
+	Dir    string
+	Holder RemoteLockHolder
+	Age    time.Duration // since last heartbeat
+}
+func (err *RemoteLockedError) Error() string {
+	return fmt.Sprintf(
+		"%s is locked by another sshmirror (%s, pid %d, last heartbeat %s ago). Lock is taken over after %s without heartbeat",
+		err.Dir,
+		err.Holder.holder,
+		err.Holder.pid,
+		err.Age,
+		RemoteLockStale,
+	)
+}
+
+type RemoteLock struct { // advisory, prevents two mirrors from writing same remote directory
+	dir    string // for messages
+	mine   RemoteLockHolder
+	output func(command string) ([]byte, error) // in remote directory
+	logger Logger
+	onLost func(error) // lock was taken over by another holder
+	held   bool
+	stop   chan struct{} // heartbeat
+	mx     sync.Mutex
+}
+func (*RemoteLock) New(dir string, output func(string) ([]byte, error), logger Logger) *RemoteLock {
+	return &RemoteLock{
+		dir:    dir,
+		mine:   RemoteLockHolder{}.Mine(),
+		output: output,
+		logger: logger,
+	}
+}
+func (lock *RemoteLock) Acquire() error { // or refresh, if already held
+	lock.mx.Lock()
+	defer lock.mx.Unlock()
+	for retry := 0; ; retry++ {
+		output, err := lock.output(fmt.Sprintf(
+			`now=$(date +%%s); if (set -C; %s) 2>/dev/null; then echo acquired; else echo "now=$now"; cat %s; fi`,
+			lock.write("$now"),
+			RemoteLockFile,
+		))
+		if err != nil { return err }
+		lines := strings.SplitN(strings.TrimSpace(string(output)), "\n", 2)
+		if lines[0] == "acquired" { break }
+		now, errNow := strconv.ParseInt(strings.TrimPrefix(lines[0], "now="), 10, 64)
+		if errNow != nil { return fmt.Errorf("unexpected output of locking %s: %s", lock.dir, output) }
+		holder, ok := RemoteLockHolder{}.Parse(strings.Join(lines[1:], ""))
+		if !ok { // being written by another holder, or broken
+			if retry < RemoteLockRetries {
+				time.Sleep(RemoteLockRetryDelay)
+				continue
+			}
+			return fmt.Errorf(
+				"%s is locked, but lock file %s is unreadable. Remove it, if no other sshmirror is running",
+				lock.dir,
+				RemoteLockFile,
+			)
+		}
+		age := time.Duration(now - holder.heartbeat) * time.Second
+		if !holder.IsSame(lock.mine) {
+			if age < RemoteLockStale { return &RemoteLockedError{Dir: lock.dir, Holder: holder, Age: age} }
+			lock.logger.Error(fmt.Sprintf("taking over stale lock of %s from %s, pid %d", lock.dir, holder.holder, holder.pid))
+			// removed only if still stale, then created again like a new one. Of two mirrors, taking it over at once,
+			// one fails to create it, and finds it held by another one
+			_, err = lock.output(fmt.Sprintf(
+				"if grep -qxF %s %s; then rm -f %s; fi",
+				wrapApostrophe(lines[1]),
+				RemoteLockFile,
+				RemoteLockFile,
+			))
+			if err != nil { return err }
+			continue
+		}
+		if _, err = lock.output(lock.write(`"$(date +%s)"`)); err != nil { return err }
+		break
+	}
+	if !lock.held {
+		lock.held = true
+		lock.stop = make(chan struct{})
+		go lock.keepHeartbeat(lock.stop)
+	}
+	return nil
+}
+func (lock *RemoteLock) Release() error {
+	lock.mx.Lock()
+	defer lock.mx.Unlock()
+	if !lock.held { return nil }
+	lock.held = false
+	close(lock.stop)
+	_, err := lock.output(fmt.Sprintf("! grep -qF %s %s || rm -f %s", lock.identity(), RemoteLockFile, RemoteLockFile))
+	return err
+}
+func (lock *RemoteLock) keepHeartbeat(stop <-chan struct{}) {
+	ticker := time.NewTicker(RemoteLockHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+			case <-stop: return
+			case <-ticker.C:
+		}
+		held, errLost := lock.beat()
+		if held { continue }
+		if errLost != nil {
+			if lock.onLost == nil {
+				lock.logger.Error(errLost.Error())
+			} else {
+				lock.onLost(errLost)
+			}
+		}
+		return
+	}
+}
+func (lock *RemoteLock) beat() (bool, error) { // refreshes heartbeat. False, if not held anymore; error, if lost
+	lock.mx.Lock()
+	defer lock.mx.Unlock()
+	if !lock.held { return false, nil } // released meanwhile
+	output, err := lock.output(fmt.Sprintf(
+		"if [ ! -e %s ]; then echo missing; elif grep -qF %s %s; then %s; else cat %s; fi",
+		RemoteLockFile,
+		lock.identity(),
+		RemoteLockFile,
+		lock.write(`"$(date +%s)"`),
+		RemoteLockFile,
+	))
+	if err != nil {
+		lock.logger.Debug("lock heartbeat failed", err.Error()) // retried on next tick, f.e. after reconnection
+		return true, nil
+	}
+	var errLost error
+	if strings.TrimSpace(string(output)) == "missing" {
+		errLost = fmt.Errorf("lock file of %s was removed", lock.dir)
+	} else if holder, ok := (RemoteLockHolder{}).Parse(string(output)); ok {
+		errLost = fmt.Errorf("lock of %s was taken over by %s, pid %d", lock.dir, holder.holder, holder.pid)
+	}
+	if errLost == nil { return true, nil }
+	lock.held = false // not refreshed anymore, and not removed on release
+	return false, errLost
+}
+func (lock *RemoteLock) write(heartbeat string) string { // shell command, `heartbeat` is evaluated remotely
+	return fmt.Sprintf("printf '%%s%%s\\n' %s heartbeat=%s > %s", lock.identity(), heartbeat, RemoteLockFile)
+}
+func (lock *RemoteLock) identity() string {
+	return wrapApostrophe(lock.mine.Identity())
+}
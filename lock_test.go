@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"github.com/0leksandr/my.go"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemoteLock(t *testing.T) {
+	dir := t.TempDir()
+	output := func(command string) ([]byte, error) {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Dir = dir
+		return cmd.Output()
+	}
+	logger := Logger{debug: NullLogger{}, error: &InMemoryErrorLogger{}}
+	newLock := func(pid int) *RemoteLock {
+		lock := (&RemoteLock{}).New(dir, output, logger)
+		lock.mine = RemoteLockHolder{holder: "user@host", pid: pid}
+		return lock
+	}
+	read := func() (RemoteLockHolder, bool) {
+		content, err := os.ReadFile(filepath.Join(dir, RemoteLockFile))
+		if err != nil { return RemoteLockHolder{}, false }
+		holder, ok := RemoteLockHolder{}.Parse(string(content))
+		my.Assert(t, ok)
+		return holder, true
+	}
+
+	first, second := newLock(1), newLock(12)
+	PanicIf(first.Acquire())
+	holder, _ := read()
+	my.Assert(t, holder.IsSame(first.mine))
+	PanicIf(first.Acquire()) // refreshed
+
+	var locked *RemoteLockedError
+	my.Assert(t, errors.As(second.Acquire(), &locked))
+	my.AssertEquals(t, locked.Holder.pid, 1)
+
+	PanicIf(os.WriteFile( // not refreshed for long
+		filepath.Join(dir, RemoteLockFile),
+		[]byte(first.mine.Identity() + "heartbeat=1\n"),
+		0644,
+	))
+	PanicIf(second.Acquire())
+	holder, _ = read()
+	my.Assert(t, holder.IsSame(second.mine))
+
+	PanicIf(os.WriteFile(filepath.Join(dir, RemoteLockFile), nil, 0644)) // created, but not written yet
+	my.Assert(t, first.Acquire() != nil)
+	PanicIf(os.WriteFile(filepath.Join(dir, RemoteLockFile), []byte(second.mine.Identity() + "heartbeat=1\n"), 0644))
+	PanicIf(second.Acquire())
+
+	PanicIf(first.Release()) // does not remove lock of another holder
+	_, exists := read()
+	my.Assert(t, exists)
+	PanicIf(second.Release())
+	_, exists = read()
+	my.Assert(t, !exists)
+
+	third := newLock(3)
+	PanicIf(os.WriteFile(filepath.Join(dir, RemoteLockFile), []byte(first.mine.Identity() + "heartbeat=1\n"), 0644))
+	racing := third.output
+	third.output = func(command string) ([]byte, error) { // second one takes stale lock over first
+		if strings.Contains(command, "rm -f") { PanicIf(second.Acquire()) }
+		return racing(command)
+	}
+	my.Assert(t, errors.As(third.Acquire(), &locked))
+	my.AssertEquals(t, locked.Holder.pid, 12)
+	holder, _ = read()
+	my.Assert(t, holder.IsSame(second.mine))
+
+	held, errLost := second.beat()
+	my.Assert(t, held && errLost == nil)
+	PanicIf(os.Remove(filepath.Join(dir, RemoteLockFile)))
+	held, errLost = second.beat()
+	my.Assert(t, !held && errLost != nil)
+	_, exists = read()
+	my.Assert(t, !exists) // not recreated
+	PanicIf(second.Release())
+}
+
+func TestRemoteLock_EscapedDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), `it's a "dir"`)
+	PanicIf(os.Mkdir(dir, 0755))
+	logger := Logger{debug: NullLogger{}, error: &InMemoryErrorLogger{}}
+	client := &sshClient{ // remote command is run locally
+		config: Config{remoteHost: `'eval "$0"'`, remoteDir: dir},
+		sshCmd: "sh -c",
+		logger: logger,
+	}
+	lock := (&RemoteLock{}).New(dir, client.remoteOutput, logger)
+	lock.mine = RemoteLockHolder{holder: "user@host", pid: 1}
+	PanicIf(lock.Acquire())
+	_, err := os.Stat(filepath.Join(dir, RemoteLockFile))
+	PanicIf(err)
+	PanicIf(lock.Release())
+	_, err = os.Stat(filepath.Join(dir, RemoteLockFile))
+	my.Assert(t, os.IsNotExist(err))
+}
@@ -53,6 +53,14 @@ func (logger ComboErrorLogger) Error(err string) {
 	}
 }
 
+type PrefixedErrorLogger struct {
+	prefix string
+	logger ErrorLogger
+}
+func (logger PrefixedErrorLogger) Error(err string) {
+	logger.logger.Error(logger.prefix + err)
+}
+
 type DebugLogger interface {
 	Debug(string, ...interface{})
 }
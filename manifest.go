@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const ManifestLinkPrefix = "-> " // of symlink records in listings
+
+type ManifestEntry struct {
+	size     int64
+	mtime    int64  // seconds
+	checksum string
+	link     string // target, if entry is a symlink
+}
+func (entry ManifestEntry) Equals(other ManifestEntry) bool {
+	if entry.link != "" || other.link != "" { return entry.link == other.link }
+	if entry.size != other.size { return false }
+	if entry.checksum != "" && other.checksum != "" { return entry.checksum == other.checksum }
+	return entry.mtime == other.mtime
+}
+
+type Manifest map[Filename]ManifestEntry // regular files and symlinks
+func (Manifest) Local(
+	root string,
+	isExcluded func(relative string, isDir bool) bool,
+	checksums bool,
+	onError func(error),
+) (Manifest, error) {
+	manifest := Manifest{}
+	err := filepath.Walk(
+		root,
+		func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				onError(err)
+				return nil
+			}
+			relative, errRelative := filepath.Rel(root, path)
+			if errRelative != nil { return errRelative }
+			if relative == "." { return nil }
+			if isExcluded(relative, info.IsDir()) {
+				if info.IsDir() { return filepath.SkipDir }
+				return nil
+			}
+			if info.Mode() & os.ModeSymlink != 0 {
+				link, errLink := os.Readlink(path)
+				if errLink != nil {
+					onError(errLink)
+					return nil
+				}
+				manifest[Filename(relative)] = ManifestEntry{link: link}
+				return nil
+			}
+			if !info.Mode().IsRegular() { return nil }
+
+			entry := ManifestEntry{
+				size:  info.Size(),
+				mtime: info.ModTime().Unix(),
+			}
+			if checksums {
+				checksum, errChecksum := fileChecksum(path)
+				if errChecksum != nil {
+					onError(errChecksum)
+					return nil
+				}
+				entry.checksum = checksum
+			}
+			manifest[Filename(relative)] = entry
+			return nil
+		},
+	)
+	return manifest, err
+}
+func (manifest Manifest) Take(filename Filename) Manifest { // file, or directory with contents. Removed from manifest
+	taken := Manifest{}
+	for name, entry := range manifest {
+		if name == filename || strings.HasPrefix(string(name), string(filename) + "/") {
+			taken[name] = entry
+			delete(manifest, name)
+		}
+	}
+	return taken
+}
+func (Manifest) Parse(listing []byte, checksums []byte) (Manifest, error) { // outputs of `RemoteCommander`
+	manifest := Manifest{}
+	records, err := manifest.parseLinks(splitNullTerminated(listing))
+	if err != nil { return nil, err }
+	for _, record := range records {
+		parts := strings.SplitN(record, " ", 3)
+		if len(parts) != 3 { return nil, errors.New("unexpected manifest record: " + record) }
+		size, errSize := strconv.ParseInt(parts[0], 10, 64)
+		if errSize != nil { return nil, errSize }
+		mtime, errMtime := strconv.ParseInt(strings.SplitN(parts[1], ".", 2)[0], 10, 64)
+		if errMtime != nil { return nil, errMtime }
+		manifest[Filename(parts[2])] = ManifestEntry{
+			size:  size,
+			mtime: mtime,
+		}
+	}
+	for _, record := range splitNullTerminated(checksums) {
+		parts := strings.SplitN(record, "  ", 2)
+		if len(parts) != 2 { return nil, errors.New("unexpected checksum record: " + record) }
+		filename := Filename(strings.TrimPrefix(parts[1], "./"))
+		if entry, ok := manifest[filename]; ok {
+			entry.checksum = parts[0]
+			manifest[filename] = entry
+		}
+	}
+	return manifest, nil
+}
+func (manifest Manifest) parseLinks(records []string) ([]string, error) { // returns records of files
+	// symlink takes 2 records: `ManifestLinkPrefix` with its name, then its target
+	files := make([]string, 0, len(records))
+	for i := 0; i < len(records); i++ {
+		if !strings.HasPrefix(records[i], ManifestLinkPrefix) {
+			files = append(files, records[i])
+			continue
+		}
+		if i + 1 == len(records) { return nil, errors.New("unexpected manifest record: " + records[i]) }
+		manifest[Filename(strings.TrimPrefix(records[i], ManifestLinkPrefix))] = ManifestEntry{link: records[i + 1]}
+		i++
+	}
+	return files, nil
+}
+func (manifest Manifest) Diff(remote Manifest) (outdated []Filename, extraneous []Filename) {
+	outdated = make([]Filename, 0)
+	extraneous = make([]Filename, 0)
+	for filename, entry := range manifest {
+		if remoteEntry, ok := remote[filename]; !ok || !entry.Equals(remoteEntry) {
+			outdated = append(outdated, filename)
+		}
+	}
+	for filename := range remote {
+		if _, ok := manifest[filename]; !ok { extraneous = append(extraneous, filename) }
+	}
+	sortFilenames(outdated)
+	sortFilenames(extraneous)
+	return
+}
+
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil { return "", err }
+	defer func() { _ = file.Close() }()
+	hash := sha1.New()
+	if _, err := io.Copy(hash, file); err != nil { return "", err }
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+func splitNullTerminated(output []byte) []string {
+	records := make([]string, 0)
+	for _, record := range bytes.Split(output, []byte{0}) {
+		if len(record) > 0 { records = append(records, string(record)) }
+	}
+	return records
+}
+func sortFilenames(filenames []Filename) {
+	sort.Slice(filenames, func(i, j int) bool { return filenames[i] < filenames[j] })
+}
\ No newline at end of file
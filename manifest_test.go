@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/0leksandr/my.go"
+	"testing"
+)
+
+func TestManifest_Parse(t *testing.T) {
+	manifest, err := Manifest{}.Parse(
+		[]byte("3 1700000000.1234567890 a\x0010 1700000001.0000000000 b/c d\x00-> link\x00../a\x00"),
+		[]byte("da39a3ee5e6b4b0d3255bfef95601890afd80709  ./a\x00"),
+	)
+	PanicIf(err)
+	my.AssertEquals(
+		t,
+		manifest,
+		Manifest{
+			"a":     {size: 3, mtime: 1700000000, checksum: "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+			"b/c d": {size: 10, mtime: 1700000001},
+			"link":  {link: "../a"},
+		},
+	)
+
+	_, err = Manifest{}.Parse([]byte("garbage\x00"), nil)
+	my.Assert(t, err != nil)
+	_, err = Manifest{}.Parse([]byte("-> link\x00"), nil)
+	my.Assert(t, err != nil)
+}
+func TestManifest_Diff(t *testing.T) {
+	local := Manifest{
+		"same":           {size: 1, mtime: 100},
+		"other-size":     {size: 1, mtime: 100},
+		"other-time":     {size: 1, mtime: 100},
+		"same-checksum":  {size: 1, mtime: 100, checksum: "aaa"},
+		"other-checksum": {size: 1, mtime: 100, checksum: "aaa"},
+		"missing":        {size: 1, mtime: 100},
+		"same-link":      {link: "a"},
+		"other-link":     {link: "a"},
+		"link-over-file": {link: "a"},
+	}
+	remote := Manifest{
+		"same":           {size: 1, mtime: 100},
+		"other-size":     {size: 2, mtime: 100},
+		"other-time":     {size: 1, mtime: 101},
+		"same-checksum":  {size: 1, mtime: 101, checksum: "aaa"},
+		"other-checksum": {size: 1, mtime: 100, checksum: "bbb"},
+		"extraneous":     {size: 1, mtime: 100},
+		"same-link":      {link: "a"},
+		"other-link":     {link: "b"},
+		"link-over-file": {size: 1, mtime: 100},
+	}
+	outdated, extraneous := local.Diff(remote)
+	my.AssertEquals(t, outdated, []Filename{"link-over-file", "missing", "other-checksum", "other-link", "other-size", "other-time"})
+	my.AssertEquals(t, extraneous, []Filename{"extraneous"})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Mapping struct { // subdirectory of local root, mirrored to its own remote directory
+	local  Path   // relative to local root. Empty for the whole root
+	remote string // relative to remote destination, or absolute
+}
+func (Mapping) Parse(str string) (Mapping, error) { // "LOCAL:REMOTE"
+	parts := strings.SplitN(str, ":", 2)
+	if len(parts) != 2 || parts[1] == "" { return Mapping{}, errors.New("invalid mapping (expected LOCAL:REMOTE): " + str) }
+	return Mapping{}.New(parts[0], parts[1])
+}
+func (Mapping) New(local, remote string) (Mapping, error) {
+	local = filepath.Clean(local)
+	if filepath.IsAbs(local) || local == ".." || strings.HasPrefix(local, ".." + string(os.PathSeparator)) {
+		return Mapping{}, errors.New("local directory of mapping must be inside of SOURCE: " + local)
+	}
+	if local == "." { local = "" }
+	return Mapping{
+		local:  Path{}.New(Filename(local)),
+		remote: stripTrailSlash(remote),
+	}, nil
+}
+func (mapping Mapping) LocalDir(root string) string {
+	if len(mapping.local.parts) == 0 { return root }
+	return root + string(os.PathSeparator) + mapping.local.original.Real()
+}
+func (mapping Mapping) RemoteDir(destination string) string {
+	if mapping.remote == "" { return destination }
+	if strings.HasPrefix(mapping.remote, "/") || destination == "" { return mapping.remote }
+	return destination + "/" + mapping.remote
+}
+func (mapping Mapping) IsRoot() bool {
+	return len(mapping.local.parts) == 0
+}
+func (mapping Mapping) Route(modification Modification) []Modification { // from local root to mapping
+	mappingRoot := Path{}.New(".") // uploaded with all its contents
+	switch modification := modification.(type) {
+		case Updated:
+			if path, inside := mapping.relative(modification.path); inside {
+				return []Modification{Updated{path}}
+			}
+			if mapping.covers(modification.path) { return []Modification{Updated{mappingRoot}} }
+		case Deleted:
+			if path, inside := mapping.relative(modification.path); inside {
+				return []Modification{Deleted{path}}
+			}
+			// removal of mapping directory itself is not mirrored
+		case Moved:
+			from, fromInside := mapping.relative(modification.from)
+			to, toInside := mapping.relative(modification.to)
+			if fromInside && toInside { return []Modification{Moved{from: from, to: to}} }
+			var modifications []Modification
+			if fromInside { modifications = append(modifications, Deleted{from}) }
+			if toInside {
+				modifications = append(modifications, Updated{to})
+			} else if mapping.covers(modification.to) {
+				modifications = append(modifications, Updated{mappingRoot})
+			}
+			return modifications
+		default:
+			panic("unknown modification")
+	}
+	return nil
+}
+func (mapping Mapping) Unroute(path Path) Path { // from mapping to local root
+	if mapping.IsRoot() { return path }
+	return Path{}.New(mapping.local.original + Filename(os.PathSeparator) + path.original)
+}
+func (mapping Mapping) relative(path Path) (Path, bool) { // false, if path is outside of mapping directory
+	if len(path.parts) <= len(mapping.local.parts) || !mapping.local.IsParentOf(path) { return Path{}, false }
+	if mapping.IsRoot() { return path, true }
+	return Path{}.New(Filename(strings.Join(path.parts[len(mapping.local.parts):], string(os.PathSeparator)))), true
+}
+func (mapping Mapping) covers(path Path) bool { // path is mapping directory, or one of its parents
+	return path.IsParentOf(mapping.local)
+}
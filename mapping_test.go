@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/0leksandr/my.go"
+	"testing"
+)
+
+func TestMapping_Route(t *testing.T) {
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+	api, err := Mapping{}.Parse("services/api:/srv/api")
+	PanicIf(err)
+	web, err := Mapping{}.Parse("web/:/var/www/html")
+	PanicIf(err)
+	my.AssertEquals(t, api.LocalDir("/repo"), "/repo/services/api")
+	my.AssertEquals(t, api.RemoteDir("/home/me"), "/srv/api")
+	my.AssertEquals(t, web.LocalDir("/repo"), "/repo/web")
+
+	type Case struct {
+		modification Modification
+		api          []Modification
+		web          []Modification
+	}
+	for _, _case := range []Case{
+		{
+			modification: Updated{path("services/api/main.go")},
+			api:          []Modification{Updated{path("main.go")}},
+		},
+		{
+			modification: Updated{path("services/apiary/main.go")},
+		},
+		{
+			modification: Deleted{path("web/index.html")},
+			web:          []Modification{Deleted{path("index.html")}},
+		},
+		{
+			modification: Moved{path("web/a"), path("web/b/a")},
+			web:          []Modification{Moved{path("a"), path("b/a")}},
+		},
+		{
+			modification: Moved{path("services/api/static"), path("web/static")},
+			api:          []Modification{Deleted{path("static")}},
+			web:          []Modification{Updated{path("static")}},
+		},
+		{
+			modification: Moved{path("README.md"), path("web/README.md")},
+			web:          []Modification{Updated{path("README.md")}},
+		},
+		{
+			modification: Updated{path("services")},
+			api:          []Modification{Updated{path(".")}},
+		},
+		{
+			modification: Deleted{path("web")},
+		},
+	} {
+		my.AssertEquals(t, api.Route(_case.modification), _case.api, _case.modification)
+		my.AssertEquals(t, web.Route(_case.modification), _case.web, _case.modification)
+	}
+
+	root, err := Mapping{}.New("", "")
+	PanicIf(err)
+	my.AssertEquals(t, root.Route(Moved{path("a"), path("b")}), []Modification{Moved{path("a"), path("b")}})
+	my.AssertEquals(t, root.RemoteDir("/dest"), "/dest")
+
+	for _, invalid := range []string{"api", "/abs:/srv", "../up:/srv", "api:"} {
+		_, err = Mapping{}.Parse(invalid)
+		my.Assert(t, err != nil, invalid)
+	}
+}
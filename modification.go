@@ -252,11 +252,19 @@ func (queue *TransactionalQueue) GetInPlace(flush bool) []InPlaceModification {
 func (queue *TransactionalQueue) GetUpdated(flush bool) []Updated {
 	return queue.ModificationsQueue.GetUpdated(flush)
 }
-func (*TransactionalQueue) Serialize() Serialized {
-	panic("not implemented")
-}
-func (*TransactionalQueue) Deserialize(Serialized) interface{} {
-	panic("not implemented")
+func (queue *TransactionalQueue) Serialize() Serialized { // including modifications of active transaction
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.backup != nil { return queue.backup.Serialize() }
+	return queue.ModificationsQueue.Serialize()
+}
+func (*TransactionalQueue) Deserialize(serialized Serialized) interface{} {
+	deserialized := (&ModificationsQueue{}).Deserialize(serialized).(*ModificationsQueue)
+	queue := TransactionalQueue{}.New()
+	queue.fs = deserialized.fs
+	queue.inPlace = deserialized.inPlace
+	return queue
 }
 func (queue *TransactionalQueue) mustNotHaveStarted() {
 	if queue.backup != nil { panic("transaction is active") }
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const SpillBatchSize = 1000 // modifications, which arrived at once, are spilled together
+
+var reservoirs atomic.Int32 // names of reservoirs in archive
+var reservoirRun = fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano()) // prefix of names, same for one process
+
 func ConvertArray(modifications []Modification) <-chan Modification {
 	channel := make(chan Modification)
 	go func() {
@@ -42,22 +53,40 @@ func Multiply(channel <-chan Modification, nr int) []<-chan Modification { // MA
 	for _, ch := range channels { outChannels = append(outChannels, ch) }
 	return outChannels
 }
-func Reservoir(in <-chan Modification, size int) <-chan Modification {
+func Reservoir(in <-chan Modification, size int, archive *Archive) <-chan Modification { // without archive, unbounded
 	out := make(chan Modification)
 	reservoir := make([]Modification, 0, size)
+	var name string
+	spilledFrom, spilledTo := 0, 0 // sequence numbers of modifications in archive
+	if archive != nil {
+		name = fmt.Sprintf("%s-%d", reservoirRun, reservoirs.Add(1))
+		archive.ForgetSpilled(isStaleReservoir)
+	}
 	var draining Locker
 	draining.Lock()
 	var mx sync.Mutex // accessing reservoir or draining state
 	inClosed := false
 	go func() {
 		for modification := range in {
+			batch := receiveAvailable(in, []Modification{modification}, SpillBatchSize)
+			var spill []Modification // inserted without holding `mx`. Only this goroutine changes `spilledTo`
 			mx.Lock()
-			reservoir = append(reservoir, modification) // MAYBE: allow realtime sending if reservoir is empty
-			if len(reservoir) == size {
-				// PRIORITY: use Archive as a fallback
+			for _, modification := range batch {
+				if archive != nil && (len(spill) > 0 || len(reservoir) >= size || spilledTo > spilledFrom) {
+					spill = append(spill, modification) // spilled ones go after all others
+				} else {
+					reservoir = append(reservoir, modification) // MAYBE: allow realtime sending if reservoir is empty
+				}
 			}
 			draining.Unlock()
 			mx.Unlock()
+			if len(spill) > 0 {
+				archive.Spill(name, spilledTo, spill)
+				mx.Lock()
+				spilledTo += len(spill)
+				draining.Unlock()
+				mx.Unlock()
+			}
 		}
 		mx.Lock()
 		inClosed = true
@@ -69,6 +98,11 @@ func Reservoir(in <-chan Modification, size int) <-chan Modification {
 			draining.Wait()
 			for {
 				mx.Lock()
+				if len(reservoir) == 0 && spilledTo > spilledFrom {
+					to := min(spilledFrom + max(size, 1), spilledTo)
+					reservoir = append(reservoir, archive.Unspill(name, spilledFrom, to)...)
+					spilledFrom = to
+				}
 				if len(reservoir) > 0 {
 					modification := reservoir[0]
 					reservoir = reservoir[1:]
@@ -89,3 +123,21 @@ func Reservoir(in <-chan Modification, size int) <-chan Modification {
 
 	return out
 }
+func receiveAvailable(in <-chan Modification, batch []Modification, limit int) []Modification { // without blocking
+	for len(batch) < limit {
+		select {
+			case modification, ok := <-in:
+				if !ok { return batch }
+				batch = append(batch, modification)
+			default:
+				return batch
+		}
+	}
+	return batch
+}
+func isStaleReservoir(name string) bool { // of another run, which is not running anymore
+	if strings.HasPrefix(name, reservoirRun + "-") { return false }
+	pid, err := strconv.Atoi(strings.SplitN(name, "-", 2)[0])
+	if err != nil || pid == os.Getpid() { return true } // same pid: previous process, crashed
+	return !processAlive(pid)
+}
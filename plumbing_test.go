@@ -1,7 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"github.com/0leksandr/my.go"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -82,7 +87,7 @@ func TestMultiply(t *testing.T) {
 }
 func TestReservoir(t *testing.T) {
 	in := make(chan Modification)
-	out := Reservoir(in, 10)
+	out := Reservoir(in, 10, nil)
 	modification1 := Updated{Path{}.New("a")}
 	modification2 := Deleted{Path{}.New("b")}
 	modification3 := Moved{Path{}.New("c"), Path{}.New("d")}
@@ -94,3 +99,30 @@ func TestReservoir(t *testing.T) {
 	for modification := range out { result = append(result, modification) }
 	my.AssertEquals(t, result, []Modification{modification1, modification2, modification3})
 }
+func TestReservoir_Spill(t *testing.T) {
+	archive, err := Archive{}.Open(filepath.Join(t.TempDir(), "archive.db"))
+	PanicIf(err)
+	finished := exec.Command("true")
+	PanicIf(finished.Run())
+	stale := []Modification{Updated{Path{}.New("stale")}}
+	archive.Spill(fmt.Sprintf("%d-1-1", finished.Process.Pid), 0, stale) // left by crashed process
+	archive.Spill(fmt.Sprintf("%d-1-1", os.Getppid()), 0, stale)          // of another running process
+	in := make(chan Modification)
+	out := Reservoir(in, 2, &archive)
+	my.AssertEquals(t, len(archive.db.SelectMany(TableSpilled, []string{ColumnSeq}, nil, nil)), 1)
+	expected := make([]Modification, 0)
+	for i := 0; i < 9; i++ {
+		modification := Updated{Path{}.New(Filename(strconv.Itoa(i)))}
+		in <- modification
+		expected = append(expected, modification)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		spilled := archive.db.SelectMany(TableSpilled, []string{ColumnSeq}, nil, nil)
+		if len(spilled) - 1 >= 9 - 2 - 1 { break } // one is being sent
+		if time.Now().After(deadline) { t.Fatalf("%d spilled", len(spilled) - 1) }
+	}
+	close(in)
+	result := make([]Modification, 0)
+	for modification := range out { result = append(result, modification) }
+	my.AssertEquals(t, result, expected)
+}
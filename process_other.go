@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid) // fails for missing processes on Windows, succeeds elsewhere
+	if err != nil { return false }
+	_ = process.Release()
+	return true
+}
@@ -1,22 +1,250 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/pkg/sftp"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
+const UploadingPrefix = ".sshmirror-uploading." // of temporary files, renamed once uploaded. Never listed as mirrored
+
+func isUploading(filename Filename) bool { // temporary file of unfinished upload
+	return strings.HasPrefix(path.Base(string(filename)), UploadingPrefix)
+}
+func uploadingName(destination string) string { // unique one, next to destination
+	return path.Join(
+		path.Dir(destination),
+		UploadingPrefix + path.Base(destination) + "." + strconv.FormatInt(time.Now().UnixNano(), 36),
+	)
+}
+
 type RemoteClient interface {
 	io.Closer
 	Update([]Updated) CancellableContext
-	InPlace([]InPlaceModification) error
+	InPlace([]InPlaceModification) CancellableContext // cancelled one stops, before its result is returned
+	Manifest(checksums bool) (Manifest, error)
 	Ready() *Locker
+	Lock(onLost func(error)) error // advisory lock of remote directory, held until `Close`. `onLost`: taken over by another
+	DescribeUpdate([]Updated) ([]string, error) // operations, which `Update` would execute. For `-dry-run`
+	DescribeInPlace([]InPlaceModification) []string
+}
+
+type SharedRemoteClient interface { // one connection for multiple directories on same host
+	RemoteClient
+	Share(config Config) RemoteClient
+}
+
+type InPlaceOutcome uint8
+const (
+	InPlaceApplied InPlaceOutcome = iota
+	InPlaceGone // source did not exist (f.e. file was created and removed again before sync). Expected
+	InPlaceFailed
+)
+func (outcome InPlaceOutcome) String() string {
+	switch outcome {
+		case InPlaceApplied: return "ok"
+		case InPlaceGone:    return "gone"
+		case InPlaceFailed:  return "failed"
+		default:             panic("unknown in-place outcome")
+	}
+}
+
+type InPlaceResult struct {
+	Modification InPlaceModification
+	Outcome      InPlaceOutcome
+	Err          error // if failed
+}
+func (InPlaceResult) All(modifications []InPlaceModification, outcome InPlaceOutcome) []InPlaceResult {
+	results := make([]InPlaceResult, 0, len(modifications))
+	for _, modification := range modifications {
+		results = append(results, InPlaceResult{Modification: modification, Outcome: outcome})
+	}
+	return results
+}
+
+type InPlaceError struct { // some modifications of a batch failed. Others were applied
+	Results []InPlaceResult // of all modifications
+}
+func (InPlaceError) New(results []InPlaceResult) error { // nil, if nothing failed
+	for _, result := range results {
+		if result.Outcome == InPlaceFailed { return &InPlaceError{Results: results} }
+	}
+	return nil
+}
+func (err *InPlaceError) Failed() []InPlaceResult {
+	failed := make([]InPlaceResult, 0)
+	for _, result := range err.Results {
+		if result.Outcome == InPlaceFailed { failed = append(failed, result) }
+	}
+	return failed
+}
+func (err *InPlaceError) Error() string {
+	failed := err.Failed()
+	messages := make([]string, 0, len(failed))
+	for _, result := range failed {
+		messages = append(messages, fmt.Sprintf("%s: %s", result.Modification.OldFilename().Real(), result.Err))
+	}
+	return fmt.Sprintf(
+		"%d of %d in-place modifications failed: %s",
+		len(failed),
+		len(err.Results),
+		strings.Join(messages, "; "),
+	)
+}
+
+const TransportSSH = "ssh"
+const TransportNative = "native"
+
+func newRemoteClient(config Config) (SharedRemoteClient, error) {
+	if config.remoteHost == "" { return LocalDirClient{}.New(config), nil } // `file://` destination
+	var base AgentCapable
+	var client SharedRemoteClient
+	switch config.transport {
+		case TransportSSH, "":
+			base = sshClient{}.New(config)
+			client = SFTPClient{}.New(config, base, config.sftp)
+		case TransportNative:
+			endpoint, err := SSHEndpoint{}.Resolve(config)
+			if err != nil { return nil, err }
+			native := NativeSSHClient{}.New(config, endpoint)
+			base = native
+			client = native // does not need rsync
+			if config.sftp { client = SFTPClient{}.New(config, native, true) }
+		default:
+			return nil, errors.New("unknown transport: " + config.transport)
+	}
+	if config.agent { client = AgentClient{}.New(config, base, client) }
+	return client, nil
+}
+
+type RemotePipe struct { // stdin and stdout of remote process
+	stdin  io.WriteCloser
+	stdout io.Reader
+	stop   func() error
+}
+func (pipe RemotePipe) Read(buffer []byte) (int, error) {
+	return pipe.stdout.Read(buffer)
+}
+func (pipe RemotePipe) Write(buffer []byte) (int, error) {
+	return pipe.stdin.Write(buffer)
+}
+func (pipe RemotePipe) Close() error {
+	_ = pipe.stdin.Close()
+	return pipe.stop()
+}
+
+func ignoreFiles(config Config) []string { // names of files with exclusion patterns, applied to uploaded directories
+	if config.gitignore { return []string{GitIgnoreFile, SSHMirrorIgnoreFile} }
+	return []string{SSHMirrorIgnoreFile}
+}
+
+func walkUpdated( // visits local files of uploaded paths, along with contents of uploaded directories
+	config Config,
+	updated []Updated,
+	visit func(localPath string, relative string, info fs.FileInfo) error,
+) error {
+	return walkUpdatedExcluding(config, updated, visit, func(string) {})
+}
+func excludedUpdated(config Config, updated []Updated) []string { // contents of uploaded directories, which are skipped
+	var excluded []string
+	_ = walkUpdatedExcluding( // errors are reported on upload
+		config,
+		updated,
+		func(string, string, fs.FileInfo) error { return nil },
+		func(relative string) { excluded = append(excluded, relative) },
+	)
+	return excluded
+}
+func walkUpdatedExcluding(
+	config Config,
+	updated []Updated,
+	visit func(localPath string, relative string, info fs.FileInfo) error,
+	excluded func(relative string), // contents of excluded directory are not walked
+) error {
+	exclude := config.excluder
+	if exclude == nil { exclude = IgnoreFilesExcluder{}.New(config.localDir, ignoreFiles(config)) } // like rsync filters
+	for _, modification := range updated {
+		root := filepath.Join(config.localDir, modification.path.original.Real())
+		err := filepath.Walk(root, func(localPath string, info fs.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) { return nil } // removed meanwhile. Will be deleted with next modification
+				return err
+			}
+			relative, errRelative := filepath.Rel(config.localDir, localPath)
+			if errRelative != nil { return errRelative }
+			if localPath != root && isExcluded(exclude, Path{}.New(Filename(relative)), info.IsDir()) {
+				excluded(relative)
+				if info.IsDir() { return filepath.SkipDir }
+				return nil
+			}
+			if !info.Mode().IsRegular() && !info.IsDir() && info.Mode() & os.ModeSymlink == 0 {
+				return nil // pipes, sockets, devices
+			}
+			return visit(localPath, relative, info)
+		})
+		if err != nil { return err }
+	}
+	return nil
+}
+
+func rsyncLiteral(path string) string { // rsync pattern, matching `path` only
+	if !strings.ContainsAny(path, "*?[") { return path } // otherwise, backslashes are not escapes
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(path)
+}
+
+func describeWalk( // one operation per visited file, for transports which upload file by file
+	config Config,
+	updated []Updated,
+	remotePath func(relative string) string,
+) ([]string, error) {
+	var operations []string
+	err := walkUpdated(config, updated, func(localPath string, relative string, info fs.FileInfo) error {
+		destination := Filename(remotePath(relative)).Escaped()
+		switch {
+			case info.IsDir():
+				operations = append(operations, "mkdir " + destination)
+			case info.Mode() & os.ModeSymlink != 0:
+				link, err := os.Readlink(localPath)
+				if err != nil { return err }
+				operations = append(operations, fmt.Sprintf("symlink %s -> %s", destination, Filename(link).Escaped()))
+			default:
+				operations = append(operations, "write " + destination)
+		}
+		return nil
+	})
+	return operations, err
+}
+func describeInPlace( // for transports, which apply in-place modifications one by one
+	modifications []InPlaceModification,
+	remotePath func(Path) string,
+) []string {
+	operations := make([]string, 0, len(modifications))
+	for _, modification := range modifications {
+		switch modification := modification.(type) {
+			case Moved:
+				from, to := Filename(remotePath(modification.from)).Escaped(), Filename(remotePath(modification.to)).Escaped()
+				operations = append(operations, fmt.Sprintf("rename %s %s", from, to))
+			case Deleted:
+				operations = append(operations, "remove " + Filename(remotePath(modification.path)).Escaped())
+			default:
+				panic("unknown in-place modification")
+		}
+	}
+	return operations
 }
 
 type sshClient struct { // TODO: rename
@@ -27,7 +255,9 @@ type sshClient struct { // TODO: rename
 	controlPath string
 	masterReady *Locker
 	commander   RemoteCommander
+	lock        *RemoteLock
 	done        bool // MAYBE: masterConnectionProcess
+	shared      bool // master connection is owned by another client
 	logger      Logger
 }
 func (sshClient) New(config Config) *sshClient {
@@ -53,61 +283,127 @@ func (sshClient) New(config Config) *sshClient {
 		commander:   UnixCommander{},
 		logger:      config.logger,
 	}
+	client.lock = (&RemoteLock{}).New(config.remoteDir, client.remoteOutput, config.logger)
 
 	client.masterReady.Lock()
 	go client.keepMasterConnection()
 
 	return client
 }
+func (client *sshClient) Share(config Config) RemoteClient { // for other directories on same host
+	shared := &sshClient{
+		config:      config,
+		sshCmd:      client.sshCmd,
+		controlPath: client.controlPath,
+		masterReady: client.masterReady,
+		commander:   client.commander,
+		shared:      true,
+		logger:      config.logger,
+	}
+	shared.lock = (&RemoteLock{}).New(config.remoteDir, shared.remoteOutput, config.logger)
+	return shared
+}
 func (client *sshClient) Close() error {
+	if err := client.lock.Release(); err != nil { client.logger.Debug("releasing lock failed", err.Error()) }
+	if client.shared { return nil }
 	client.done = true
 	client.closeMaster()
 	_ = os.Remove(client.controlPath)
 	return nil
 }
 func (client *sshClient) Update(updated []Updated) CancellableContext {
-	escapedFilenames := make([]string, 0, len(updated))
-	for _, modification := range updated {
-		escapedFilenames = append(escapedFilenames, modification.path.original.Escaped())
-	}
-
+	var stderr []string // for classification of errors
+	var stderrMx sync.Mutex
 	command := client.startCommand(
-		fmt.Sprintf(
-			"rsync --checksum --recursive --links --perms --times --group --owner --executability --compress --relative --rsh='%s' -- %s %s:%s",
-			client.sshCmd,
-			strings.Join(escapedFilenames, " "),
-			client.config.remoteHost,
-			client.config.remoteDir,
-		),
+		client.rsyncCommand(updated),
 		true,
 		nil,
+		func(line string) {
+			stderrMx.Lock()
+			stderr = append(stderr, line)
+			stderrMx.Unlock()
+		},
 	)
 	return CancellableContext{
-		Result: func() error { return command.Wait() }, // TODO: ensure an error is returned on cancel
+		Result: func() error { // TODO: ensure an error is returned on cancel
+			err := command.Wait()
+			if err == nil { return nil }
+			stderrMx.Lock()
+			defer stderrMx.Unlock()
+			// besides ssh, rsync reports lost connection with: 10 (socket I/O), 12 (protocol stream), 30, 35 (timeouts)
+			return client.commandError("rsync", err, strings.Join(stderr, "\n"), 255, 10, 12, 30, 35)
+		},
 		Cancel: func() {
 			err := command.Process.Signal(syscall.SIGTERM)
 			if err != nil && err.Error() != "os: process already finished" { PanicIf(err) }
 		},
 	}
 }
-func (client *sshClient) InPlace(modifications []InPlaceModification) error {
-	commands := make([]string, 0, len(modifications) + 1)
-	for _, modification := range modifications {
-		commands = append(commands, modification.Command(client.commander))
+func (client *sshClient) DescribeUpdate(updated []Updated) ([]string, error) {
+	return []string{client.rsyncCommand(updated)}, nil
+}
+func (client *sshClient) DescribeInPlace(modifications []InPlaceModification) []string {
+	return []string{client.commander.InPlaceCommand(modifications)}
+}
+func (client *sshClient) rsyncCommand(updated []Updated) string {
+	escapedFilenames := make([]string, 0, len(updated))
+	for _, modification := range updated {
+		escapedFilenames = append(escapedFilenames, modification.path.original.Escaped())
 	}
-	// last command, for indicating whether commands chain was received by server (we don't care whether some commands
-	// failed, as it is possible in legitimate cases - see test cases)
-	commands = append(commands, "true")
 
-	if client.runRemoteCommand(strings.Join(commands, " ; ")) {
-		return nil
-	} else {
-		return errors.New("could not apply in-place modifications") // MAYBE: actual error
+	filters := make([]string, 0, 3) // for contents of uploaded directories
+	for _, ignoreFile := range ignoreFiles(client.config) {
+		filters = append(filters, "--filter=" + wrapApostrophe(":- " + ignoreFile))
+	}
+	if client.config.excluder != nil { // f.e. by `-e`, which ignore files do not cover. Anchored, due to `--relative`
+		for _, relative := range excludedUpdated(client.config, updated) {
+			filters = append(filters, "--exclude=" + wrapApostrophe("/" + rsyncLiteral(filepath.ToSlash(relative))))
+		}
+	}
+	if trash := client.config.trash; trash.enabled { // overwritten files are kept
+		filters = append(filters, "--backup --backup-dir=" + wrapApostrophe(TrashDir + "/" + trash.Stamp(time.Now())))
 	}
+	return fmt.Sprintf(
+		"rsync --checksum --recursive --links --perms --times --group --owner --executability --compress --relative %s --rsh='%s' -- %s %s:%s",
+		strings.Join(filters, " "),
+		client.sshCmd,
+		strings.Join(escapedFilenames, " "),
+		client.config.remoteHost,
+		client.config.remoteDir,
+	)
+}
+func (client *sshClient) InPlace(modifications []InPlaceModification) CancellableContext {
+	ctx, cancel := context.WithCancel(context.Background())
+	return CancellableContext{}.Go(
+		func() error {
+			defer cancel()
+			output, err := client.remoteOutputContext(ctx, client.commander.InPlaceCommand(modifications))
+			if err != nil { return err } // commands chain was not received by server, or was interrupted
+			return InPlaceError{}.New(parseInPlaceReport(output, modifications))
+		},
+		cancel, // remote chain stops on reporting next outcome into closed connection
+	)
+}
+func (client *sshClient) Manifest(checksums bool) (Manifest, error) {
+	listing, errListing := client.remoteOutput(client.commander.ListCommand())
+	if errListing != nil { return nil, errListing }
+	var checksumsListing []byte
+	if checksums {
+		var errChecksums error
+		checksumsListing, errChecksums = client.remoteOutput(client.commander.ChecksumsCommand())
+		if errChecksums != nil { return nil, errChecksums }
+	}
+	return Manifest{}.Parse(listing, checksumsListing)
 }
 func (client *sshClient) Ready() *Locker {
 	return client.masterReady
 }
+func (client *sshClient) Lock(onLost func(error)) error {
+	client.masterReady.Wait()
+	if err := client.Run("mkdir -p -- " + Filename(client.config.remoteDir).Escaped()); err != nil { return err }
+	client.lock.onLost = onLost
+	return client.lock.Acquire()
+}
 func (client *sshClient) keepMasterConnection() {
 	client.closeMaster()
 
@@ -144,9 +440,14 @@ func (client *sshClient) closeMaster() {
 	)
 }
 func (client *sshClient) runCommand(command string, localDir bool, onStdout func(string)) bool {
-	return client.startCommand(command, localDir, onStdout).Wait() == nil
+	return client.startCommand(command, localDir, onStdout, nil).Wait() == nil
 }
-func (client *sshClient) startCommand(command string, localDir bool, onStdout func(string)) *exec.Cmd {
+func (client *sshClient) startCommand(
+	command string,
+	localDir bool,
+	onStdout func(string),
+	onStderr func(string), // besides logging
+) *exec.Cmd {
 	client.logger.Debug("running command", command)
 	var dir string
 	if localDir { dir = client.config.localDir }
@@ -154,19 +455,100 @@ func (client *sshClient) startCommand(command string, localDir bool, onStdout fu
 		dir,
 		command,
 		onStdout,
-		func(err string) { client.logger.Error(fmt.Sprintf("command: %s; error: %s", command, err)) },
+		func(err string) {
+			client.logger.Error(fmt.Sprintf("command: %s; error: %s", command, err))
+			if onStderr != nil { onStderr(err) }
+		},
 	)
 }
-func (client *sshClient) runRemoteCommand(command string) bool {
-	return client.runCommand(
-		fmt.Sprintf(
-			"%s %s 'cd %s && (%s)'",
-			client.sshCmd,
-			client.config.remoteHost,
-			client.config.remoteDir,
-			escapeApostrophe(command),
-		),
-		false,
-		nil,
+func (client *sshClient) remoteOutput(command string) ([]byte, error) { // MAYBE: stream
+	return client.remoteOutputContext(context.Background(), command)
+}
+func (client *sshClient) remoteOutputContext(ctx context.Context, command string) ([]byte, error) {
+	command = client.remoteCommand(command)
+	client.logger.Debug("running command", command)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = time.Second // for outputs of killed one to be closed
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil { return nil, client.commandError(command, err, stderr.String(), 255) }
+	return output, nil
+}
+func (client *sshClient) Run(command string) error { // on remote host, outside of remote directory
+	client.logger.Debug("running remote command", command)
+	cmd := exec.Command(
+		"sh",
+		"-c",
+		fmt.Sprintf("%s %s %s", client.sshCmd, client.config.remoteHost, wrapApostrophe(command)),
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil { return client.commandError(command, err, stderr.String(), 255) }
+	return nil
+}
+func (client *sshClient) commandError(command string, err error, stderr string, connectionCodes ...int) error {
+	exitCode := -1
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) { exitCode = exitError.ExitCode() }
+	for _, connectionCode := range connectionCodes { // f.e. 255, by ssh convention
+		if exitCode == connectionCode { return &ConnectionError{Host: client.config.remoteHost, Err: err} }
+	}
+	return &RemoteCommandError{
+		Host:     client.config.remoteHost,
+		Command:  command,
+		ExitCode: exitCode,
+		Stderr:   strings.TrimSpace(stderr),
+		Err:      err,
+	}
+}
+func (client *sshClient) Pipe(command string) (io.ReadWriteCloser, error) { // over master connection
+	client.logger.Debug("starting remote command", command)
+	cmd := exec.Command(
+		"sh",
+		"-c",
+		fmt.Sprintf("%s %s %s", client.sshCmd, client.config.remoteHost, wrapApostrophe(command)),
+	)
+	stdin, errStdin := cmd.StdinPipe()
+	if errStdin != nil { return nil, errStdin }
+	stdout, errStdout := cmd.StdoutPipe()
+	if errStdout != nil { return nil, errStdout }
+	if err := cmd.Start(); err != nil { return nil, err }
+	return RemotePipe{
+		stdin:  stdin,
+		stdout: stdout,
+		stop:   func() error {
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+			_ = cmd.Wait()
+			return nil
+		},
+	}, nil
+}
+func (client *sshClient) SFTP() (*sftp.Client, error) { // over master connection
+	cmd := exec.Command("sh", "-c", fmt.Sprintf("%s -s %s sftp", client.sshCmd, client.config.remoteHost))
+	stdin, errStdin := cmd.StdinPipe()
+	if errStdin != nil { return nil, errStdin }
+	stdout, errStdout := cmd.StdoutPipe()
+	if errStdout != nil { return nil, errStdout }
+	if err := cmd.Start(); err != nil { return nil, err }
+	sftpClient, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, &ConnectionError{Host: client.config.remoteHost, Err: err}
+	}
+	go func() {
+		_ = sftpClient.Wait() // closed
+		_ = cmd.Wait()
+	}()
+	return sftpClient, nil
+}
+func (client *sshClient) remoteCommand(command string) string {
+	return fmt.Sprintf(
+		"%s %s %s",
+		client.sshCmd,
+		client.config.remoteHost,
+		wrapApostrophe(fmt.Sprintf("cd -- %s && (%s)", Filename(client.config.remoteDir).Escaped(), command)),
 	)
 }
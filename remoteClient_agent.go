@@ -0,0 +1,446 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const CommandAgent = "agent"
+const AgentDir = ".cache/sshmirror" // on remote host. Relative to home directory
+
+var errAgentUnavailable = errors.New("agent is not available")
+
+type AgentCapable interface { // connection, over which agent can be uploaded and started
+	SFTPCapable
+	Pipe(command string) (io.ReadWriteCloser, error)
+}
+
+type AgentOperationError struct {
+	Request AgentRequest
+	Err     error
+}
+func (err AgentOperationError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Request, err.Err)
+}
+
+type AgentBatchError struct { // some operations of a batch failed. Others were applied
+	Total  int
+	Failed []AgentOperationError
+}
+func (err *AgentBatchError) Error() string {
+	messages := make([]string, 0, len(err.Failed))
+	for _, failed := range err.Failed { messages = append(messages, failed.Error()) }
+	return fmt.Sprintf("%d of %d operations failed: %s", len(err.Failed), err.Total, strings.Join(messages, "; "))
+}
+
+type agentProcess struct { // shared between clients of one host
+	pipe        io.ReadWriteCloser
+	encoder     *AgentEncoder
+	decoder     *AgentDecoder
+	nextId      uint32
+	unavailable bool // could not be deployed. Fallback client is used instead
+	mx          sync.Mutex // one batch of requests at a time
+}
+
+type AgentClient struct { // talks to `sshmirror agent` on remote host
+	SharedRemoteClient // fallback, if agent can not be started
+	base     AgentCapable
+	config   Config
+	process  *agentProcess
+	agentDir string
+	shared   bool
+}
+func (AgentClient) New(config Config, base AgentCapable, fallback SharedRemoteClient) *AgentClient {
+	return &AgentClient{
+		SharedRemoteClient: fallback,
+		base:               base,
+		config:             config,
+		process:            &agentProcess{},
+		agentDir:           AgentDir,
+	}
+}
+func (client *AgentClient) Share(config Config) RemoteClient {
+	return &AgentClient{
+		SharedRemoteClient: client.SharedRemoteClient.Share(config).(SharedRemoteClient),
+		base:               client.base.Share(config).(AgentCapable),
+		config:             config,
+		process:            client.process,
+		agentDir:           client.agentDir,
+		shared:             true,
+	}
+}
+func (client *AgentClient) Close() error {
+	if !client.shared {
+		client.process.mx.Lock()
+		client.stop()
+		client.process.mx.Unlock()
+	}
+	return client.SharedRemoteClient.Close()
+}
+func (client *AgentClient) Update(updated []Updated) CancellableContext {
+	if client.isUnavailable() { return client.SharedRemoteClient.Update(updated) }
+
+	result := make(chan error, 1)
+	cancelled := make(chan struct{})
+	var cancelOnce sync.Once
+	go func() {
+		responses, err := client.execute(func(send func(AgentRequest) error) error {
+			return client.upload(updated, send, cancelled)
+		})
+		if errors.Is(err, errAgentUnavailable) {
+			result <- client.SharedRemoteClient.Update(updated).Result()
+			return
+		}
+		if err == nil { err = client.batchError(responses) }
+		result <- err
+	}()
+	return CancellableContext{
+		Result: func() error { return <-result },
+		Cancel: func() { cancelOnce.Do(func() { close(cancelled) }) },
+	}
+}
+func (client *AgentClient) InPlace(modifications []InPlaceModification) CancellableContext {
+	if client.isUnavailable() { return client.SharedRemoteClient.InPlace(modifications) }
+
+	cancelled := make(chan struct{})
+	return CancellableContext{}.Go(
+		func() error { return client.inPlace(modifications, cancelled) },
+		func() { close(cancelled) }, // requests, which were already sent, are awaited
+	)
+}
+func (client *AgentClient) inPlace(modifications []InPlaceModification, cancelled <-chan struct{}) error {
+	responses, err := client.execute(func(send func(AgentRequest) error) error {
+		for _, modification := range modifications {
+			select {
+				case <-cancelled: return errors.New("in-place modifications cancelled")
+				default:
+			}
+			if err := send(client.inPlaceRequest(modification)); err != nil { return err }
+		}
+		return nil
+	})
+	if errors.Is(err, errAgentUnavailable) { return client.SharedRemoteClient.InPlace(modifications).Result() }
+	if err != nil { return err }
+	results := InPlaceResult{}.All(modifications, InPlaceApplied)
+	for i, response := range responses {
+		err := response.Err()
+		switch {
+			case err == nil:
+			case errors.Is(err, os.ErrNotExist): results[i].Outcome = InPlaceGone
+			default: results[i] = InPlaceResult{Modification: modifications[i], Outcome: InPlaceFailed, Err: err}
+		}
+	}
+	return InPlaceError{}.New(results)
+}
+func (client *AgentClient) DescribeUpdate(updated []Updated) ([]string, error) { // as agent requests
+	if client.isUnavailable() { return client.SharedRemoteClient.DescribeUpdate(updated) }
+	var requests []string
+	err := walkUpdated(client.config, updated, func(localPath string, relative string, info fs.FileInfo) error {
+		request := AgentRequest{op: AgentWrite, path: path.Join(client.config.remoteDir, filepath.ToSlash(relative))}
+		switch {
+			case info.IsDir(): request.op = AgentMkdir
+			case info.Mode() & os.ModeSymlink != 0:
+				request.op = AgentSymlink
+				link, err := os.Readlink(localPath)
+				if err != nil { return err }
+				request.target = link
+		}
+		requests = append(requests, request.String())
+		return nil
+	})
+	return requests, err
+}
+func (client *AgentClient) DescribeInPlace(modifications []InPlaceModification) []string {
+	if client.isUnavailable() { return client.SharedRemoteClient.DescribeInPlace(modifications) }
+	requests := make([]string, 0, len(modifications))
+	for _, modification := range modifications { requests = append(requests, client.inPlaceRequest(modification).String()) }
+	return requests
+}
+func (client *AgentClient) Manifest(checksums bool) (Manifest, error) {
+	if client.isUnavailable() { return client.SharedRemoteClient.Manifest(checksums) }
+
+	responses, err := client.execute(func(send func(AgentRequest) error) error {
+		return send(AgentRequest{op: AgentList, path: client.config.remoteDir, last: checksums})
+	})
+	if errors.Is(err, errAgentUnavailable) { return client.SharedRemoteClient.Manifest(checksums) }
+	if err != nil { return nil, err }
+	if err = responses[0].Err(); err != nil { return nil, err }
+
+	manifest := Manifest{}
+	records, err := manifest.parseLinks(splitNullTerminated(responses[0].data))
+	if err != nil { return nil, err }
+	for _, record := range records {
+		parts := strings.SplitN(record, " ", 4)
+		if len(parts) != 4 { return nil, errors.New("unexpected manifest record: " + record) }
+		size, errSize := strconv.ParseInt(parts[0], 10, 64)
+		if errSize != nil { return nil, errSize }
+		mtime, errMtime := strconv.ParseInt(parts[1], 10, 64)
+		if errMtime != nil { return nil, errMtime }
+		entry := ManifestEntry{size: size, mtime: mtime}
+		if checksums { entry.checksum = parts[2] }
+		manifest[Filename(parts[3])] = entry
+	}
+	return manifest, nil
+}
+func (client *AgentClient) inPlaceRequest(modification InPlaceModification) AgentRequest {
+	switch modification := modification.(type) {
+		case Moved:
+			return AgentRequest{
+				op:     AgentMove,
+				path:   client.remotePath(modification.from),
+				target: client.remotePath(modification.to),
+			}
+		case Deleted:
+			return AgentRequest{op: AgentDelete, path: client.remotePath(modification.path)}
+		default:
+			panic("unknown in-place modification")
+	}
+}
+func (client *AgentClient) remotePath(relative Path) string {
+	return path.Join(client.config.remoteDir, filepath.ToSlash(relative.original.Real()))
+}
+func (client *AgentClient) isUnavailable() bool {
+	client.process.mx.Lock()
+	defer client.process.mx.Unlock()
+	return client.process.unavailable
+}
+func (client *AgentClient) batchError(responses []AgentResponse) error {
+	batchError := &AgentBatchError{Total: len(responses)}
+	for _, response := range responses {
+		err := response.Err()
+		if err == nil { continue }
+		batchError.Failed = append(batchError.Failed, AgentOperationError{Request: response.request, Err: err})
+	}
+	if len(batchError.Failed) == 0 { return nil }
+	return batchError
+}
+func (client *AgentClient) upload(updated []Updated, send func(AgentRequest) error, cancelled <-chan struct{}) error {
+	var dirs []AgentRequest // times are set again, after contents are uploaded
+	err := walkUpdated(client.config, updated, func(localPath string, relative string, info fs.FileInfo) error {
+		select {
+			case <-cancelled: return errors.New("upload cancelled")
+			default:
+		}
+		remotePath := path.Join(client.config.remoteDir, filepath.ToSlash(relative))
+		switch {
+			case info.IsDir():
+				request := AgentRequest{
+					op:    AgentMkdir,
+					path:  remotePath,
+					mode:  uint32(info.Mode().Perm()),
+					mtime: info.ModTime().UnixNano(),
+				}
+				dirs = append(dirs, request)
+				return send(request)
+			case info.Mode() & os.ModeSymlink != 0:
+				link, err := os.Readlink(localPath)
+				if err != nil { return err }
+				return send(AgentRequest{op: AgentSymlink, path: remotePath, target: link})
+			default:
+				return client.uploadFile(localPath, remotePath, info, send, cancelled)
+		}
+	})
+	if err != nil { return err }
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = send(dirs[i]); err != nil { return err }
+	}
+	return nil
+}
+func (client *AgentClient) uploadFile(
+	localPath string,
+	remotePath string,
+	info fs.FileInfo,
+	send func(AgentRequest) error,
+	cancelled <-chan struct{},
+) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		if os.IsNotExist(err) { return nil }
+		return err
+	}
+	defer file.Close()
+	buffer := make([]byte, AgentChunkSize)
+	for offset := uint64(0); ; {
+		select {
+			case <-cancelled: return errors.New("upload cancelled")
+			default:
+		}
+		n, errRead := io.ReadFull(file, buffer)
+		last := errors.Is(errRead, io.EOF) || errors.Is(errRead, io.ErrUnexpectedEOF)
+		if errRead != nil && !last { return errRead }
+		err = send(AgentRequest{
+			op:     AgentWrite,
+			path:   remotePath,
+			mode:   uint32(info.Mode().Perm()),
+			mtime:  info.ModTime().UnixNano(),
+			offset: offset,
+			last:   last,
+			data:   buffer[:n],
+		})
+		if err != nil || last { return err }
+		offset += uint64(n)
+	}
+}
+func (client *AgentClient) execute( // pipelined; responses are read while requests are sent
+	produce func(send func(AgentRequest) error) error,
+) ([]AgentResponse, error) {
+	process := client.process
+	process.mx.Lock()
+	defer process.mx.Unlock()
+	if err := client.start(); err != nil { return nil, err }
+
+	inflight := make(chan AgentRequest, 64)
+	produced := make(chan error, 1)
+	var errPipe error // writing to, or reading from agent failed
+	go func() {
+		defer close(inflight)
+		err := produce(func(request AgentRequest) error {
+			process.nextId++
+			request.id = process.nextId
+			if err := process.encoder.Request(request); err != nil {
+				errPipe = err
+				return err
+			}
+			request.data = nil
+			select {
+				case inflight <- request:
+				default: // reader is waiting for responses to buffered requests
+					if err := process.encoder.Flush(); err != nil {
+						errPipe = err
+						return err
+					}
+					inflight <- request
+			}
+			return nil
+		})
+		if errFlush := process.encoder.Flush(); errFlush != nil && errPipe == nil { errPipe = errFlush }
+		produced <- err
+	}()
+
+	var responses []AgentResponse
+	var errRead error
+	for request := range inflight {
+		if errRead != nil { continue } // waiting for producer to stop
+		response, err := client.response(request)
+		for err == nil && response.more { // streamed; parts are joined
+			var next AgentResponse
+			next, err = client.response(request)
+			next.data = append(response.data, next.data...)
+			response = next
+		}
+		if err != nil {
+			errRead = err
+			_ = process.pipe.Close() // producer fails too
+			continue
+		}
+		response.request = request
+		responses = append(responses, response)
+	}
+	errProduce := <-produced
+	if errRead == nil { errRead = errPipe }
+	if errRead != nil {
+		client.stop()
+		return nil, &ConnectionError{Host: client.config.remoteHost, Err: fmt.Errorf("agent: %w", errRead)}
+	}
+	return responses, errProduce
+}
+func (client *AgentClient) response(request AgentRequest) (AgentResponse, error) { // next one, which must be to `request`
+	response, err := client.process.decoder.Response()
+	if err == nil && response.id != request.id {
+		err = fmt.Errorf("unexpected agent response %d to request %d", response.id, request.id)
+	}
+	return response, err
+}
+func (client *AgentClient) start() error { // if not running
+	process := client.process
+	if process.pipe != nil { return nil }
+	if process.unavailable { return errAgentUnavailable }
+
+	unavailable := func(err error) error {
+		var connectionError *ConnectionError
+		if errors.As(err, &connectionError) { return err } // will retry
+		process.unavailable = true
+		client.config.logger.Error(fmt.Sprintf("could not start agent on %s: %s", client.config.remoteHost, err))
+		return errAgentUnavailable
+	}
+	remotePath, err := client.deploy()
+	if err != nil { return unavailable(err) }
+	command := Filename(remotePath).Escaped() + " " + CommandAgent
+	if !path.IsAbs(remotePath) { command = "./" + command } // not from PATH
+	pipe, err := client.base.Pipe(command)
+	if err != nil { return unavailable(err) }
+	decoder := AgentDecoder{}.New(pipe)
+	greeting, err := decoder.reader.ReadString('\n')
+	if err != nil || greeting != AgentGreeting {
+		_ = pipe.Close()
+		return unavailable(fmt.Errorf("unexpected greeting %q (%v)", greeting, err))
+	}
+	process.pipe = pipe
+	process.encoder = AgentEncoder{}.New(pipe)
+	process.decoder = decoder
+	client.config.logger.Debug("agent started", remotePath)
+	return nil
+}
+func (client *AgentClient) stop() {
+	process := client.process
+	if process.pipe == nil { return }
+	_ = process.pipe.Close()
+	process.pipe = nil
+	process.encoder = nil
+	process.decoder = nil
+}
+func (client *AgentClient) deploy() (string, error) { // uploads current executable, if it is not there yet
+	if platform, known := unamePlatform(); known {
+		err := client.base.Run(fmt.Sprintf(`test "$(uname -s)/$(uname -m)" = %s`, Filename(platform).Escaped()))
+		var commandError *RemoteCommandError
+		if errors.As(err, &commandError) && commandError.ExitCode == 1 {
+			return "", errors.New("remote platform differs from " + platform)
+		}
+		if err != nil { return "", err }
+	}
+	checksum, err := executableChecksum()
+	if err != nil { return "", err }
+	remotePath := path.Join(client.agentDir, "sshmirror-" + checksum[:16])
+
+	sftpClient, err := client.base.SFTP()
+	if err != nil { return "", err }
+	defer sftpClient.Close()
+	if _, err = sftpClient.Stat(remotePath); err == nil { return remotePath, nil }
+
+	if client.config.verbosity > 0 { fmt.Printf("Uploading agent to %s:%s\n", client.config.remoteHost, remotePath) }
+	if err = sftpClient.MkdirAll(client.agentDir); err != nil { return "", err }
+	executable, err := os.Executable()
+	if err != nil { return "", err }
+	local, err := os.Open(executable)
+	if err != nil { return "", err }
+	defer local.Close()
+	temporary := remotePath + ".tmp"
+	remote, err := sftpClient.Create(temporary)
+	if err != nil { return "", err }
+	_, err = io.Copy(remote, local)
+	if errClose := remote.Close(); err == nil { err = errClose }
+	if err == nil { err = sftpClient.Chmod(temporary, 0755) }
+	if err == nil { err = sftpClient.PosixRename(temporary, remotePath) }
+	if err != nil {
+		_ = sftpClient.Remove(temporary)
+		return "", err
+	}
+	return remotePath, nil
+}
+
+func unamePlatform() (string, bool) { // current platform, as reported by `uname -s` and `uname -m`
+	system := map[string]string{"linux": "Linux", "darwin": "Darwin", "freebsd": "FreeBSD"}[runtime.GOOS]
+	machine := map[string]string{"amd64": "x86_64", "386": "i686", "arm64": "aarch64"}[runtime.GOARCH]
+	if runtime.GOOS == "darwin" && runtime.GOARCH == "arm64" { machine = "arm64" }
+	if system == "" || machine == "" { return "", false }
+	return system + "/" + machine, true
+}
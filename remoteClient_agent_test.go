@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/0leksandr/my.go"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == CommandAgent { // test binary is uploaded as agent
+		if err := RunAgent(os.Stdin, os.Stdout); err != nil {
+			WriteToStderr(err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestAgentProtocol(t *testing.T) {
+	var buffer bytes.Buffer
+	encoder := AgentEncoder{}.New(&buffer)
+	request := AgentRequest{id: 7, op: AgentWrite, path: "/a b", mode: 0644, mtime: -1, offset: 3, last: true, data: []byte("x")}
+	PanicIf(encoder.Request(request))
+	PanicIf(encoder.Response(AgentResponse{id: 7, status: AgentNotExist, message: "no", size: 1 << 40, more: true}))
+	PanicIf(encoder.Flush())
+
+	decoder := AgentDecoder{}.New(&buffer)
+	decoded, err := decoder.Request()
+	PanicIf(err)
+	my.AssertEquals(t, decoded, request)
+	response, err := decoder.Response()
+	PanicIf(err)
+	my.AssertEquals(t, response.size, uint64(1 << 40))
+	my.Assert(t, response.more)
+	my.Assert(t, errors.Is(response.Err(), os.ErrNotExist))
+
+	malformed := AgentDecoder{}.New(bytes.NewReader([]byte{0, 0, 0, 5, 0, 0, 0, 1, 2}))
+	_, err = malformed.Request()
+	my.Assert(t, err != nil)
+
+	buffer.Reset()
+	my.Assert(t, encoder.Response(AgentResponse{data: make([]byte, AgentMaxFrame)}) != nil)
+	PanicIf(encoder.Flush())
+	my.AssertEquals(t, buffer.Len(), 0)
+}
+
+func TestAgentList(t *testing.T) {
+	dir := t.TempDir()
+	const nrFiles = 6000 // records take more than one frame
+	name := strings.Repeat("x", 200)
+	for i := 0; i < nrFiles; i++ {
+		PanicIf(os.WriteFile(filepath.Join(dir, fmt.Sprintf("%s%d", name, i)), nil, 0644))
+	}
+	var requests bytes.Buffer
+	encoder := AgentEncoder{}.New(&requests)
+	PanicIf(encoder.Request(AgentRequest{id: 1, op: AgentList, path: dir}))
+	PanicIf(encoder.Request(AgentRequest{id: 2, op: AgentList, path: filepath.Join(dir, "missing")}))
+	PanicIf(encoder.Flush())
+	var responses bytes.Buffer
+	PanicIf(RunAgent(&requests, &responses))
+
+	decoder := AgentDecoder{}.New(&responses)
+	_, err := decoder.reader.ReadString('\n')
+	PanicIf(err)
+	nrFrames, nrRecords := 0, 0
+	for more := true; more; {
+		response, err := decoder.Response()
+		PanicIf(err)
+		PanicIf(response.Err())
+		my.AssertEquals(t, response.id, uint32(1))
+		nrFrames++
+		nrRecords += len(splitNullTerminated(response.data))
+		more = response.more
+	}
+	my.Assert(t, nrFrames > 1, nrFrames)
+	my.AssertEquals(t, nrRecords, nrFiles)
+	response, err := decoder.Response()
+	PanicIf(err)
+	my.AssertEquals(t, response.id, uint32(2))
+	my.Assert(t, !response.more)
+	PanicIf(response.Err())
+}
+
+func TestAgentWrite(t *testing.T) {
+	dir := t.TempDir()
+	destination := filepath.Join(dir, "a")
+	uploading := func() []string {
+		matches, err := filepath.Glob(filepath.Join(dir, UploadingPrefix + "*"))
+		PanicIf(err)
+		return matches
+	}
+	write := func(agent *Agent, offset uint64, last bool) AgentResponse {
+		return agent.Handle(AgentRequest{op: AgentWrite, path: destination, mode: 0644, offset: offset, last: last, data: []byte("ab")})
+	}
+
+	agent := Agent{}
+	my.AssertEquals(t, write(&agent, 0, false).status, AgentOK)
+	my.AssertEquals(t, len(uploading()), 1)
+	my.Assert(t, isUploading(Filename(uploading()[0])))
+	my.AssertEquals(t, write(&agent, 2, true).status, AgentOK)
+	contents, err := os.ReadFile(destination)
+	PanicIf(err)
+	my.AssertEquals(t, string(contents), "abab")
+	my.AssertEquals(t, len(uploading()), 0)
+
+	my.AssertEquals(t, write(&agent, 0, false).status, AgentOK)
+	agent.Handle(AgentRequest{op: AgentStat, path: dir}) // upload cancelled
+	my.AssertEquals(t, len(uploading()), 0)
+	my.AssertEquals(t, write(&agent, 2, true).status, AgentFailed) // not started
+	my.AssertEquals(t, len(uploading()), 0)
+
+	my.AssertEquals(t, write(&agent, 0, false).status, AgentOK)
+	agent.abandon() // agent stopped
+	my.AssertEquals(t, len(uploading()), 0)
+}
+
+func TestAgentClient(t *testing.T) {
+	server := (&TestSSHServer{}).New(t)
+	localDir := t.TempDir()
+	remoteDir := filepath.Join(t.TempDir(), "remote")
+	write := func(relative, contents string) {
+		path := filepath.Join(localDir, relative)
+		PanicIf(os.MkdirAll(filepath.Dir(path), 0755))
+		PanicIf(os.WriteFile(path, []byte(contents), 0640))
+	}
+	remoteContents := func(relative string) string {
+		contents, err := os.ReadFile(filepath.Join(remoteDir, relative))
+		if err != nil { return "" }
+		return string(contents)
+	}
+	big := strings.Repeat("0123456789", AgentChunkSize / 4)
+	write("a.txt", "a")
+	write("dir/big", big)
+	write("dir/empty", "")
+	write("dir/x.log", "x")
+	write("dir/" + SSHMirrorIgnoreFile, "*.log\n")
+	PanicIf(os.Symlink("../a.txt", filepath.Join(localDir, "dir/link")))
+
+	config := Config{
+		localDir:    localDir,
+		remoteHost:  "test",
+		remoteDir:   remoteDir,
+		connTimeout: 1,
+		logger:      Logger{debug: NullLogger{}, error: &InMemoryErrorLogger{}},
+	}
+	native := NativeSSHClient{}.New(config, server.Endpoint())
+	defer native.Close()
+	native.Ready().Wait()
+	client := AgentClient{}.New(config, native, native)
+	client.agentDir = filepath.Join(t.TempDir(), "agent")
+	defer client.Close()
+
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+	PanicIf(client.Update([]Updated{{path("a.txt")}, {path("dir")}}).Result())
+	my.Assert(t, !client.isUnavailable())
+	my.AssertEquals(t, remoteContents("a.txt"), "a")
+	my.AssertEquals(t, remoteContents("dir/big"), big)
+	my.AssertEquals(t, remoteContents("dir/x.log"), "")
+	info, err := os.Stat(filepath.Join(remoteDir, "dir/empty"))
+	PanicIf(err)
+	my.AssertEquals(t, info.Mode().Perm(), os.FileMode(0640))
+	link, err := os.Readlink(filepath.Join(remoteDir, "dir/link"))
+	PanicIf(err)
+	my.AssertEquals(t, link, "../a.txt")
+
+	PanicIf(client.InPlace([]InPlaceModification{
+		Moved{from: path("dir/big"), to: path("moved/big")},
+		Deleted{path("dir/empty")},
+		Deleted{path("missing")},
+	}).Result())
+	my.AssertEquals(t, remoteContents("moved/big"), big)
+	err = client.InPlace([]InPlaceModification{
+		Moved{from: path("a.txt"), to: path("moved/big/a.txt")}, // not a directory
+		Deleted{path("dir/link")},
+	}).Result()
+	var inPlaceError *InPlaceError
+	my.Assert(t, errors.As(err, &inPlaceError), err)
+	my.AssertEquals(t, len(inPlaceError.Results), 2)
+	my.AssertEquals(t, len(inPlaceError.Failed()), 1)
+	my.AssertEquals(t, inPlaceError.Failed()[0].Modification.OldFilename(), Filename("a.txt"))
+
+	PanicIf(os.Symlink("a.txt", filepath.Join(remoteDir, "remote-link")))
+	shared := client.Share(config)
+	manifest, err := shared.Manifest(true)
+	PanicIf(err)
+	my.AssertEquals(t, len(manifest), 4) // a.txt, moved/big, dir/.sshmirrorignore, remote-link
+	my.AssertEquals(t, manifest["moved/big"].size, int64(len(big)))
+	my.Assert(t, manifest["moved/big"].checksum != "")
+	my.AssertEquals(t, manifest["remote-link"], ManifestEntry{link: "a.txt"})
+
+	server.env = []string{"PATH=/nonexistent"} // `uname` fails, thus agent is not deployed
+	fallback := AgentClient{}.New(config, native, LocalDirClient{}.New(config))
+	fallback.agentDir = filepath.Join(t.TempDir(), "agent")
+	write("b.txt", "b")
+	PanicIf(fallback.Update([]Updated{{path("b.txt")}}).Result())
+	my.Assert(t, fallback.isUnavailable())
+	my.AssertEquals(t, remoteContents("b.txt"), "b")
+}
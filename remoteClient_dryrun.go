@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const DryRunPrefix = "dry run: "
+
+type DryRunClient struct { // prints operations of underlying transport instead of executing them. Listing is done for real
+	RemoteClient
+	prefix string // of output messages
+	out    io.Writer
+}
+func (DryRunClient) New(client RemoteClient, prefix string) *DryRunClient {
+	return &DryRunClient{
+		RemoteClient: client,
+		prefix:       prefix,
+		out:          os.Stdout,
+	}
+}
+func (client *DryRunClient) Update(updated []Updated) CancellableContext {
+	operations, err := client.RemoteClient.DescribeUpdate(updated)
+	client.print(operations)
+	return CancellableContext{}.Go(func() error { return err }, func() {})
+}
+func (client *DryRunClient) InPlace(modifications []InPlaceModification) CancellableContext {
+	client.print(client.RemoteClient.DescribeInPlace(modifications))
+	return CancellableContext{}.Go(func() error { return nil }, func() {})
+}
+func (client *DryRunClient) Lock(func(error)) error { // nothing is written
+	return nil
+}
+func (client *DryRunClient) print(operations []string) {
+	for _, operation := range operations { _, _ = fmt.Fprintln(client.out, client.prefix + DryRunPrefix + operation) }
+}
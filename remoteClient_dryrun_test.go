@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"github.com/0leksandr/my.go"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDryRunClient(t *testing.T) {
+	localDir := t.TempDir()
+	remoteDir := t.TempDir()
+	PanicIf(os.WriteFile(filepath.Join(localDir, "a b"), []byte("a"), 0644))
+	PanicIf(os.MkdirAll(filepath.Join(localDir, "dir"), 0755))
+	PanicIf(os.WriteFile(filepath.Join(localDir, "dir/x"), []byte("x"), 0644))
+	PanicIf(os.WriteFile(filepath.Join(localDir, "dir/x.log"), []byte("x"), 0644))
+	PanicIf(os.WriteFile(filepath.Join(localDir, "dir", SSHMirrorIgnoreFile), []byte("*.log\n"), 0644))
+	PanicIf(os.Symlink("x", filepath.Join(localDir, "dir/link")))
+	PanicIf(os.WriteFile(filepath.Join(remoteDir, "c"), []byte("c"), 0644))
+	config := Config{localDir: localDir, remoteHost: "host", remoteDir: remoteDir}
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+	updated := []Updated{{path("a b")}, {path("dir")}}
+	inPlace := []InPlaceModification{Moved{from: path("c"), to: path("d/c")}, Deleted{path("e")}}
+	describe := func(client RemoteClient) []string {
+		var out bytes.Buffer
+		dryRun := DryRunClient{}.New(client, "test: ")
+		dryRun.out = &out
+		PanicIf(dryRun.Update(updated).Result())
+		PanicIf(dryRun.InPlace(inPlace).Result())
+		return strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	}
+	remote := func(relative string) string { return Filename(filepath.Join(remoteDir, relative)).Escaped() }
+
+	local := LocalDirClient{}.New(config)
+	my.AssertEquals(t, describe(local), []string{
+		"test: dry run: write " + remote("a b"),
+		"test: dry run: mkdir " + remote("dir"),
+		"test: dry run: write " + remote("dir/" + SSHMirrorIgnoreFile),
+		"test: dry run: symlink " + remote("dir/link") + " -> 'x'",
+		"test: dry run: write " + remote("dir/x"),
+		"test: dry run: rename " + remote("c") + " " + remote("d/c"),
+		"test: dry run: remove " + remote("e"),
+	})
+	_, err := os.Stat(filepath.Join(remoteDir, "a b"))
+	my.Assert(t, os.IsNotExist(err)) // nothing is executed
+	manifest, err := DryRunClient{}.New(local, "").Manifest(false)
+	PanicIf(err)
+	my.AssertEquals(t, len(manifest), 1) // listed for real
+
+	config.trash = Trash{enabled: true}
+	rsync := describe(&sshClient{config: config, sshCmd: "ssh", commander: UnixCommander{}})
+	my.AssertEquals(t, len(rsync), 2)
+	my.Assert(t, strings.HasPrefix(rsync[0], "test: dry run: rsync "))
+	my.Assert(t, strings.Contains(rsync[0], "--filter=':- " + SSHMirrorIgnoreFile + "'"))
+	my.Assert(t, strings.Contains(rsync[0], "--backup --backup-dir='" + TrashDir + "/"))
+	my.Assert(t, strings.HasSuffix(rsync[0], "-- 'a b' 'dir' host:" + remoteDir))
+	my.AssertEquals(t, rsync[1], "test: dry run: " + UnixCommander{}.InPlaceCommand(inPlace)) // whole chain
+
+	agent := AgentClient{}.New(config, nil, local)
+	my.AssertEquals(t, describe(agent)[0], "test: dry run: write " + filepath.Join(remoteDir, "a b"))
+	my.AssertEquals(t, describe(agent)[5], "test: dry run: move " + filepath.Join(remoteDir, "c") + " " + filepath.Join(remoteDir, "d/c"))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const LocalScheme = "file://" // destination on local (f.e. mounted) filesystem
+
+func isLocalDestination(destination string) bool {
+	return strings.HasPrefix(destination, LocalScheme)
+}
+
+type LocalDirClient struct { // "remote" directory is a local one
+	RemoteClient
+	config Config
+	ready  *Locker
+}
+func (LocalDirClient) New(config Config) *LocalDirClient {
+	return &LocalDirClient{
+		config: config,
+		ready:  &Locker{}, // always ready
+	}
+}
+func (client *LocalDirClient) Share(config Config) RemoteClient {
+	return LocalDirClient{}.New(config)
+}
+func (client *LocalDirClient) Close() error {
+	return nil
+}
+func (client *LocalDirClient) Update(updated []Updated) CancellableContext {
+	result := make(chan error, 1)
+	cancelled := make(chan struct{})
+	var cancelOnce sync.Once
+	go func() { result <- client.copy(updated, cancelled) }()
+	return CancellableContext{
+		Result: func() error { return <-result },
+		Cancel: func() { cancelOnce.Do(func() { close(cancelled) }) },
+	}
+}
+func (client *LocalDirClient) InPlace(modifications []InPlaceModification) CancellableContext {
+	cancelled := make(chan struct{})
+	return CancellableContext{}.Go(
+		func() error { return client.inPlace(modifications, cancelled) },
+		func() { close(cancelled) },
+	)
+}
+func (client *LocalDirClient) inPlace(modifications []InPlaceModification, cancelled <-chan struct{}) error {
+	results := InPlaceResult{}.All(modifications, InPlaceApplied)
+	for i, modification := range modifications {
+		select {
+			case <-cancelled: return errors.New("in-place modifications cancelled")
+			default:
+		}
+		source := client.destination(modification.OldFilename().Real())
+		if _, err := os.Lstat(source); os.IsNotExist(err) {
+			results[i].Outcome = InPlaceGone
+			continue
+		}
+		var err error
+		switch modification := modification.(type) {
+			case Moved:
+				to := client.destination(modification.to.original.Real())
+				if err = os.MkdirAll(filepath.Dir(to), 0755); err == nil { err = os.Rename(source, to) }
+			case Deleted:
+				err = os.RemoveAll(source)
+			default:
+				panic("unknown in-place modification")
+		}
+		if err != nil { results[i] = InPlaceResult{Modification: modification, Outcome: InPlaceFailed, Err: err} }
+	}
+	return InPlaceError{}.New(results)
+}
+func (client *LocalDirClient) DescribeUpdate(updated []Updated) ([]string, error) {
+	return describeWalk(client.config, updated, client.destination)
+}
+func (client *LocalDirClient) DescribeInPlace(modifications []InPlaceModification) []string {
+	return describeInPlace(modifications, func(relative Path) string { return client.destination(relative.original.Real()) })
+}
+func (client *LocalDirClient) Manifest(checksums bool) (Manifest, error) {
+	var errWalk error
+	manifest, err := Manifest{}.Local(
+		client.config.remoteDir,
+		func(string, bool) bool { return false },
+		checksums,
+		func(err error) {
+			if !os.IsNotExist(err) && errWalk == nil { errWalk = err }
+		},
+	)
+	if err == nil { err = errWalk }
+	return manifest, err
+}
+func (client *LocalDirClient) Ready() *Locker {
+	return client.ready
+}
+func (client *LocalDirClient) Lock(func(error)) error { // MAYBE: lock file too
+	return nil
+}
+func (client *LocalDirClient) destination(relative string) string {
+	return filepath.Join(client.config.remoteDir, relative)
+}
+func (client *LocalDirClient) copy(updated []Updated, cancelled <-chan struct{}) error {
+	type Dir struct {
+		path  string
+		mode  fs.FileMode
+		mtime time.Time
+	}
+	var dirs []Dir // permissions and times are set after contents are copied
+	stamp := client.config.trash.Stamp(time.Now())
+	err := walkUpdated(client.config, updated, func(localPath string, relative string, info fs.FileInfo) error {
+		select {
+			case <-cancelled: return errors.New("copying cancelled")
+			default:
+		}
+		destination := client.destination(relative)
+		if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil { return err }
+		switch {
+			case info.IsDir():
+				if existing, errStat := os.Lstat(destination); errStat == nil && !existing.IsDir() { // file, replaced
+					if err := os.Remove(destination); err != nil { return err }
+				}
+				if err := os.MkdirAll(destination, 0755); err != nil { return err }
+				dirs = append(dirs, Dir{path: destination, mode: info.Mode().Perm(), mtime: info.ModTime()})
+				return nil
+			case info.Mode() & os.ModeSymlink != 0:
+				link, err := os.Readlink(localPath)
+				if err != nil { return err }
+				if err = os.RemoveAll(destination); err != nil { return err }
+				return os.Symlink(link, destination)
+			default:
+				backup := func() error { return client.backup(relative, stamp) }
+				return client.copyFile(localPath, destination, info, backup, cancelled)
+		}
+	})
+	if err != nil { return err }
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = os.Chmod(dirs[i].path, dirs[i].mode); err != nil { return err }
+		if err = os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime); err != nil { return err }
+	}
+	return nil
+}
+func (client *LocalDirClient) backup(relative string, stamp string) error { // overwritten file is moved into trash
+	if !client.config.trash.enabled { return nil }
+	destination := client.destination(relative)
+	if existing, err := os.Lstat(destination); err != nil || existing.IsDir() { return nil }
+	trashed := client.destination(client.config.trash.Path(stamp, Path{}.New(Filename(relative))).original.Real())
+	if err := os.MkdirAll(filepath.Dir(trashed), 0755); err != nil { return err }
+	return os.Rename(destination, trashed)
+}
+func (client *LocalDirClient) copyFile(
+	from, to string,
+	info fs.FileInfo,
+	backup func() error, // of old version, once new one is fully copied
+	cancelled <-chan struct{},
+) error {
+	source, err := os.Open(from)
+	if err != nil {
+		if os.IsNotExist(err) { return nil }
+		return err
+	}
+	defer source.Close()
+
+	// copied to a temporary file, which replaces destination at once. Thus, cancelling leaves old version intact
+	temporary, err := os.CreateTemp(filepath.Dir(to), UploadingPrefix + filepath.Base(to) + ".*")
+	if err != nil { return err }
+	defer func() { _ = os.Remove(temporary.Name()) }() // no-op after successful rename
+	_, err = io.Copy(temporary, CancellableReader{reader: source, cancelled: cancelled})
+	if errClose := temporary.Close(); err == nil { err = errClose }
+	if err != nil { return err }
+	if err = os.Chmod(temporary.Name(), info.Mode().Perm()); err != nil { return err }
+	if err = os.Chtimes(temporary.Name(), info.ModTime(), info.ModTime()); err != nil { return err }
+	if err = backup(); err != nil { return err }
+	if existing, errStat := os.Lstat(to); errStat == nil && existing.IsDir() { // directory, replaced with file
+		if err = os.RemoveAll(to); err != nil { return err }
+	}
+	return os.Rename(temporary.Name(), to)
+}
+
+type CancellableReader struct {
+	reader    io.Reader
+	cancelled <-chan struct{}
+}
+func (reader CancellableReader) Read(buffer []byte) (int, error) {
+	select {
+		case <-reader.cancelled: return 0, errors.New("copying cancelled")
+		default: return reader.reader.Read(buffer)
+	}
+}
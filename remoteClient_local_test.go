@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"github.com/0leksandr/my.go"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalDirClient(t *testing.T) {
+	localDir := t.TempDir()
+	remoteDir := filepath.Join(t.TempDir(), "mnt")
+	write := func(relative, contents string, mode os.FileMode) {
+		path := filepath.Join(localDir, relative)
+		PanicIf(os.MkdirAll(filepath.Dir(path), 0755))
+		PanicIf(os.WriteFile(path, []byte(contents), mode))
+	}
+	remoteContents := func(relative string) string {
+		contents, err := os.ReadFile(filepath.Join(remoteDir, relative))
+		if err != nil { return "" }
+		return string(contents)
+	}
+	write("dir/a.sh", "a", 0700)
+	write("dir/b.log", "b", 0644)
+	write("c.txt", "c", 0644)
+	write(SSHMirrorIgnoreFile, "*.log\n", 0644)
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	PanicIf(os.Chtimes(filepath.Join(localDir, "dir"), mtime, mtime))
+
+	client := LocalDirClient{}.New(Config{localDir: localDir, remoteDir: remoteDir})
+	client.Ready().Wait()
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+	PanicIf(client.Update([]Updated{{path("dir")}, {path("c.txt")}}).Result())
+	my.AssertEquals(t, remoteContents("dir/a.sh"), "a")
+	my.AssertEquals(t, remoteContents("dir/b.log"), "")
+	info, err := os.Stat(filepath.Join(remoteDir, "dir/a.sh"))
+	PanicIf(err)
+	my.AssertEquals(t, info.Mode().Perm(), os.FileMode(0700))
+	info, err = os.Stat(filepath.Join(remoteDir, "dir"))
+	PanicIf(err)
+	my.AssertEquals(t, info.ModTime().Unix(), mtime.Unix())
+
+	PanicIf(client.InPlace([]InPlaceModification{
+		Moved{from: path("dir/a.sh"), to: path("moved/a.sh")},
+		Deleted{path("c.txt")},
+		Moved{from: path("missing"), to: path("other")},
+	}).Result())
+	my.AssertEquals(t, remoteContents("moved/a.sh"), "a")
+	my.AssertEquals(t, remoteContents("c.txt"), "")
+	err = client.InPlace([]InPlaceModification{
+		Moved{from: path("moved/a.sh"), to: path("moved/a.sh/a.sh")}, // not a directory
+		Deleted{path("missing")},
+	}).Result()
+	var inPlaceError *InPlaceError
+	my.Assert(t, errors.As(err, &inPlaceError), err)
+	my.AssertEquals(t, len(inPlaceError.Failed()), 1)
+	my.AssertEquals(t, inPlaceError.Results[1].Outcome, InPlaceGone)
+
+	manifest, err := client.Manifest(true)
+	PanicIf(err)
+	my.AssertEquals(t, len(manifest), 1)
+	my.AssertEquals(t, manifest["moved/a.sh"].size, int64(1))
+
+	write("c.txt", "new", 0644)
+	cancelled := client.Update([]Updated{{path("c.txt")}})
+	cancelled.Cancel()
+	if cancelled.Result() != nil { my.AssertEquals(t, remoteContents("c.txt"), "") } // raced with copying otherwise
+
+	client.config.trash = Trash{enabled: true}
+	PanicIf(os.WriteFile(filepath.Join(remoteDir, "c.txt"), []byte("old"), 0644))
+	info, err = os.Stat(filepath.Join(localDir, "c.txt"))
+	PanicIf(err)
+	closed := make(chan struct{})
+	close(closed)
+	backedUp := false
+	err = client.copyFile(
+		filepath.Join(localDir, "c.txt"),
+		filepath.Join(remoteDir, "c.txt"),
+		info,
+		func() error { backedUp = true; return nil },
+		closed,
+	)
+	my.Assert(t, err != nil)
+	my.Assert(t, !backedUp)
+	my.AssertEquals(t, remoteContents("c.txt"), "old")
+
+	_, err = LocalDirClient{}.New(Config{remoteDir: filepath.Join(remoteDir, "missing")}).Manifest(false)
+	PanicIf(err)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kevinburke/ssh_config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ConnectionError struct { // could not connect to (or lost connection with) remote host
+	Host string
+	Err  error
+}
+func (err *ConnectionError) Error() string {
+	return fmt.Sprintf("connection to %s: %s", err.Host, err.Err)
+}
+func (err *ConnectionError) Unwrap() error {
+	return err.Err
+}
+
+type RemoteCommandError struct { // remote command was started, but failed
+	Host     string
+	Command  string
+	ExitCode int // -1, if command did not exit normally (f.e. killed by signal, or connection was lost)
+	Stderr   string
+	Err      error
+}
+func (err *RemoteCommandError) Error() string {
+	message := fmt.Sprintf("command on %s: %s; ", err.Host, err.Command)
+	if err.ExitCode >= 0 {
+		message += fmt.Sprintf("exit code: %d", err.ExitCode)
+	} else {
+		message += "error: " + err.Err.Error()
+	}
+	if err.Stderr != "" { message += "; stderr: " + err.Stderr }
+	return message
+}
+func (err *RemoteCommandError) Unwrap() error {
+	return err.Err
+}
+
+type SSHEndpoint struct { // where and how to connect
+	address      string // host:port
+	clientConfig *ssh.ClientConfig
+}
+func (SSHEndpoint) Resolve(config Config) (SSHEndpoint, error) { // honors ~/.ssh/config, like `ssh` does
+	alias := config.remoteHost
+	user := ""
+	if at := strings.LastIndex(alias, "@"); at >= 0 {
+		user = alias[:at]
+		alias = alias[at + 1:]
+	}
+	get := func(key string) string { return ssh_config.Get(alias, key) }
+
+	host := get("HostName")
+	if host == "" { host = alias }
+	host = strings.ReplaceAll(host, "%h", alias)
+	if user == "" { user = get("User") }
+	if user == "" {
+		if current := os.Getenv("USER"); current != "" { user = current }
+	}
+	port := get("Port")
+	if port == "" { port = "22" }
+
+	var auth []ssh.AuthMethod
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" && get("IdentitiesOnly") != "yes" {
+		if connection, err := net.Dial("unix", socket); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(connection).Signers))
+		} else {
+			config.logger.Debug("ssh agent is not available", err)
+		}
+	}
+	var identityFiles []string
+	if config.identityFile != "" { identityFiles = append(identityFiles, config.identityFile) }
+	identityFiles = append(identityFiles, ssh_config.GetAll(alias, "IdentityFile")...)
+	identityFiles = append(identityFiles, "~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa")
+	var signers []ssh.Signer
+	for _, identityFile := range identityFiles {
+		contents, err := os.ReadFile(expandHome(identityFile))
+		if err != nil { continue } // default ones may not exist
+		signer, err := ssh.ParsePrivateKey(contents)
+		if err != nil {
+			config.logger.Debug("skipping identity file", identityFile, err) // MAYBE: ask for passphrase
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 { auth = append(auth, ssh.PublicKeys(signers...)) }
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if get("StrictHostKeyChecking") == "no" {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		var knownHostsFiles []string
+		for _, file := range append(
+			strings.Fields(get("UserKnownHostsFile")),
+			"~/.ssh/known_hosts",
+		) {
+			if _, err := os.Stat(expandHome(file)); err == nil { knownHostsFiles = append(knownHostsFiles, expandHome(file)) }
+		}
+		if len(knownHostsFiles) == 0 {
+			return SSHEndpoint{}, errors.New("no known_hosts file found. Connect to " + alias + " with ssh once, to verify its key")
+		}
+		callback, err := knownhosts.New(knownHostsFiles...)
+		if err != nil { return SSHEndpoint{}, err }
+		hostKeyCallback = callback // MAYBE: prefer host key algorithms, listed in known_hosts
+	}
+
+	return SSHEndpoint{
+		address: net.JoinHostPort(host, port),
+		clientConfig: &ssh.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         time.Duration(config.connTimeout) * time.Second,
+		},
+	}, nil
+}
+
+type nativeConnection struct { // shared between clients of one host
+	endpoint SSHEndpoint
+	client   *ssh.Client
+	mx       sync.Mutex // accessing `client`
+	ready    *Locker
+	done     chan struct{}
+}
+
+type NativeSSHClient struct { // without `ssh` and `rsync` binaries
+	RemoteClient
+	config     Config
+	connection *nativeConnection
+	commander  RemoteCommander
+	lock       *RemoteLock
+	shared     bool // connection is owned by another client
+	logger     Logger
+}
+func (NativeSSHClient) New(config Config, endpoint SSHEndpoint) *NativeSSHClient {
+	connection := &nativeConnection{
+		endpoint: endpoint,
+		ready:    &Locker{},
+		done:     make(chan struct{}),
+	}
+	client := &NativeSSHClient{
+		config:     config,
+		connection: connection,
+		commander:  UnixCommander{},
+		logger:     config.logger,
+	}
+	client.lock = (&RemoteLock{}).New(config.remoteDir, client.output, config.logger)
+	connection.ready.Lock()
+	go client.keepConnection()
+	return client
+}
+func (client *NativeSSHClient) Share(config Config) RemoteClient { // for other directories on same host
+	shared := &NativeSSHClient{
+		config:     config,
+		connection: client.connection,
+		commander:  client.commander,
+		shared:     true,
+		logger:     config.logger,
+	}
+	shared.lock = (&RemoteLock{}).New(config.remoteDir, shared.output, config.logger)
+	return shared
+}
+func (client *NativeSSHClient) Close() error {
+	if err := client.lock.Release(); err != nil { client.logger.Debug("releasing lock failed", err.Error()) }
+	if client.shared { return nil }
+	connection := client.connection
+	connection.mx.Lock()
+	defer connection.mx.Unlock()
+	select {
+		case <-connection.done: return nil
+		default:
+	}
+	close(connection.done)
+	if connection.client != nil { return connection.client.Close() }
+	return nil
+}
+func (client *NativeSSHClient) Update(updated []Updated) CancellableContext {
+	command := client.extractCommand()
+	session, err := client.session()
+	result := make(chan error, 1)
+	if err != nil {
+		result <- err
+		return CancellableContext{
+			Result: func() error { return <-result },
+			Cancel: func() {},
+		}
+	}
+
+	var cancelOnce sync.Once
+	cancelled := make(chan struct{})
+	go func() {
+		defer session.Close()
+		var stderr bytes.Buffer
+		session.Stderr = &stderr
+		stdin, errStdin := session.StdinPipe()
+		if errStdin != nil {
+			result <- client.commandError(command, errStdin, "")
+			return
+		}
+		if errStart := session.Start(command); errStart != nil {
+			result <- client.commandError(command, errStart, "")
+			return
+		}
+		errArchive := client.archive(updated, stdin, cancelled)
+		_ = stdin.Close()
+		errWait := session.Wait()
+		switch {
+			case errArchive != nil: result <- errArchive
+			case errWait != nil:    result <- client.commandError(command, errWait, stderr.String())
+			default:                result <- nil
+		}
+	}()
+	return CancellableContext{
+		Result: func() error { return <-result },
+		Cancel: func() {
+			cancelOnce.Do(func() {
+				close(cancelled)
+				_ = session.Signal(ssh.SIGTERM)
+				_ = session.Close()
+			})
+		},
+	}
+}
+func (client *NativeSSHClient) InPlace(modifications []InPlaceModification) CancellableContext {
+	cancelled := make(chan struct{})
+	return CancellableContext{}.Go(
+		func() error {
+			output, err := client.runCancellable(client.inPlaceCommand(modifications), cancelled)
+			if err != nil { return err }
+			return InPlaceError{}.New(parseInPlaceReport(output, modifications))
+		},
+		func() { close(cancelled) },
+	)
+}
+func (client *NativeSSHClient) DescribeUpdate(updated []Updated) ([]string, error) {
+	members := []string{client.extractCommand() + " < tar of:"}
+	err := walkUpdated(client.config, updated, func(_ string, relative string, info fs.FileInfo) error {
+		member := filepath.ToSlash(relative)
+		if info.IsDir() { member += "/" }
+		members = append(members, "  " + Filename(member).Escaped())
+		return nil
+	})
+	return members, err
+}
+func (client *NativeSSHClient) DescribeInPlace(modifications []InPlaceModification) []string {
+	return []string{client.inPlaceCommand(modifications)}
+}
+func (client *NativeSSHClient) extractCommand() string { // of uploaded archive
+	return fmt.Sprintf(
+		"mkdir -p -- %s && tar -x -f - -C %s",
+		Filename(client.config.remoteDir).Escaped(),
+		Filename(client.config.remoteDir).Escaped(),
+	)
+}
+func (client *NativeSSHClient) inPlaceCommand(modifications []InPlaceModification) string {
+	return fmt.Sprintf(
+		"cd %s && (%s)",
+		Filename(client.config.remoteDir).Escaped(),
+		client.commander.InPlaceCommand(modifications),
+	)
+}
+func (client *NativeSSHClient) Manifest(checksums bool) (Manifest, error) {
+	listing, errListing := client.output(client.commander.ListCommand())
+	if errListing != nil { return nil, errListing }
+	var checksumsListing []byte
+	if checksums {
+		var errChecksums error
+		checksumsListing, errChecksums = client.output(client.commander.ChecksumsCommand())
+		if errChecksums != nil { return nil, errChecksums }
+	}
+	return Manifest{}.Parse(listing, checksumsListing)
+}
+func (client *NativeSSHClient) Ready() *Locker {
+	return client.connection.ready
+}
+func (client *NativeSSHClient) Lock(onLost func(error)) error {
+	client.connection.ready.Wait()
+	if _, err := client.run("mkdir -p -- " + Filename(client.config.remoteDir).Escaped()); err != nil { return err }
+	client.lock.onLost = onLost
+	return client.lock.Acquire()
+}
+func (client *NativeSSHClient) keepConnection() {
+	connection := client.connection
+	for {
+		fmt.Print("Establishing SSH connection... ")
+		sshClient, err := ssh.Dial("tcp", connection.endpoint.address, connection.endpoint.clientConfig)
+		if err == nil {
+			connection.mx.Lock()
+			select {
+				case <-connection.done:
+					connection.mx.Unlock()
+					_ = sshClient.Close()
+					return
+				default:
+			}
+			connection.client = sshClient
+			connection.mx.Unlock()
+			fmt.Println("done")
+			client.logger.Debug("connection ready")
+			connection.ready.Unlock()
+
+			go client.keepAlive(sshClient)
+			_ = sshClient.Wait()
+
+			connection.ready.Lock()
+			connection.mx.Lock()
+			connection.client = nil
+			connection.mx.Unlock()
+		} else {
+			fmt.Println("failed")
+			client.logger.Error((&ConnectionError{Host: client.config.remoteHost, Err: err}).Error())
+		}
+
+		select {
+			case <-connection.done: return
+			case <-time.After(time.Duration(client.config.connTimeout) * time.Second):
+		}
+	}
+}
+func (client *NativeSSHClient) keepAlive(sshClient *ssh.Client) { // like `ServerAliveInterval`
+	interval := time.Duration(client.config.connTimeout) * time.Second
+	for {
+		select {
+			case <-client.connection.done: return
+			case <-time.After(interval):
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+			case err := <-reply:
+				if err == nil { continue }
+			case <-time.After(interval):
+		}
+		client.logger.Debug("connection lost")
+		_ = sshClient.Close()
+		return
+	}
+}
+func (client *NativeSSHClient) connected() (*ssh.Client, error) {
+	connection := client.connection
+	connection.mx.Lock()
+	defer connection.mx.Unlock()
+	if connection.client == nil {
+		return nil, &ConnectionError{Host: client.config.remoteHost, Err: errors.New("not connected")}
+	}
+	return connection.client, nil
+}
+func (client *NativeSSHClient) session() (*ssh.Session, error) {
+	sshClient, errConnected := client.connected()
+	if errConnected != nil { return nil, errConnected }
+	session, err := sshClient.NewSession()
+	if err != nil { return nil, &ConnectionError{Host: client.config.remoteHost, Err: err} }
+	return session, nil
+}
+func (client *NativeSSHClient) Run(command string) error { // on remote host, outside of remote directory
+	_, err := client.run(command)
+	return err
+}
+func (client *NativeSSHClient) Pipe(command string) (io.ReadWriteCloser, error) {
+	client.logger.Debug("starting remote command", command)
+	session, err := client.session()
+	if err != nil { return nil, err }
+	stdin, errStdin := session.StdinPipe()
+	if errStdin != nil { return nil, errStdin }
+	stdout, errStdout := session.StdoutPipe()
+	if errStdout != nil { return nil, errStdout }
+	if err = session.Start(command); err != nil {
+		_ = session.Close()
+		return nil, client.commandError(command, err, "")
+	}
+	return RemotePipe{stdin: stdin, stdout: stdout, stop: session.Close}, nil
+}
+func (client *NativeSSHClient) SFTP() (*sftp.Client, error) {
+	sshClient, errConnected := client.connected()
+	if errConnected != nil { return nil, errConnected }
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil { return nil, &ConnectionError{Host: client.config.remoteHost, Err: err} }
+	return sftpClient, nil
+}
+func (client *NativeSSHClient) output(command string) ([]byte, error) { // in remote directory
+	return client.run(fmt.Sprintf("cd %s && (%s)", Filename(client.config.remoteDir).Escaped(), command))
+}
+func (client *NativeSSHClient) run(command string) ([]byte, error) { // MAYBE: stream
+	return client.runCancellable(command, nil)
+}
+func (client *NativeSSHClient) runCancellable(command string, cancelled <-chan struct{}) ([]byte, error) {
+	client.logger.Debug("running remote command", command)
+	session, err := client.session()
+	if err != nil { return nil, err }
+	defer session.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+			case <-cancelled:
+				_ = session.Signal(ssh.SIGTERM)
+				_ = session.Close() // `Run` returns
+			case <-done:
+		}
+	}()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err = session.Run(command); err != nil { return nil, client.commandError(command, err, stderr.String()) }
+	return stdout.Bytes(), nil
+}
+func (client *NativeSSHClient) commandError(command string, err error, stderr string) error {
+	exitCode := -1
+	var exitError *ssh.ExitError
+	if errors.As(err, &exitError) { exitCode = exitError.ExitStatus() }
+	return &RemoteCommandError{
+		Host:     client.config.remoteHost,
+		Command:  command,
+		ExitCode: exitCode,
+		Stderr:   strings.TrimSpace(stderr),
+		Err:      err,
+	}
+}
+func (client *NativeSSHClient) archive(updated []Updated, writer io.Writer, cancelled <-chan struct{}) error {
+	archive := tar.NewWriter(writer)
+	err := walkUpdated(client.config, updated, func(localPath string, relative string, info fs.FileInfo) error {
+		select {
+			case <-cancelled: return errors.New("upload cancelled")
+			default:
+		}
+		return client.archiveFile(archive, localPath, filepath.ToSlash(relative), info)
+	})
+	if err != nil { return err }
+	return archive.Close()
+}
+func (client *NativeSSHClient) archiveFile(archive *tar.Writer, path, name string, info fs.FileInfo) error {
+	link := ""
+	if info.Mode() & os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil { return err }
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil { return err }
+	header.Name = name
+	if info.IsDir() { header.Name += "/" }
+	if err = archive.WriteHeader(header); err != nil { return err }
+	if !info.Mode().IsRegular() { return nil }
+
+	file, err := os.Open(path)
+	if err != nil { return err }
+	defer file.Close()
+	_, err = io.CopyN(archive, file, header.Size) // file may grow meanwhile
+	return err
+}
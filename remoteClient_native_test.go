@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/0leksandr/my.go"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TestSSHServer struct { // in-process, runs commands with local `sh`
+	listener    net.Listener
+	hostKey     ssh.Signer
+	clientKey   ssh.Signer
+	connections []net.Conn
+	mx          sync.Mutex
+	env         []string // of commands, f.e. to hide binaries with PATH
+}
+func (*TestSSHServer) New(t *testing.T) *TestSSHServer {
+	newSigner := func() ssh.Signer {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		PanicIf(err)
+		signer, err := ssh.NewSignerFromKey(key)
+		PanicIf(err)
+		return signer
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	PanicIf(err)
+	server := &TestSSHServer{
+		listener:  listener,
+		hostKey:   newSigner(),
+		clientKey: newSigner(),
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(server.clientKey.PublicKey().Marshal()) { return nil, nil }
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(server.hostKey)
+	go func() {
+		for {
+			conn, errAccept := listener.Accept()
+			if errAccept != nil { return }
+			server.mx.Lock()
+			server.connections = append(server.connections, conn)
+			server.mx.Unlock()
+			go server.serve(conn, config)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+		server.Disconnect()
+	})
+	return server
+}
+func (server *TestSSHServer) Endpoint() SSHEndpoint {
+	return SSHEndpoint{
+		address: server.listener.Addr().String(),
+		clientConfig: &ssh.ClientConfig{
+			User:            "test",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(server.clientKey)},
+			HostKeyCallback: ssh.FixedHostKey(server.hostKey.PublicKey()),
+			Timeout:         time.Second,
+		},
+	}
+}
+func (server *TestSSHServer) Disconnect() { // drops all connections
+	server.mx.Lock()
+	defer server.mx.Unlock()
+	for _, conn := range server.connections { _ = conn.Close() }
+	server.connections = nil
+}
+func (server *TestSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil { return }
+	go func() {
+		for request := range requests {
+			if request.WantReply { _ = request.Reply(request.Type == "keepalive@openssh.com", nil) }
+		}
+	}()
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		channel, channelRequests, errAccept := newChannel.Accept()
+		if errAccept != nil { continue }
+		go server.session(channel, channelRequests)
+	}
+}
+func (server *TestSSHServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		length := uint32(0)
+		if len(request.Payload) >= 4 { length = binary.BigEndian.Uint32(request.Payload) }
+		if request.Type == "subsystem" && string(request.Payload[4:4 + length]) == "sftp" {
+			_ = request.Reply(true, nil)
+			sftpServer, err := sftp.NewServer(channel)
+			PanicIf(err)
+			_ = sftpServer.Serve()
+			return
+		}
+		if request.Type != "exec" {
+			if request.WantReply { _ = request.Reply(false, nil) }
+			continue
+		}
+		command := exec.Command("sh", "-c", string(request.Payload[4:4 + length]))
+		command.Env = append(os.Environ(), server.env...)
+		command.Stdout = channel
+		command.Stderr = channel.Stderr()
+		stdin, _ := command.StdinPipe()
+		go func() {
+			_, _ = io.Copy(stdin, channel)
+			_ = stdin.Close()
+		}()
+		_ = request.Reply(true, nil)
+		exitCode := 0
+		if err := command.Run(); err != nil {
+			exitCode = 255
+			var exitError *exec.ExitError
+			if errors.As(err, &exitError) { exitCode = exitError.ExitCode() }
+		}
+		status := make([]byte, 4)
+		binary.BigEndian.PutUint32(status, uint32(exitCode))
+		_, _ = channel.SendRequest("exit-status", false, status)
+		return
+	}
+}
+
+func TestNativeSSHClient(t *testing.T) {
+	server := (&TestSSHServer{}).New(t)
+	localDir := t.TempDir()
+	remoteDir := filepath.Join(t.TempDir(), "remote dir")
+	write := func(relative, contents string) {
+		path := filepath.Join(localDir, relative)
+		PanicIf(os.MkdirAll(filepath.Dir(path), 0755))
+		PanicIf(os.WriteFile(path, []byte(contents), 0644))
+	}
+	remoteContents := func(relative string) string {
+		contents, err := os.ReadFile(filepath.Join(remoteDir, relative))
+		if err != nil { return "" }
+		return string(contents)
+	}
+	write("a.txt", "a")
+	write("dir/b.txt", "b")
+	write("dir/ignored.log", "ignored")
+	write("dir/" + SSHMirrorIgnoreFile, "*.log\n")
+	PanicIf(os.Symlink("a.txt", filepath.Join(localDir, "link")))
+
+	config := Config{
+		localDir:    localDir,
+		remoteHost:  "test",
+		remoteDir:   remoteDir,
+		connTimeout: 1,
+		logger:      Logger{debug: NullLogger{}, error: &InMemoryErrorLogger{}},
+	}
+	client := NativeSSHClient{}.New(config, server.Endpoint())
+	defer client.Close()
+	client.Ready().Wait()
+
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+	PanicIf(client.Update([]Updated{{path("a.txt")}, {path("dir")}, {path("link")}, {path("missing")}}).Result())
+	my.AssertEquals(t, remoteContents("a.txt"), "a")
+	my.AssertEquals(t, remoteContents("dir/b.txt"), "b")
+	my.AssertEquals(t, remoteContents("dir/ignored.log"), "")
+	link, err := os.Readlink(filepath.Join(remoteDir, "link"))
+	PanicIf(err)
+	my.AssertEquals(t, link, "a.txt")
+
+	PanicIf(client.InPlace([]InPlaceModification{
+		Moved{from: path("a.txt"), to: path("moved/a.txt")},
+		Deleted{path("dir/b.txt")},
+		Moved{from: path("missing"), to: path("other")},
+	}).Result())
+	my.AssertEquals(t, remoteContents("moved/a.txt"), "a")
+	my.AssertEquals(t, remoteContents("dir/b.txt"), "")
+
+	manifest, err := client.Manifest(true)
+	PanicIf(err)
+	my.AssertEquals(t, len(manifest), 3)
+	my.AssertEquals(t, manifest["moved/a.txt"].size, int64(1))
+	my.Assert(t, manifest["moved/a.txt"].checksum != "")
+	my.AssertEquals(t, manifest["link"], ManifestEntry{link: "a.txt"})
+
+	_, err = client.output("echo oops >&2 && exit 3")
+	var commandError *RemoteCommandError
+	my.Assert(t, errors.As(err, &commandError))
+	my.AssertEquals(t, commandError.ExitCode, 3)
+	my.AssertEquals(t, commandError.Stderr, "oops")
+
+	server.Disconnect() // reconnects
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		time.Sleep(100 * time.Millisecond)
+		client.Ready().Wait()
+		if _, err = client.Manifest(false); err == nil { break }
+		my.Assert(t, time.Now().Before(deadline), err)
+	}
+
+	unreachable := NativeSSHClient{}.New(config, SSHEndpoint{address: "127.0.0.1:1", clientConfig: &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}})
+	defer unreachable.Close()
+	var connectionError *ConnectionError
+	my.Assert(t, errors.As(unreachable.Update([]Updated{{path("a.txt")}}).Result(), &connectionError))
+}
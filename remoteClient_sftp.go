@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type SFTPCapable interface { // connection, over which SFTP sessions can be opened
+	SharedRemoteClient
+	SFTP() (*sftp.Client, error)
+	Run(command string) error
+}
+
+type rsyncDetection struct { // shared between clients of one host
+	forced   bool // SFTP is used regardless of rsync
+	detected bool
+	missing  bool
+	mx       sync.Mutex
+}
+
+type SFTPClient struct { // for hosts without rsync. Otherwise, delegates to underlying client
+	SFTPCapable
+	config    Config
+	detection *rsyncDetection
+}
+func (SFTPClient) New(config Config, base SFTPCapable, forced bool) *SFTPClient {
+	return &SFTPClient{
+		SFTPCapable: base,
+		config:      config,
+		detection:   &rsyncDetection{forced: forced},
+	}
+}
+func (client *SFTPClient) Share(config Config) RemoteClient {
+	return &SFTPClient{
+		SFTPCapable: client.SFTPCapable.Share(config).(SFTPCapable),
+		config:      config,
+		detection:   client.detection,
+	}
+}
+func (client *SFTPClient) Update(updated []Updated) CancellableContext {
+	if !client.useSFTP() { return client.SFTPCapable.Update(updated) }
+
+	result := make(chan error, 1)
+	sftpClient, err := client.SFTP()
+	if err != nil {
+		result <- err
+		return CancellableContext{
+			Result: func() error { return <-result },
+			Cancel: func() {},
+		}
+	}
+	go func() {
+		defer sftpClient.Close()
+		result <- client.upload(sftpClient, updated)
+	}()
+	return CancellableContext{
+		Result: func() error { return <-result },
+		Cancel: func() { _ = sftpClient.Close() }, // running operation fails
+	}
+}
+func (client *SFTPClient) InPlace(modifications []InPlaceModification) CancellableContext {
+	if !client.useSFTP() { return client.SFTPCapable.InPlace(modifications) }
+
+	sftpClient, err := client.SFTP()
+	if err != nil { return CancellableContext{}.Go(func() error { return err }, func() {}) }
+	cancelled := make(chan struct{})
+	return CancellableContext{}.Go(
+		func() error {
+			defer sftpClient.Close()
+			return client.inPlace(sftpClient, modifications, cancelled)
+		},
+		func() {
+			close(cancelled)
+			_ = sftpClient.Close() // running operation fails
+		},
+	)
+}
+func (client *SFTPClient) DescribeUpdate(updated []Updated) ([]string, error) {
+	if !client.useSFTP() { return client.SFTPCapable.DescribeUpdate(updated) }
+	return describeWalk(client.config, updated, func(relative string) string {
+		return path.Join(client.config.remoteDir, filepath.ToSlash(relative))
+	})
+}
+func (client *SFTPClient) DescribeInPlace(modifications []InPlaceModification) []string {
+	if !client.useSFTP() { return client.SFTPCapable.DescribeInPlace(modifications) }
+	return describeInPlace(modifications, client.remotePath)
+}
+func (client *SFTPClient) inPlace(
+	sftpClient *sftp.Client,
+	modifications []InPlaceModification,
+	cancelled <-chan struct{},
+) error {
+	var err error
+	results := InPlaceResult{}.All(modifications, InPlaceApplied)
+	for i, modification := range modifications {
+		select {
+			case <-cancelled: return errors.New("in-place modifications cancelled")
+			default:
+		}
+		source := client.remotePath(Path{}.New(modification.OldFilename()))
+		if _, err = sftpClient.Lstat(source); errors.Is(err, os.ErrNotExist) {
+			results[i].Outcome = InPlaceGone
+			continue
+		}
+		switch modification := modification.(type) {
+			case Moved:
+				to := client.remotePath(modification.to)
+				if err = sftpClient.MkdirAll(path.Dir(to)); err == nil {
+					if err = sftpClient.PosixRename(source, to); err != nil { err = sftpClient.Rename(source, to) }
+				}
+			case Deleted:
+				err = sftpClient.RemoveAll(source)
+			default:
+				panic("unknown in-place modification")
+		}
+		if errors.Is(err, sftp.ErrSSHFxConnectionLost) { return err } // nothing more can be applied
+		if err != nil { results[i] = InPlaceResult{Modification: modification, Outcome: InPlaceFailed, Err: err} }
+	}
+	return InPlaceError{}.New(results)
+}
+func (client *SFTPClient) Manifest(checksums bool) (Manifest, error) {
+	if !client.useSFTP() || checksums { return client.SFTPCapable.Manifest(checksums) } // MAYBE: download and hash
+
+	sftpClient, err := client.SFTP()
+	if err != nil { return nil, err }
+	defer sftpClient.Close()
+	manifest := Manifest{}
+	walker := sftpClient.Walk(client.config.remoteDir)
+	for walker.Step() {
+		if err = walker.Err(); err != nil {
+			if errors.Is(err, os.ErrNotExist) { continue }
+			return nil, err
+		}
+		info := walker.Stat()
+		relative, errRelative := filepath.Rel(client.config.remoteDir, walker.Path())
+		if errRelative != nil { return nil, errRelative }
+		if info.Mode() & os.ModeSymlink != 0 && relative != "." {
+			link, errLink := sftpClient.ReadLink(walker.Path())
+			if errLink != nil { return nil, errLink }
+			manifest[Filename(relative)] = ManifestEntry{link: link}
+			continue
+		}
+		if !info.Mode().IsRegular() { continue }
+		manifest[Filename(relative)] = ManifestEntry{
+			size:  info.Size(),
+			mtime: info.ModTime().Unix(),
+		}
+	}
+	return manifest, nil
+}
+func (client *SFTPClient) useSFTP() bool {
+	detection := client.detection
+	detection.mx.Lock()
+	defer detection.mx.Unlock()
+	if detection.forced { return true }
+	if !detection.detected {
+		err := client.Run("rsync --version")
+		var commandError *RemoteCommandError
+		switch {
+			case err == nil:
+				detection.detected = true
+			case errors.As(err, &commandError) && commandError.ExitCode > 0:
+				detection.detected = true
+				detection.missing = true
+				if client.config.verbosity > 0 {
+					fmt.Printf("rsync is not available on %s. Uploading with SFTP\n", client.config.remoteHost)
+				}
+			default: // could not connect. Detect next time
+				client.config.logger.Debug("rsync detection failed", err)
+		}
+	}
+	return detection.missing
+}
+func (client *SFTPClient) remotePath(relative Path) string {
+	return path.Join(client.config.remoteDir, filepath.ToSlash(relative.original.Real()))
+}
+func (client *SFTPClient) upload(sftpClient *sftp.Client, updated []Updated) error {
+	type Dir struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []Dir // times are set after contents are uploaded
+	createdParents := make(map[string]bool)
+	stamp := client.config.trash.Stamp(time.Now())
+	err := walkUpdated(client.config, updated, func(localPath string, relative string, info fs.FileInfo) error {
+		remotePath := path.Join(client.config.remoteDir, filepath.ToSlash(relative))
+		if parent := path.Dir(remotePath); !createdParents[parent] {
+			if err := sftpClient.MkdirAll(parent); err != nil { return err }
+			createdParents[parent] = true
+		}
+		switch {
+			case info.IsDir():
+				if err := sftpClient.MkdirAll(remotePath); err != nil { return err }
+				createdParents[remotePath] = true
+				dirs = append(dirs, Dir{path: remotePath, mtime: info.ModTime()})
+				return sftpClient.Chmod(remotePath, info.Mode().Perm())
+			case info.Mode() & os.ModeSymlink != 0:
+				link, err := os.Readlink(localPath)
+				if err != nil { return err }
+				_ = sftpClient.Remove(remotePath)
+				return sftpClient.Symlink(link, remotePath)
+			default:
+				backup := func() error { return client.backup(sftpClient, relative, stamp) }
+				return client.uploadFile(sftpClient, localPath, remotePath, info, backup)
+		}
+	})
+	if err != nil { return err }
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = sftpClient.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime); err != nil { return err }
+	}
+	return nil
+}
+func (client *SFTPClient) backup(sftpClient *sftp.Client, relative string, stamp string) error { // into trash
+	if !client.config.trash.enabled { return nil }
+	remotePath := path.Join(client.config.remoteDir, filepath.ToSlash(relative))
+	if existing, err := sftpClient.Lstat(remotePath); err != nil || existing.IsDir() { return nil }
+	trashed := client.remotePath(client.config.trash.Path(stamp, Path{}.New(Filename(relative))))
+	if err := sftpClient.MkdirAll(path.Dir(trashed)); err != nil { return err }
+	return sftpClient.PosixRename(remotePath, trashed)
+}
+func (client *SFTPClient) uploadFile(
+	sftpClient *sftp.Client,
+	localPath, remotePath string,
+	info fs.FileInfo,
+	backup func() error, // of old version, once new one is fully uploaded
+) error {
+	local, err := os.Open(localPath)
+	if err != nil {
+		if os.IsNotExist(err) { return nil }
+		return err
+	}
+	defer local.Close()
+	// uploaded under temporary name, which replaces destination at once. Thus, interruption leaves old version intact
+	temporary := uploadingName(remotePath)
+	remote, err := sftpClient.OpenFile(temporary, os.O_WRONLY | os.O_CREATE | os.O_EXCL)
+	if err != nil { return err }
+	renamed := false
+	defer func() {
+		if !renamed { _ = sftpClient.Remove(temporary) }
+	}()
+	if _, err = io.Copy(remote, local); err != nil {
+		_ = remote.Close()
+		return err
+	}
+	if err = remote.Close(); err != nil { return err }
+	if err = sftpClient.Chmod(temporary, info.Mode().Perm()); err != nil { return err }
+	if err = sftpClient.Chtimes(temporary, info.ModTime(), info.ModTime()); err != nil { return err }
+	if err = backup(); err != nil { return err }
+	if existing, errStat := sftpClient.Lstat(remotePath); errStat == nil && existing.IsDir() { // replaced with file
+		if err = sftpClient.RemoveAll(remotePath); err != nil { return err }
+	}
+	if _, posix := sftpClient.HasExtension("posix-rename@openssh.com"); posix {
+		err = sftpClient.PosixRename(temporary, remotePath)
+	} else { // plain rename does not replace
+		if err = sftpClient.Remove(remotePath); err == nil || errors.Is(err, os.ErrNotExist) {
+			err = sftpClient.Rename(temporary, remotePath)
+		}
+	}
+	renamed = err == nil
+	return err
+}
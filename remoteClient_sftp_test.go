@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/0leksandr/my.go"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSFTPClient(t *testing.T) {
+	server := (&TestSSHServer{}).New(t)
+	localDir := t.TempDir()
+	remoteDir := filepath.Join(t.TempDir(), "remote")
+	write := func(relative, contents string, mode os.FileMode) {
+		path := filepath.Join(localDir, relative)
+		PanicIf(os.MkdirAll(filepath.Dir(path), 0755))
+		PanicIf(os.WriteFile(path, []byte(contents), mode))
+	}
+	write("dir/sub/a.sh", "a", 0751)
+	write("dir/b.log", "b", 0644)
+	write(SSHMirrorIgnoreFile, "*.log\n", 0644)
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	PanicIf(os.Chtimes(filepath.Join(localDir, "dir/sub/a.sh"), mtime, mtime))
+	PanicIf(os.Chtimes(filepath.Join(localDir, "dir"), mtime, mtime))
+
+	config := Config{
+		localDir:    localDir,
+		remoteHost:  "test",
+		remoteDir:   remoteDir,
+		connTimeout: 1,
+		logger:      Logger{debug: NullLogger{}, error: &InMemoryErrorLogger{}},
+	}
+	native := NativeSSHClient{}.New(config, server.Endpoint())
+	defer native.Close()
+	native.Ready().Wait()
+
+	fakeBin := t.TempDir()
+	PanicIf(os.WriteFile(filepath.Join(fakeBin, "rsync"), []byte("#!/bin/sh\n"), 0755))
+	server.env = []string{"PATH=" + fakeBin + ":" + os.Getenv("PATH")}
+	my.Assert(t, !SFTPClient{}.New(config, native, false).useSFTP())
+	server.env = []string{"PATH=/nonexistent"}
+	client := SFTPClient{}.New(config, native, false)
+	my.Assert(t, client.useSFTP())
+
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+	PanicIf(client.Update([]Updated{{path("dir")}}).Result())
+	info, err := os.Stat(filepath.Join(remoteDir, "dir/sub/a.sh"))
+	PanicIf(err)
+	my.AssertEquals(t, info.Mode().Perm(), os.FileMode(0751))
+	my.AssertEquals(t, info.ModTime().Unix(), mtime.Unix())
+	info, err = os.Stat(filepath.Join(remoteDir, "dir"))
+	PanicIf(err)
+	my.AssertEquals(t, info.ModTime().Unix(), mtime.Unix())
+	_, err = os.Stat(filepath.Join(remoteDir, "dir/b.log"))
+	my.Assert(t, os.IsNotExist(err))
+
+	PanicIf(client.InPlace([]InPlaceModification{
+		Moved{from: path("dir/sub/a.sh"), to: path("moved/a.sh")},
+		Deleted{path("dir/sub")},
+		Deleted{path("missing")},
+	}).Result())
+	_, err = os.Stat(filepath.Join(remoteDir, "dir/sub"))
+	my.Assert(t, os.IsNotExist(err))
+
+	PanicIf(os.Symlink("moved/a.sh", filepath.Join(remoteDir, "link")))
+	manifest, err := client.Manifest(false)
+	PanicIf(err)
+	my.AssertEquals(t, manifest, Manifest{"moved/a.sh": {size: 1, mtime: mtime.Unix()}, "link": {link: "moved/a.sh"}})
+	PanicIf(os.Remove(filepath.Join(remoteDir, "link")))
+
+	client.config.trash = Trash{enabled: true}
+	write("moved/a.sh", "new", 0644)
+	PanicIf(client.Update([]Updated{{path("moved/a.sh")}}).Result())
+	manifest, err = client.Manifest(false)
+	PanicIf(err)
+	my.AssertEquals(t, len(manifest), 2)
+	for filename := range manifest {
+		if isTrashed(filename) { my.AssertEquals(t, manifest[filename].size, int64(1)) } // overwritten one
+	}
+}
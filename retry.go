@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const RetryJitter = 0.2
+
+type ErrorClass uint8
+const (
+	ErrorOther ErrorClass = iota
+	ErrorConnection // remote host is unreachable. Modifications are not at fault
+	ErrorPermission
+	ErrorNoSpace
+)
+func (class ErrorClass) String() string {
+	switch class {
+		case ErrorOther:      return "other"
+		case ErrorConnection: return "connection"
+		case ErrorPermission: return "permission"
+		case ErrorNoSpace:    return "no space"
+		default:              panic("unknown error class")
+	}
+}
+
+func classifyError(err error) ErrorClass {
+	var connectionError *ConnectionError
+	var timeoutError *TimeoutError
+	switch {
+		case errors.As(err, &connectionError),
+			errors.As(err, &timeoutError), // network stalled
+			errors.Is(err, sftp.ErrSSHFxConnectionLost),
+			errors.Is(err, io.ErrUnexpectedEOF):
+			return ErrorConnection
+		case errors.Is(err, fs.ErrPermission):
+			return ErrorPermission
+		case errors.Is(err, syscall.ENOSPC):
+			return ErrorNoSpace
+	}
+
+	message := strings.ToLower(err.Error()) // errors of remote commands are known only by text
+	for _, noSpace := range []string{"no space left on device", "disk quota exceeded"} {
+		if strings.Contains(message, noSpace) { return ErrorNoSpace }
+	}
+	for _, permission := range []string{"permission denied", "operation not permitted", "read-only file system"} {
+		if strings.Contains(message, permission) { return ErrorPermission }
+	}
+	return ErrorOther
+}
+
+type RetryPolicy struct { // zero value retries immediately and endlessly
+	delay       time.Duration // after first failure. Doubled after each next one
+	maxDelay    time.Duration
+	jitter      float64 // randomized fraction of delay, so that targets do not retry all at once
+	maxAttempts int     // then, modifications are parked. 0 means unlimited
+}
+func (policy RetryPolicy) Delay(class ErrorClass, attempt int) time.Duration {
+	delay := policy.delay
+	for i := 1; i < attempt && delay < policy.maxDelay; i++ { delay *= 2 }
+	if delay > policy.maxDelay || class == ErrorNoSpace { delay = policy.maxDelay } // space is not freed in seconds
+	if policy.jitter > 0 { delay += time.Duration((rand.Float64() * 2 - 1) * policy.jitter * float64(delay)) }
+	return delay
+}
+func (policy RetryPolicy) GivesUp(class ErrorClass, attempt int) bool {
+	// modifications are not parked while connection is lost, as they would fail all at once
+	return class != ErrorConnection && policy.maxAttempts > 0 && attempt >= policy.maxAttempts
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/0leksandr/my.go"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	for err, class := range map[error]ErrorClass{
+		&ConnectionError{Host: "host", Err: errors.New("Permission denied (publickey)")}:  ErrorConnection,
+		&os.PathError{Op: "open", Path: "a", Err: syscall.EACCES}:                        ErrorPermission,
+		fmt.Errorf("writing: %w", syscall.ENOSPC):                                        ErrorNoSpace,
+		&RemoteCommandError{Stderr: "rsync: write failed on \"a\": No space left on device"}: ErrorNoSpace,
+		errors.New("a: mv: cannot move 'a' to 'b': Permission denied"):                   ErrorPermission,
+		errors.New("something else"):                                                     ErrorOther,
+	} {
+		my.AssertEquals(t, classifyError(err), class, err)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{delay: time.Second, maxDelay: 5 * time.Second, maxAttempts: 3}
+	delays := make([]time.Duration, 0)
+	for attempt := 1; attempt <= 5; attempt++ { delays = append(delays, policy.Delay(ErrorOther, attempt)) }
+	my.AssertEquals(t, delays, []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second})
+	my.AssertEquals(t, policy.Delay(ErrorNoSpace, 1), 5 * time.Second)
+
+	policy.jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(ErrorOther, 2)
+		my.Assert(t, delay >= time.Second && delay <= 3 * time.Second, delay)
+	}
+
+	my.Assert(t, !policy.GivesUp(ErrorPermission, 2))
+	my.Assert(t, policy.GivesUp(ErrorPermission, 3))
+	my.Assert(t, !policy.GivesUp(ErrorConnection, 100))
+	my.Assert(t, !RetryPolicy{}.GivesUp(ErrorOther, 100))
+}
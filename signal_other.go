@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+const RetrySignalName = "no signal on this platform"
+
+var retrySignals []os.Signal
@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const RetrySignalName = "SIGUSR1"
+
+var retrySignals = []os.Signal{syscall.SIGUSR1} // retry parked modifications
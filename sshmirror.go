@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"flag"
@@ -10,22 +11,19 @@ import (
 	"io/fs"
 	"os"
 	"os/signal"
-	"os/user"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 // TODO: upload directories on initial sync
-// TODO: timeout sync operations
 // TODO: re-sync with timeout on error
 // TODO: ignore special types of files (pipes, block devices etc.)
-// TODO: support scp without rsync
 // MAYBE: support symlinks
-// MAYBE: automatically adjust timeout based on server response rate
 // MAYBE: copy permissions
 // MAYBE: copy files metadata (creation time etc.)
 // MAYBE: upload new files with scp
@@ -110,28 +108,46 @@ func (fileSize FileSize) Add(other FileSize) FileSize {
 func (fileSize FileSize) IsLess(other FileSize) bool {
 	return fileSize.Bytes() < other.Bytes()
 }
+func (fileSize FileSize) String() string {
+	bytes := fileSize.Bytes()
+	switch {
+		case bytes >= 1 << 30: return fmt.Sprintf("%.1fGb", float64(bytes) / (1 << 30))
+		case bytes >= 1 << 20: return fmt.Sprintf("%.1fMb", float64(bytes) / (1 << 20))
+		case bytes >= 1 << 10: return fmt.Sprintf("%.1fKb", float64(bytes) / (1 << 10))
+		default:               return fmt.Sprintf("%db", bytes)
+	}
+}
 
 type CancellableContext struct { // MAYBE: rename
 	Result     func() error
 	Cancel     func()
 	ResultChan <-chan error // TODO: remove/handle
 }
+func (CancellableContext) Go(run func() error, cancel func()) CancellableContext { // `run` is started in background
+	result := make(chan error, 1)
+	var cancelOnce sync.Once
+	go func() { result <- run() }()
+	return CancellableContext{
+		Result:     func() error { return <-result },
+		Cancel:     func() { cancelOnce.Do(cancel) },
+		ResultChan: result,
+	}
+}
 
-type SwitchChannelPaths struct { // MAYBE: atomic
-	on bool
+type SwitchChannelPaths struct {
+	on atomic.Bool // switched by syncing goroutine, read by receiving one
 	ch chan Path
 }
-func (SwitchChannelPaths) New() *SwitchChannelPaths {
+func (*SwitchChannelPaths) New() *SwitchChannelPaths {
 	return &SwitchChannelPaths{
-		on: false,
 		ch: make(chan Path), // MAYBE: buffer
 	}
 }
 func (c *SwitchChannelPaths) On() {
-	c.on = true
+	c.on.Store(true)
 }
 func (c *SwitchChannelPaths) Off() {
-	c.on = false
+	c.on.Store(false)
 	for {
 		select {
 			case _, ok := <-c.ch: if !ok { return }
@@ -140,33 +156,115 @@ func (c *SwitchChannelPaths) Off() {
 	}
 }
 func (c *SwitchChannelPaths) Put(path Path) {
-	if c.on { c.ch <- path }
+	if c.on.Load() { c.ch <- path }
 }
 func (c *SwitchChannelPaths) Get() <-chan Path {
 	return c.ch
 }
 
+type RemoteTarget struct {
+	host string // empty for local destination
+	dir  string
+}
+func (target RemoteTarget) String() string {
+	if target.IsLocal() { return LocalScheme + target.dir }
+	return target.host + ":" + target.dir
+}
+func (target RemoteTarget) IsLocal() bool {
+	return target.host == "" && target.dir != ""
+}
+func (target RemoteTarget) normalized() RemoteTarget { // `file://` destination does not need host
+	if isLocalDestination(target.dir) {
+		return RemoteTarget{dir: strings.TrimPrefix(target.dir, LocalScheme)}
+	}
+	return target
+}
+
+const CommandRun = "run"
+const CommandInit = "init"
+const CommandRestore = "restore"
+
 type Config struct {
+	command string
+
 	// parameters
 	localDir   string
 	remoteHost string
 	remoteDir  string
+	targets    []RemoteTarget // if empty, the only target is `remoteHost:remoteDir`
+	mappings   []Mapping      // if empty, the whole `localDir` is mirrored to `remoteDir`
 
 	// flags
 	identityFile string
 	connTimeout  int
 	verbosity    int
-	exclude      string
+	exclude      []string // regexps
+	gitignore    bool
+	transport    string
+	sftp         bool
+	agent        bool
 	watcher      string
+	pollInterval time.Duration
+	init         bool
+	batchSize    FileSize
+	checksums    bool
+	deleteExtra  bool
+	retry        RetryPolicy
+	timeouts     SyncTimeouts
+	windows      BatchWindows
+	journal      string // path of database. Empty disables journaling
+	guard        DeletionGuard
+	trash        Trash
+	restorePath  string // for `restore` command. Relative to `localDir`
+	restoreStamp string // empty means latest
+	dryRun       bool
+	control      string // socket path. Empty disables
 
 	// services?
-	logger Logger
+	logger   Logger
+	excluder Excluder // all exclusions, relative to `localDir`. If nil, only ignore files apply to uploaded directories
 }
 func (Config) ParseArguments() Config {
+	command := CommandRun
+	arguments := os.Args[1:]
+	if len(arguments) > 0 {
+		switch arguments[0] {
+			case CommandRun, CommandInit, CommandRestore:
+				command = arguments[0]
+				arguments = arguments[1:]
+		}
+	}
+
 	identityFile := flag.String("i", "", "identity file (rsa)")
 	connTimeout  := flag.Int("t", 5, "connection timeout (seconds)")
 	verbosity    := flag.Int("v", 2, "verbosity level (0-3)")
-	exclude      := flag.String("e", "", "exclude pattern (regexp, f.e. '^\\.git/')")
+	var exclude []string
+	flag.Func(
+		"e",
+		"exclude pattern (regexp, f.e. '^\\.git/'). Can be repeated. Also, patterns from " + SSHMirrorIgnoreFile +
+			" files (with .gitignore syntax) are excluded",
+		func(value string) error {
+			exclude = append(exclude, value)
+			return nil
+		},
+	)
+	gitignore := flag.Bool("gitignore", false, "exclude files, ignored by " + GitIgnoreFile + " files")
+	transport := flag.String(
+		"transport",
+		TransportSSH,
+		fmt.Sprintf(
+			"how to connect to remote host. Available values: %s (ssh and rsync binaries), %s (built-in SSH client)",
+			TransportSSH,
+			TransportNative,
+		),
+	)
+	useSFTP := flag.Bool("sftp", false, "upload files with SFTP instead of rsync (default: if rsync is not available remotely)")
+	useAgent := flag.Bool(
+		"agent",
+		false,
+		"upload sshmirror binary to remote host (~/" + AgentDir + "), and apply modifications with it. Remote " +
+			"host must have same OS and architecture",
+	)
 	errorCmd     := flag.String(
 		"error-cmd",
 		"",
@@ -176,43 +274,330 @@ func (Config) ParseArguments() Config {
 	watcher := flag.String(
 		"watcher",
 		"",
-		fmt.Sprintf("FS watcher. Available values: %s, %s", InotifyWatcher{}.Name(), FsnotifyWatcher{}.Name()),
+		fmt.Sprintf(
+			"FS watcher. Available values: %s, %s, %s, %s",
+			InotifyWatcher{}.Name(),
+			NativeInotifyWatcher{}.Name(),
+			FsnotifyWatcher{}.Name(),
+			PollingWatcher{}.Name(),
+		),
+	)
+	pollInterval := flag.Duration(
+		"poll-interval",
+		1 * time.Second,
+		fmt.Sprintf("interval of scanning local directory (for \"%s\" watcher)", PollingWatcher{}.Name()),
+	)
+	initSync  := flag.Bool("init", false, "upload all existing files before starting to watch")
+	batchSize := flag.Uint64("batch-size", 10, "size of a batch during initial sync (megabytes)")
+	checksums := flag.Bool("checksums", false, "compare checksums of files (not only sizes and times) on initial sync")
+	deleteExtra := flag.Bool(
+		"delete-extraneous",
+		false,
+		"on initial sync, delete remote files, that do not exist locally (excluded ones are kept)",
 	)
 
-	flag.Parse()
+	retryAttempts := flag.Int(
+		"retry-attempts",
+		10,
+		"failed attempts in a row, after which modifications are parked until next successful sync (or " +
+			RetrySignalName + "). Connection errors are retried endlessly. 0 means unlimited",
+	)
+	retryDelay := flag.Duration("retry-delay", 1 * time.Second, "delay before retrying a failed sync. Doubled after each failure")
+	retryMaxDelay := flag.Duration("retry-max-delay", 1 * time.Minute, "maximal delay before retrying a failed sync")
+	syncTimeout := flag.Duration(
+		"sync-timeout",
+		30 * time.Second,
+		"minimal timeout of a sync operation. Grows with size of a batch. Stalled operation is cancelled and retried",
+	)
+	syncTimeoutMax := flag.Duration("sync-timeout-max", 1 * time.Hour, "maximal timeout of a sync operation. 0 disables timeouts")
 
-	if flag.NArg() != 3 {
-		WriteToStderr("Usage: of " + os.Args[0] + ":\nOptional flags:")
+	batchWait := flag.Duration(
+		"batch-wait",
+		DefaultBatchWindows.wait,
+		"modifications are synced, when no new ones were made for this long",
+	)
+	batchMaxWait := flag.Duration(
+		"batch-max-wait",
+		DefaultBatchWindows.maxWait,
+		"modifications are synced at the latest this long after first of them was made",
+	)
+	adaptiveBatching := flag.Bool(
+		"adaptive-batching",
+		false,
+		"tune batch-wait and batch-max-wait to measured speed of remote host: slow hosts get bigger batches",
+	)
+	guardFiles := flag.Int(
+		"guard-files",
+		DefaultGuardFiles,
+		"deleting more files at once needs confirmation (typed in terminal). Other targets are synced meanwhile. " +
+			"0 means unlimited",
+	)
+	guardSize := flag.Uint64(
+		"guard-size",
+		0,
+		"deleting more megabytes at once needs confirmation. Remote files are listed to measure it. 0 means unlimited",
+	)
+	var protected []string
+	flag.Func(
+		"protect",
+		"moving or deleting matching files (regexp, f.e. '^\\.env$' or '^uploads/') needs confirmation. Can be repeated",
+		func(value string) error {
+			protected = append(protected, value)
+			return nil
+		},
+	)
+	useTrash := flag.Bool(
+		"trash",
+		false,
+		"instead of deleting remote files, move them into " + TrashDir + " directory of DESTINATION (also, files " +
+			"overwritten by rsync). They can be brought back with \"" + CommandRestore + "\" command",
+	)
+	trashMaxAge := flag.Duration("trash-max-age", 7 * 24 * time.Hour, "files are deleted from trash after this time. 0 means never")
+	trashMaxSize := flag.Uint64("trash-max-size", 1024, "oldest files are deleted from trash above this size (megabytes). 0 means unlimited")
+	restorePath := flag.String("path", "", "for \"" + CommandRestore + "\" command: file or directory (relative to SOURCE)")
+	restoreStamp := flag.String(
+		"stamp",
+		"",
+		"for \"" + CommandRestore + "\" command: time of deletion (name of directory in trash). Default: latest",
+	)
+	dryRun := flag.Bool(
+		"dry-run",
+		false,
+		"print operations of the transport (rsync command, remote commands, agent requests or uploaded files) instead " +
+			"of executing them. Remote host is still connected to and listed. Journal is not used",
+	)
+	control := flag.String(
+		"control",
+		"",
+		"control socket, to which \"" + os.Args[0] + " " + CommandCtl + "\" connects. Default: derived from SOURCE. \"" +
+			ControlNone + "\" disables",
+	)
+	journal := flag.String(
+		"journal",
+		DefaultJournalPath(),
+		"database, where not yet synced modifications are kept. They are synced on next start, if sshmirror was " +
+			"stopped before syncing them. Empty disables journaling",
+	)
+
+	var mappings []Mapping
+	flag.Func(
+		"map",
+		"mirror only subdirectory LOCAL of SOURCE to REMOTE (absolute, or relative to DESTINATION). Format: " +
+			"LOCAL:REMOTE. Can be repeated",
+		func(value string) error {
+			mapping, err := Mapping{}.Parse(value)
+			if err == nil { mappings = append(mappings, mapping) }
+			return err
+		},
+	)
+	configPath := flag.String(
+		"config",
+		"",
+		"config file (default: .sshmirror.toml/.yaml in current directory, or config.toml/.yaml in " +
+			"~/.config/sshmirror/)",
+	)
+
+	var positional []string // flags can go before and after profile name
+	for {
+		Must(flag.CommandLine.Parse(arguments))
+		if flag.NArg() == 0 { break }
+		positional = append(positional, flag.Arg(0))
+		arguments = flag.Args()[1:]
+	}
+
+	exitWithError := func(err error) {
+		WriteToStderr(err.Error())
+		os.Exit(1)
+	}
+	configFile := ConfigFile{}
+	if *configPath == "" {
+		found, err := ConfigFile{}.Find()
+		if err != nil { exitWithError(err) }
+		*configPath = found
+	}
+	if *configPath != "" {
+		loaded, err := ConfigFile{}.Load(*configPath)
+		if err != nil { exitWithError(err) }
+		configFile = loaded
+	}
+	profileName := ""
+	if len(positional) == 1 { profileName = positional[0] }
+	profile, errProfile := configFile.Get(profileName)
+	if errProfile != nil { exitWithError(errProfile) }
+	if len(positional) >= 2 {
+		override := Profile{LocalDir: positional[0]}
+		for i := 1; i < len(positional); i++ {
+			switch {
+				case isLocalDestination(positional[i]): // single argument
+					override.Targets = append(override.Targets, ProfileTarget{Remote: positional[i]})
+				case i + 1 < len(positional):
+					override.Targets = append(override.Targets, ProfileTarget{Host: positional[i], Remote: positional[i + 1]})
+					i++
+				default: // HOST without DESTINATION
+					override = Profile{}
+					profile = Profile{}
+			}
+		}
+		profile = profile.Merge(override)
+	}
+	targets := profile.GetTargets()
+	for _, target := range targets {
+		hasMappings := len(mappings) > 0 || profile.Mappings != nil // absolute remote directories
+		if (target.host == "" && !target.IsLocal()) || (target.dir == "" && !hasMappings) { targets = nil }
+	}
+
+	if profile.LocalDir == "" || len(targets) == 0 {
+		WriteToStderr(
+			"Usage: of " + os.Args[0] + " [COMMAND] [FLAGS] SOURCE HOST DESTINATION [HOST DESTINATION]...\n" +
+				"    or " + os.Args[0] + " [COMMAND] [FLAGS] SOURCE " + LocalScheme + "DESTINATION\n" +
+				"    or " + os.Args[0] + " [COMMAND] [PROFILE] [FLAGS]\n" +
+				"Commands:",
+		)
+		WriteToStderr(
+			"  " + CommandRun + " - watch SOURCE and mirror it to DESTINATION (default)\n" +
+				"  " + CommandInit + " - upload all existing files of SOURCE to DESTINATION, and exit\n" +
+				"  " + CommandRestore + " - bring back file or directory -path from trash of DESTINATION, and exit\n" +
+				"  " + CommandCtl + " - control running sshmirror (see \"" + os.Args[0] + " " + CommandCtl + " -help\")",
+		)
+		WriteToStderr("Optional flags:")
 		flag.PrintDefaults()
 		WriteToStderr(
-			"Required parameters:\n" +
+			"Required parameters (can be set in config file):\n" +
 				"  SOURCE - local directory (absolute path)\n" +
 				"  HOST (IP or HOST or USER@HOST)\n" +
-				"  DESTINATION - remote directory (absolute path)]",
+				"  DESTINATION - remote directory (absolute path)]\n" +
+				"  PROFILE - name of a profile from config file\n" +
+				"Multiple pairs of HOST DESTINATION can be passed to mirror SOURCE to all of them. " +
+				LocalScheme + "DESTINATION (without HOST) is a directory on local (f.e. mounted) filesystem",
 		)
 		os.Exit(1)
 	}
 
-	localDir   := stripTrailSlash(flag.Arg(0))
-	remoteHost := flag.Arg(1)
-	remoteDir  := stripTrailSlash(flag.Arg(2))
+	isSet := make(map[string]bool) // explicitly, in command line. They override values from config file
+	flag.Visit(func(f *flag.Flag) { isSet[f.Name] = true })
+	if !isSet["i"]                 && profile.IdentityFile != "" { *identityFile = profile.IdentityFile       }
+	if !isSet["t"]                 && profile.ConnTimeout  != nil { *connTimeout = *profile.ConnTimeout      }
+	if !isSet["v"]                 && profile.Verbosity    != nil { *verbosity   = *profile.Verbosity        }
+	if !isSet["e"]                 && profile.Exclude      != nil { exclude      = profile.Exclude            }
+	if !isSet["gitignore"]         && profile.Gitignore    != nil { *gitignore   = *profile.Gitignore        }
+	if !isSet["transport"]         && profile.Transport    != "" { *transport    = profile.Transport          }
+	if !isSet["sftp"]              && profile.SFTP         != nil { *useSFTP     = *profile.SFTP             }
+	if !isSet["agent"]             && profile.Agent        != nil { *useAgent    = *profile.Agent            }
+	if !isSet["error-cmd"]         && profile.ErrorCmd     != "" { *errorCmd     = profile.ErrorCmd           }
+	if !isSet["watcher"]           && profile.Watcher      != "" { *watcher      = profile.Watcher            }
+	if !isSet["batch-size"]        && profile.BatchSize    != nil { *batchSize   = *profile.BatchSize        }
+	if !isSet["checksums"]         && profile.Checksums    != nil { *checksums   = *profile.Checksums        }
+	if !isSet["delete-extraneous"] && profile.DeleteExtra  != nil { *deleteExtra = *profile.DeleteExtra      }
+	if !isSet["map"]               && profile.Mappings     != nil {
+		for _, profileMapping := range profile.Mappings {
+			mapping, err := Mapping{}.New(profileMapping.Local, profileMapping.Remote)
+			if err != nil { exitWithError(err) }
+			mappings = append(mappings, mapping)
+		}
+	}
+	if !isSet["poll-interval"]     && profile.PollInterval != "" {
+		interval, err := profile.GetPollInterval()
+		if err != nil { exitWithError(err) }
+		*pollInterval = interval
+	}
+	if !isSet["retry-attempts"]    && profile.RetryAttempts != nil { *retryAttempts = *profile.RetryAttempts }
+	if !isSet["retry-delay"]       && profile.RetryDelay != "" {
+		delay, err := time.ParseDuration(profile.RetryDelay)
+		if err != nil { exitWithError(err) }
+		*retryDelay = delay
+	}
+	if !isSet["retry-max-delay"]   && profile.RetryMaxDelay != "" {
+		delay, err := time.ParseDuration(profile.RetryMaxDelay)
+		if err != nil { exitWithError(err) }
+		*retryMaxDelay = delay
+	}
+	if *retryMaxDelay < *retryDelay { exitWithError(errors.New("-retry-max-delay is less than -retry-delay")) }
+	if !isSet["batch-wait"]        && profile.BatchWait != "" {
+		wait, err := time.ParseDuration(profile.BatchWait)
+		if err != nil { exitWithError(err) }
+		*batchWait = wait
+	}
+	if !isSet["batch-max-wait"]    && profile.BatchMaxWait != "" {
+		wait, err := time.ParseDuration(profile.BatchMaxWait)
+		if err != nil { exitWithError(err) }
+		*batchMaxWait = wait
+	}
+	if !isSet["adaptive-batching"] && profile.AdaptiveBatching != nil { *adaptiveBatching = *profile.AdaptiveBatching }
+	if !isSet["guard-files"]       && profile.GuardFiles != nil { *guardFiles = *profile.GuardFiles }
+	if !isSet["guard-size"]        && profile.GuardSize  != nil { *guardSize  = *profile.GuardSize  }
+	if !isSet["protect"]           && profile.Protect    != nil { protected   = profile.Protect      }
+	guard, errGuard := DeletionGuard{}.New(*guardFiles, FileSize{megabytes: *guardSize}, protected)
+	if errGuard != nil { exitWithError(errGuard) }
+	if !isSet["trash"]             && profile.Trash != nil { *useTrash = *profile.Trash }
+	if !isSet["trash-max-age"]     && profile.TrashMaxAge != "" {
+		age, err := time.ParseDuration(profile.TrashMaxAge)
+		if err != nil { exitWithError(err) }
+		*trashMaxAge = age
+	}
+	if !isSet["trash-max-size"]    && profile.TrashMaxSize != nil { *trashMaxSize = *profile.TrashMaxSize }
+	if *useTrash && (*useAgent || (*transport == TransportNative && !*useSFTP)) { // overwritten files are not backed up
+		exitWithError(errors.New("-trash is supported with rsync, SFTP and " + LocalScheme + " destinations only"))
+	}
+	if command == CommandRestore && *restorePath == "" { exitWithError(errors.New("-path is required")) }
+	if !isSet["journal"]           && profile.Journal != nil { *journal = expandHome(*profile.Journal) }
+	if !isSet["control"]           && profile.Control != "" { *control = expandHome(profile.Control) }
+	if !isSet["sync-timeout"]      && profile.SyncTimeout != "" {
+		timeout, err := time.ParseDuration(profile.SyncTimeout)
+		if err != nil { exitWithError(err) }
+		*syncTimeout = timeout
+	}
+	if !isSet["sync-timeout-max"]  && profile.SyncTimeoutMax != "" {
+		timeout, err := time.ParseDuration(profile.SyncTimeoutMax)
+		if err != nil { exitWithError(err) }
+		*syncTimeoutMax = timeout
+	}
 
-	if len(localDir) >= 2 && localDir[:2] == "~/" {
-		usr, err := user.Current()
-		PanicIf(err)
-		dir := usr.HomeDir
-		localDir = filepath.Join(dir, localDir[2:])
+	localDir := stripTrailSlash(expandHome(profile.LocalDir))
+	switch *control {
+		case "":          *control = DefaultControlPath(localDir)
+		case ControlNone: *control = ""
+	}
+	for i := range targets {
+		if targets[i].IsLocal() { targets[i].dir = expandHome(targets[i].dir) }
+		targets[i].dir = stripTrailSlash(targets[i].dir)
 	}
 
 	return Config{
+		command:      command,
 		localDir:     localDir,
-		remoteHost:   remoteHost,
-		remoteDir:    remoteDir,
+		remoteHost:   targets[0].host,
+		remoteDir:    targets[0].dir,
+		targets:      targets,
+		mappings:     mappings,
 		identityFile: *identityFile,
 		connTimeout:  *connTimeout,
 		verbosity:    *verbosity,
-		exclude:      *exclude,
+		exclude:      exclude,
+		gitignore:    *gitignore,
+		transport:    *transport,
+		sftp:         *useSFTP,
+		agent:        *useAgent,
 		watcher:      *watcher,
+		pollInterval: *pollInterval,
+		init:         *initSync,
+		batchSize:    FileSize{megabytes: *batchSize},
+		checksums:    *checksums,
+		deleteExtra:  *deleteExtra,
+		retry:        RetryPolicy{
+			delay:       *retryDelay,
+			maxDelay:    *retryMaxDelay,
+			jitter:      RetryJitter,
+			maxAttempts: *retryAttempts,
+		},
+		timeouts:     SyncTimeouts{min: *syncTimeout, max: *syncTimeoutMax},
+		windows:      BatchWindows{wait: *batchWait, maxWait: *batchMaxWait, adaptive: *adaptiveBatching},
+		journal:      expandHome(*journal),
+		dryRun:       *dryRun,
+		control:      *control,
+		guard:        guard,
+		trash:        Trash{enabled: *useTrash, maxAge: *trashMaxAge, maxSize: FileSize{megabytes: *trashMaxSize}},
+		restorePath:  *restorePath,
+		restoreStamp: *restoreStamp,
 		logger:       Logger{
 			debug: NullLogger{},
 			error: func() ErrorLogger {
@@ -226,16 +611,38 @@ func (Config) ParseArguments() Config {
 	}
 }
 
+func (config Config) Targets() []RemoteTarget {
+	if len(config.targets) > 0 { return config.targets }
+	return []RemoteTarget{{host: config.remoteHost, dir: config.remoteDir}}
+}
+
+func (config Config) Mappings() []Mapping {
+	if len(config.mappings) > 0 { return config.mappings }
+	mapping, err := Mapping{}.New("", "")
+	PanicIf(err)
+	return []Mapping{mapping}
+}
+
 type RemoteManager struct {
 	RemoteClient
 	verbosity int // MAYBE: enum
 	localDir  string
+	prefix    string // of output messages
+	exclude   func(relative Filename, isDir bool) bool
+	retry     RetryPolicy
+	timeouts  SyncTimeouts
+	meter     *LinkMeter
+	trash     Trash
 }
-func (RemoteManager) New(config Config) RemoteManager {
+func (RemoteManager) New(config Config, client RemoteClient) RemoteManager {
 	return RemoteManager{
-		RemoteClient: sshClient{}.New(config),
+		RemoteClient: client,
 		verbosity:    config.verbosity,
 		localDir:     config.localDir,
+		retry:        config.retry,
+		timeouts:     config.timeouts,
+		meter:        &LinkMeter{},
+		trash:        config.trash,
 	}
 }
 func (manager RemoteManager) Update(updated []Updated) CancellableContext {
@@ -244,10 +651,15 @@ func (manager RemoteManager) Update(updated []Updated) CancellableContext {
 	cmdContext := manager.RemoteClient.Update(updated)
 	cmdResult := make(chan error, 1)
 	go func() {
-		cmdResult <- manager.sync(
+		size := uploadSize(manager.localDir, updated)
+		timeout := manager.timeouts.Upload(size)
+		start := time.Now()
+		err := manager.sync(
 			manager.message(updatedFilenames, "+", "uploading"),
-			cmdContext.Result,
+			func() error { return withTimeout("upload", timeout, cmdContext.Result, cmdContext.Cancel, false) },
 		)
+		if err == nil { manager.meter.Record(size, time.Since(start)) } // in-place ones are not measured: no size
+		cmdResult <- err
 		close(cmdResult) // TODO: check if it's closed on cancel
 	}()
 	return CancellableContext{
@@ -256,21 +668,79 @@ func (manager RemoteManager) Update(updated []Updated) CancellableContext {
 		ResultChan: cmdResult,
 	}
 }
-func (manager RemoteManager) InPlace(modifications []InPlaceModification) error {
+func (manager RemoteManager) InPlace(modifications []InPlaceModification) ([]InPlaceResult, error) {
+	// error means that nothing could be applied. Otherwise, each modification has its own outcome
 	movedFilenames := make([]Filename, 0, len(modifications))
 	for _, modification := range modifications {
 		movedFilenames = append(movedFilenames, modification.OldFilename())
 	}
 
-	return manager.sync(
+	remoteModifications := manager.trash.Deleting(modifications, time.Now())
+	err := manager.sync(
 		manager.message(movedFilenames, "^", "(re)moving"),
-		func() error { return manager.RemoteClient.InPlace(modifications) },
+		func() error {
+			command := manager.RemoteClient.InPlace(remoteModifications)
+			return withTimeout(
+				"in-place modifications",
+				manager.timeouts.InPlace(len(modifications)),
+				command.Result,
+				command.Cancel,
+				true, // before batch is rolled back and retried
+			)
+		},
 	)
+	var inPlaceError *InPlaceError
+	switch {
+		case err == nil:
+			return InPlaceResult{}.All(modifications, InPlaceApplied), nil
+		case errors.As(err, &inPlaceError):
+			results := inPlaceError.Results
+			for i := range results { results[i].Modification = modifications[i] } // not the ones moved into trash
+			return results, nil
+		default:
+			return nil, err
+	}
+}
+func (manager RemoteManager) Manifest(checksums bool) (Manifest, error) { // without trash, lock and unfinished uploads
+	manifest, err := manager.RemoteClient.Manifest(checksums)
+	for filename := range manifest {
+		if isTrashed(filename) || filename == RemoteLockFile || isUploading(filename) { delete(manifest, filename) }
+	}
+	return manifest, err
+}
+func (manager RemoteManager) PruneTrash() error {
+	remote, err := manager.RemoteClient.Manifest(false) // MAYBE: list only trash
+	if err != nil { return err }
+	expired := manager.trash.Expired(remote, time.Now())
+	if len(expired) == 0 { return nil }
+	_, err = manager.InPlace(expired) // not moved into trash again
+	return err
+}
+func (manager RemoteManager) Restore(path Path, stamp string) (string, error) { // from trash. Returns stamp
+	remote, err := manager.RemoteClient.Manifest(false)
+	if err != nil { return "", err }
+	versions := manager.trash.Versions(remote, path)
+	if len(versions) == 0 { return "", fmt.Errorf("%s is not found in trash", path.original.Real()) }
+	if stamp == "" { stamp = versions[len(versions) - 1] }
+	if i := sort.SearchStrings(versions, stamp); i == len(versions) || versions[i] != stamp {
+		return "", fmt.Errorf("%s is not found in trash of %s", path.original.Real(), stamp)
+	}
+
+	current := manager.trash.After(stamp, time.Now()) // current one is moved into trash, if it exists
+	results, err := manager.InPlace([]InPlaceModification{
+		Moved{from: path, to: manager.trash.Path(current, path)},
+		Moved{from: manager.trash.Path(stamp, path), to: path},
+	})
+	if err != nil { return "", err }
+	for _, result := range results {
+		if result.Outcome == InPlaceFailed { return "", result.Err }
+	}
+	return stamp, nil
 }
 func (manager RemoteManager) Ready() *Locker { // MAYBE: remove
 	return manager.RemoteClient.Ready()
 }
-func (manager RemoteManager) Fallback(queue *ModificationsQueue) { // MAYBE: legacy, remove
+func (manager RemoteManager) Fallback(queue *ModificationsQueue) error { // MAYBE: legacy, remove
 	var files []Filename
 
 	for _, inPlaceModification := range queue.inPlace {
@@ -282,16 +752,22 @@ func (manager RemoteManager) Fallback(queue *ModificationsQueue) { // MAYBE: leg
 		files = append(files, updated.path.original)
 	}
 
-	manager.fallbackFiles(files)
+	return manager.fallbackFiles(files)
 }
 func (manager RemoteManager) sync(message string, operation func() error) error {
-	if message == "" {
-		return operation()
-	} else {
-		return stopwatch(message, operation)
+	if message == "" { return operation() }
+	return stopwatch(message, operation)
+}
+func (manager RemoteManager) fallbackFiles(files []Filename) error {
+	for attempt := 1; ; attempt++ {
+		err := manager.fallbackOnce(files)
+		if err == nil { return nil }
+		class := classifyError(err)
+		if manager.retry.GivesUp(class, attempt) { return err }
+		time.Sleep(manager.retry.Delay(class, attempt))
 	}
 }
-func (manager RemoteManager) fallbackFiles(files []Filename) {
+func (manager RemoteManager) fallbackOnce(files []Filename) error {
 	verbosity := manager.verbosity
 	filesUnique := make(map[Filename]interface{})
 	for _, file := range files { filesUnique[file] = nil }
@@ -303,6 +779,10 @@ func (manager RemoteManager) fallbackFiles(files []Filename) {
 	updated := make([]Updated, 0)
 	deleted := make([]InPlaceModification, 0)
 	for file := range filesUnique {
+		if manager.exclude != nil {
+			info, err := os.Lstat(manager.localDir + string(os.PathSeparator) + file.Real())
+			if manager.exclude(file, err == nil && info.IsDir()) { continue }
+		}
 		if fileExists(Filename(manager.localDir + string(os.PathSeparator)) + file) {
 			updated = append(updated, Updated{Path{}.New(file)})
 		} else {
@@ -310,57 +790,54 @@ func (manager RemoteManager) fallbackFiles(files []Filename) {
 		}
 	}
 
-	result := true
+	var err error
 	if verbosity == 0 {
-		if len(updated) > 0 { result = result && (manager.RemoteClient.Update(updated).Result() == nil) }
-		if len(deleted) > 0 { result = result && (manager.RemoteClient.InPlace(deleted) == nil) }
+		if len(updated) > 0 { err = manager.RemoteClient.Update(updated).Result() }
+		if err == nil && len(deleted) > 0 { err = manager.RemoteClient.InPlace(deleted).Result() }
 	} else {
 		if len(updated) > 0 {
 			var uploadMessage string
 			if verbosity == 1 {
-				uploadMessage = fmt.Sprintf("+%d", len(updated))
+				uploadMessage = fmt.Sprintf("%s+%d", manager.prefix, len(updated))
 			} else {
-				uploadMessage = fmt.Sprintf("uploading %d file(s)", len(updated))
+				uploadMessage = fmt.Sprintf("%suploading %d file(s)", manager.prefix, len(updated))
 				if verbosity == 3 {
 					existingStr := make([]string, 0, len(updated))
 					for _, u := range updated { existingStr = append(existingStr, u.path.original.Real()) }
 					uploadMessage = fmt.Sprintf("%s: %s", uploadMessage, strings.Join(existingStr, " "))
 				}
 			}
-			result = stopwatch(
+			err = stopwatch(
 				uploadMessage,
 				func() error { return manager.RemoteClient.Update(updated).Result() },
-			) == nil
+			)
 		}
 
-		if result && len(deleted) > 0 {
+		if err == nil && len(deleted) > 0 {
 			var uploadMessage string
 			if verbosity == 1 {
-				uploadMessage = fmt.Sprintf("-%d", len(deleted))
+				uploadMessage = fmt.Sprintf("%s-%d", manager.prefix, len(deleted))
 			} else {
-				uploadMessage = fmt.Sprintf("deleting %d file(s)", len(deleted))
+				uploadMessage = fmt.Sprintf("%sdeleting %d file(s)", manager.prefix, len(deleted))
 				if verbosity == 3 {
 					deletedStr := make([]string, 0, len(deleted))
 					for _, d := range deleted { deletedStr = append(deletedStr, d.OldFilename().Real()) }
 					uploadMessage = fmt.Sprintf("%s: %s", uploadMessage, strings.Join(deletedStr, " "))
 				}
 			}
-			result = stopwatch(
+			err = stopwatch(
 				uploadMessage,
-				func() error { return manager.RemoteClient.InPlace(deleted) },
-			) == nil
+				func() error { return manager.RemoteClient.InPlace(deleted).Result() },
+			)
 		}
 	}
-
-	if !result {
-		manager.fallbackFiles(files)
-	}
+	return err
 }
 func (manager RemoteManager) message(filenames []Filename, sign string, action string) string {
 	if manager.verbosity == 0 { return "" }
-	if manager.verbosity == 1 { return fmt.Sprintf("%s%d", sign, len(filenames)) }
+	if manager.verbosity == 1 { return fmt.Sprintf("%s%s%d", manager.prefix, sign, len(filenames)) }
 
-	message := fmt.Sprintf("%s %d file", action, len(filenames))
+	message := fmt.Sprintf("%s%s %d file", manager.prefix, action, len(filenames))
 	if len(filenames) > 1 { message += "s" }
 	if manager.verbosity == 2 {
 		return message
@@ -421,16 +898,25 @@ func wrapApostrophe(text string) string {
 
 type SSHMirror struct {
 	io.Closer
-	root    string // TODO: Filename
-	watcher Watcher
-	remote  RemoteManager
-	logger  Logger
-	syncing *Locker // only for test
+	root        string // TODO: Filename
+	exclude     Excluder
+	verbosity   int
+	checksums   bool
+	deleteExtra bool
+	watcher     Watcher
+	targets     []*Target
+	logger      Logger
+	pending     []Modification // received during initial sync, and not yet synced
+	archive     *Archive       // nil, if journaling is disabled
+	control     string         // socket path. Empty disables
+	server      *ControlServer // nil, until `Listen`
+	listening   sync.Once
+	running     atomic.Bool    // targets receive modifications
 }
-func (SSHMirror) New(config Config) *SSHMirror {
+func (*SSHMirror) New(config Config) *SSHMirror {
 	logger := config.logger
-	var exclude *regexp.Regexp
-	if config.exclude != "" { exclude = regexp.MustCompile(config.exclude) }
+	exclude, errExclude := Exclusions{}.New(config.localDir, config.exclude, config.gitignore)
+	PanicIf(errExclude)
 
 	watcher := (func() Watcher {
 		switch config.watcher {
@@ -438,114 +924,397 @@ func (SSHMirror) New(config Config) *SSHMirror {
 				inotify, err := InotifyWatcher{}.New(config.localDir, exclude, logger)
 				PanicIf(err)
 				return inotify
+			case NativeInotifyWatcher{}.Name():
+				native, err := NativeInotifyWatcher{}.New(config.localDir, exclude, logger)
+				PanicIf(err)
+				return native
 			case FsnotifyWatcher{}.Name():
-				return FsnotifyWatcher{}.New(config.localDir, exclude)
+				return FsnotifyWatcher{}.New(config.localDir, exclude, logger)
+			case PollingWatcher{}.Name():
+				return PollingWatcher{}.New(config.localDir, exclude, config.pollInterval, logger)
 			default:
 				if inotify, err := (InotifyWatcher{}.New(config.localDir, exclude, logger)); err == nil {
 					return inotify
 				} else {
 					logger.Error(err.Error())
-					logger.Error(
-						"Warning! Current FS events provider: fsnotify. It has known problem of not tracking " +
-							"contents of subdirectories, created after program was started. It can only reliably " +
-							"track files in existing subdirectories",
-					)
-					return FsnotifyWatcher{}.New(config.localDir, exclude)
 				}
+				if native, err := (NativeInotifyWatcher{}.New(config.localDir, exclude, logger)); err == nil {
+					return native
+				} else {
+					logger.Error(err.Error())
+				}
+				logger.Error("Current FS events provider: fsnotify")
+				return FsnotifyWatcher{}.New(config.localDir, exclude, logger)
 		}
 	})()
 
+	var archive *Archive // of journal
+	if config.journal != "" && !config.dryRun { // journaled modifications of real runs are not "synced" by dry ones
+		if opened, err := (Archive{}.Open(config.journal)); err == nil {
+			archive = &opened
+		} else {
+			logger.Error("journal is disabled: " + err.Error())
+		}
+	}
+
+	remoteTargets := config.Targets()
+	mappings := config.Mappings()
+	nrTargets := len(remoteTargets) * len(mappings)
+	targets := make([]*Target, 0, nrTargets)
+	for _, remoteTarget := range remoteTargets {
+		var master SharedRemoteClient // shared between mappings
+		for _, mapping := range mappings {
+			targetConfig := config
+			targetConfig.localDir = mapping.LocalDir(config.localDir)
+			targetConfig.remoteHost = remoteTarget.host
+			targetConfig.remoteDir = mapping.RemoteDir(remoteTarget.dir)
+			targetConfig.excluder = MappedExcluder{exclude: exclude, mapping: mapping}
+			name := RemoteTarget{host: targetConfig.remoteHost, dir: targetConfig.remoteDir}.String()
+			prefix := ""
+			if nrTargets > 1 {
+				prefix = name + ": "
+				targetConfig.logger = Logger{
+					debug: logger.debug,
+					error: PrefixedErrorLogger{prefix: prefix, logger: logger.error},
+				}
+			}
+			var remoteClient RemoteClient
+			if master == nil {
+				var err error
+				master, err = newRemoteClient(targetConfig)
+				PanicIf(err)
+				remoteClient = master
+			} else {
+				remoteClient = master.Share(targetConfig)
+			}
+			if config.dryRun { remoteClient = DryRunClient{}.New(remoteClient, prefix) }
+			remote := RemoteManager{}.New(targetConfig, remoteClient)
+			remote.prefix = prefix
+			remote.exclude = func(excluder Excluder) func(Filename, bool) bool {
+				return func(relative Filename, isDir bool) bool {
+					return isExcluded(excluder, Path{}.New(relative), isDir)
+				}
+			}(targetConfig.excluder)
+			target := (&Target{}).New(name, prefix, remote, targetConfig.logger)
+			target.root = targetConfig.localDir
+			target.windows = config.windows
+			target.guard = config.guard
+			target.mapping = mapping
+			if archive != nil { target.journal = (&Journal{}).New(*archive, targetConfig.localDir, name) }
+			targets = append(targets, target)
+		}
+	}
+
 	return &SSHMirror{
-		root:    config.localDir,
-		watcher: watcher,
-		remote:  RemoteManager{}.New(config),
-		logger:  logger,
-		syncing: &Locker{},
+		root:        config.localDir,
+		exclude:     exclude,
+		verbosity:   config.verbosity,
+		checksums:   config.checksums,
+		deleteExtra: config.deleteExtra,
+		watcher:     watcher,
+		targets:     targets,
+		logger:      logger,
+		archive:     archive,
+		control:     config.control,
 	}
 }
 func (client *SSHMirror) Close() error {
-	err1 := client.watcher.Close()
-	err2 := client.remote.Close()
-
-	if err1 != nil { return err1 }
-	if err2 != nil { return err2 }
+	err := client.watcher.Close()
+	if errServer := client.server.Close(); err == nil { err = errServer }
+	for _, target := range client.targets {
+		if errTarget := target.remote.Close(); err == nil { err = errTarget }
+	}
+	return err
+}
+func (client *SSHMirror) Status() []TargetStatus {
+	statuses := make([]TargetStatus, 0, len(client.targets))
+	for _, target := range client.targets { statuses = append(statuses, target.Status()) }
+	return statuses
+}
+func (client *SSHMirror) Lock() error { // remote directories of all targets
+	for _, target := range client.targets {
+		onLost := func(err error) { // other one writes there now
+			target.logger.Error(err.Error() + ". Pausing until resumed")
+			target.Pause()
+		}
+		if err := target.remote.Lock(onLost); err != nil { return err }
+	}
+	return nil
+}
+func (client *SSHMirror) RetryParked() {
+	for _, target := range client.targets { target.RetryParked() }
+}
+func (client *SSHMirror) Pause() {
+	for _, target := range client.targets { target.Pause() }
+}
+func (client *SSHMirror) Resume() {
+	for _, target := range client.targets { target.Resume() }
+}
+func (client *SSHMirror) Flush() {
+	for _, target := range client.targets { target.Flush() }
+}
+func (client *SSHMirror) Resync(path Path) (int, error) { // number of resynced files
+	info, err := os.Lstat(filepath.Join(client.root, path.original.Real()))
+	if isExcluded(client.exclude, path, err == nil && info.IsDir()) { return 0, errors.New("excluded: " + path.original.Real()) }
+	var modifications []Modification
+	switch {
+		case os.IsNotExist(err): modifications = []Modification{Deleted{path}}
+		case err != nil:         return 0, err
+		case info.IsDir():       modifications = client.rescan(path)
+		default:                 modifications = []Modification{Updated{path}}
+	}
+	for _, target := range client.targets {
+		for _, modification := range modifications { target.Resync(modification) }
+		target.Flush()
+	}
+	return len(modifications), nil
+}
+func (client *SSHMirror) Drain(timeout time.Duration) bool { // false, if not everything was synced in time
+	var draining sync.WaitGroup
+	for _, target := range client.targets {
+		draining.Add(1)
+		go func(target *Target) {
+			defer draining.Done()
+			target.Drain()
+		}(target)
+	}
+	drained := make(chan struct{})
+	go func() {
+		draining.Wait()
+		close(drained)
+	}()
+	select {
+		case <-drained:             return true
+		case <-time.After(timeout): return false // f.e. target is held, or failing
+	}
+}
+func (client *SSHMirror) Restore(path Path, stamp string) error {
+	nrFailed := 0
+	for _, target := range client.targets {
+		target.remote.Ready().Wait()
+		for _, routed := range target.mapping.Route(Updated{path}) {
+			restored, err := target.remote.Restore(routed.(Updated).path, stamp)
+			if err != nil {
+				if len(client.targets) == 1 { return err }
+				target.logger.Error(err.Error())
+				nrFailed++
+				continue
+			}
+			if client.verbosity > 0 { fmt.Printf("%srestored %s (deleted at %s)\n", target.prefix, path.original.Real(), restored) }
+		}
+	}
+	if nrFailed > 0 { return fmt.Errorf("restoring failed for %d of %d targets", nrFailed, len(client.targets)) }
 	return nil
 }
+func (client *SSHMirror) Confirm(proceed bool) int { // number of targets, which were waiting for confirmation
+	nrConfirmed := 0
+	for _, target := range client.targets {
+		if target.Confirm(proceed) { nrConfirmed++ }
+	}
+	return nrConfirmed
+}
 func (client *SSHMirror) Init(batchSize FileSize) error {
-	// MAYBE: progress indicator
-
-	synced := DummyFS{}
-
-	modified := func(Path) {} // MAYBE: use `SwitchChannelPaths`
+	var synced DummyFS
+	var upToDate map[Filename]bool // according to remote manifest
+	var batch *DummyFS
+	var current *Target
+	var mx sync.Mutex // accessing `current`, `synced`, `upToDate`, `batch` or `pending`
 
+	stopListening := make(chan struct{})
+	listening := make(chan struct{})
 	go func() {
-		for modification := range client.watcher.Modifications() {
-			// PRIORITY: handle directories
-			// MAYBE: something smarter
-			for _, path := range modification.AffectedPaths() {
-				modified(path)
-				synced.Delete(path)
+		defer close(listening)
+		for {
+			select {
+				case modification, ok := <-client.watcher.Modifications():
+					if !ok { return }
+					client.logger.Debug("modification received during initial sync", modification)
+					mx.Lock()
+					var routed []Modification
+					if current != nil { routed = current.mapping.Route(modification) }
+					for _, _routed := range routed {
+						for _, path := range _routed.AffectedPaths() { // MAYBE: something smarter
+							if path.original == "." { path = Path{}.New("") } // whole mapping directory
+							synced.Delete(path)
+							if batch != nil { batch.Delete(path) }
+							for filename := range upToDate {
+								if path.IsParentOf(Path{}.New(filename)) { delete(upToDate, filename) }
+							}
+						}
+					}
+					client.pending = append(client.pending, modification)
+					mx.Unlock()
+				case <-stopListening:
+					return
 			}
 		}
-		panic("modifications channel closed") // THINK: some exit point
+	}()
+	defer func() {
+		close(stopListening)
+		<-listening
 	}()
 
-	upload := func(batch DummyFS) {
-		modified = func(path Path) { batch.Delete(path) }
-		defer func() { modified = func(Path) {} }()
+	initTarget := func(target *Target) error {
+		target.remote.Ready().Wait()
+		mx.Lock()
+		current = target
+		synced = DummyFS{}
+		upToDate = make(map[Filename]bool)
+		mx.Unlock()
 
-		updated := make([]Updated, 0, len(batch.files))
-		for _, filePath := range batch.files { updated = append(updated, Updated{filePath}) }
+		var nrUploaded int
+		var sizeUploaded FileSize
+		start := time.Now()
+		client.progress(target.prefix + "initial sync: comparing with remote files")
 
-		if err := client.remote.Update(updated).Result(); err == nil {
-			for _, filePath := range batch.files { synced.AddFile(filePath.original) }
+		onError := func(err error) { target.logger.Error(err.Error()) }
+		isExcluded := func(relative string, isDir bool) bool {
+			return client.isExcluded(target.mapping, relative, isDir)
+		}
+		localManifest, errLocal := Manifest{}.Local(target.root, isExcluded, client.checksums, onError)
+		if errLocal != nil { return errLocal }
+		remoteManifest, errRemote := target.remote.Manifest(client.checksums)
+		if errRemote != nil {
+			target.logger.Error(errRemote.Error())
+			target.logger.Error("could not get list of remote files. Uploading all local files")
+			remoteManifest = Manifest{}
 		} else {
-			client.logger.Error(err.Error())
+			target.listed = remoteManifest
 		}
-	}
+		outdated, extraneous := localManifest.Diff(remoteManifest)
+		mx.Lock()
+		for filename := range localManifest { upToDate[filename] = true }
+		for _, filename := range outdated { delete(upToDate, filename) }
+		mx.Unlock()
+		client.progress(target.prefix + fmt.Sprintf(
+			"initial sync: %d of %d file(s) are up to date",
+			len(localManifest) - len(outdated),
+			len(localManifest),
+		))
 
-	for {
-		batch := DummyFS{}
-		var curBatchSize FileSize
-		errBatch := filepath.Walk( // MAYBE: optimize. Do not walk over `synced`
-			client.root,
-			func(path string, info fs.FileInfo, err error) error {
-				if err != nil {
-					client.logger.Error(err.Error())
-					return nil
-				}
-				if info.IsDir() { return nil }
-				filename := Filename(path)
-				if synced.Has(Path{}.New(filename)) { return nil } // MAYBE: optimize
-				batch.AddFile(filename)
-				curBatchSize = curBatchSize.Add(FileSize{bytes: uint64(info.Size())})
-				if curBatchSize.IsLess(batchSize) {
-					return nil
-				} else {
-					return io.EOF
-				}
-			},
-		)
-		switch errBatch {
-			case io.EOF:
-				upload(batch)
-			case nil:
-				if batch.IsEmpty() {
-					return nil
-				} else {
-					upload(batch)
+		if client.deleteExtra {
+			deleted := make([]InPlaceModification, 0, len(extraneous))
+			for _, filename := range extraneous {
+				if isExcluded(filename.Real(), false) { continue }
+				deleted = append(deleted, Deleted{Path{}.New(filename)})
+			}
+			if deleted = target.guarded(deleted); len(deleted) > 0 { // wrong SOURCE would wipe DESTINATION
+				results, err := target.remote.InPlace(deleted)
+				if err != nil { target.logger.Error(err.Error()) }
+				for _, result := range results {
+					if result.Outcome == InPlaceFailed { target.logger.Error(result.Err.Error()) }
 				}
-			default:
-				return errBatch
+			}
+		}
+
+		upload := func(files []Filename, size FileSize) {
+			mx.Lock()
+			batch = &DummyFS{}
+			for _, file := range files { batch.AddFile(file) }
+			mx.Unlock()
+
+			updated := make([]Updated, 0, len(files))
+			for _, file := range files { updated = append(updated, Updated{Path{}.New(file)}) }
+
+			err := target.remote.Update(updated).Result()
+
+			mx.Lock()
+			if err == nil {
+				for _, filePath := range batch.files { synced.AddFile(filePath.original) } // modified ones were excluded
+				nrUploaded += len(files)
+				sizeUploaded = sizeUploaded.Add(size)
+			} else {
+				target.logger.Error(err.Error())
+			}
+			batch = nil
+			mx.Unlock()
+
+			client.progress(target.prefix + fmt.Sprintf(
+				"initial sync: %d file(s), %s uploaded",
+				nrUploaded,
+				sizeUploaded,
+			))
 		}
+
+		for {
+			var files []Filename
+			var curBatchSize FileSize
+			errBatch := filepath.Walk( // MAYBE: optimize. Do not walk over `synced`
+				target.root,
+				func(path string, info fs.FileInfo, err error) error {
+					if err != nil {
+						target.logger.Error(err.Error())
+						return nil
+					}
+					relative, errRelative := filepath.Rel(target.root, path)
+					if errRelative != nil { return errRelative }
+					if relative == "." { return nil }
+					if isExcluded(relative, info.IsDir()) {
+						if info.IsDir() { return filepath.SkipDir }
+						return nil
+					}
+					if info.IsDir() { return nil }
+					if !info.Mode().IsRegular() && info.Mode() & os.ModeSymlink == 0 { return nil } // pipes, devices etc.
+					filename := Filename(relative)
+					mx.Lock()
+					isSynced := upToDate[filename] || synced.Has(Path{}.New(filename)) // MAYBE: optimize
+					mx.Unlock()
+					if isSynced { return nil }
+					files = append(files, filename)
+					curBatchSize = curBatchSize.Add(FileSize{bytes: uint64(info.Size())})
+					if curBatchSize.IsLess(batchSize) {
+						return nil
+					} else {
+						return io.EOF
+					}
+				},
+			)
+			switch errBatch {
+				case io.EOF:
+					upload(files, curBatchSize)
+				case nil:
+					if len(files) == 0 {
+						client.progress(target.prefix + fmt.Sprintf(
+							"initial sync done: %d file(s), %s uploaded in %s",
+							nrUploaded,
+							sizeUploaded,
+							time.Since(start).String(),
+						))
+						return nil
+					} else {
+						upload(files, curBatchSize)
+					}
+				default:
+					return errBatch
+			}
+		}
+	}
+
+	nrFailed := 0
+	for _, target := range client.targets {
+		if err := initTarget(target); err != nil {
+			if len(client.targets) == 1 { return err }
+			target.logger.Error(err.Error())
+			nrFailed++
+		}
+	}
+	if nrFailed > 0 { return fmt.Errorf("initial sync failed for %d of %d targets", nrFailed, len(client.targets)) }
+	return nil
+}
+func (client *SSHMirror) SyncPending() { // modifications, received during `Init`
+	var syncing sync.WaitGroup
+	for _, target := range client.targets {
+		syncing.Add(1)
+		go func(target *Target) {
+			defer syncing.Done()
+			target.Sync(client.pending)
+		}(target)
 	}
+	syncing.Wait()
+	client.pending = nil
 }
 func (client *SSHMirror) Run() {
-	queue := TransactionalQueue{}.New()
-	var syncing sync.Mutex
-	var cancelFirst *context.CancelFunc
-	var cancelLast *context.CancelFunc
-	modifiedPaths := SwitchChannelPaths{}.New()
+	const ReservoirSize = 1 << 10
 
 	exit := make(chan os.Signal)
 	signal.Notify(exit, os.Interrupt, syscall.SIGTERM)
@@ -554,130 +1323,217 @@ func (client *SSHMirror) Run() {
 		Must(client.Close())
 		os.Exit(0)
 	}()
+	if len(retrySignals) > 0 {
+		retry := make(chan os.Signal, 1)
+		signal.Notify(retry, retrySignals...)
+		go func() {
+			for range retry { client.RetryParked() }
+		}()
+	}
 
-	client.remote.Ready().Wait()
-	client.logger.Debug("remote client initialized")
-
-	doSync := func() {
-		client.logger.Debug("doSync")
-		syncing.Lock()
-		defer syncing.Unlock()
-
-		client.logger.Debug("waiting for remote client")
-		client.remote.Ready().Wait()
-		client.logger.Debug("remote client ready")
+	client.Listen()
+	client.running.Store(true)
 
-		if cancelFirst != nil {
-			(*cancelFirst)()
-			cancelFirst = nil
-		}
-		if cancelLast != nil {
-			(*cancelLast)()
-			cancelLast = nil
-		}
+	pending := client.pending
+	client.pending = nil
 
-		if queue.IsEmpty() { // during upload, multiple syncs were produces, first sync synchronized everything
-			client.logger.Debug("queue empty")
-			client.syncing.Unlock() // for "empty" move - when file was moved outside and then into same location
-			return
+	modifications := client.withRescans(client.watcher.Modifications())
+	var channels []<-chan Modification
+	if len(client.targets) == 1 {
+		channels = []<-chan Modification{modifications}
+	} else {
+		for _, channel := range Multiply(modifications, len(client.targets)) {
+			// slow target does not block others
+			channels = append(channels, Reservoir(channel, ReservoirSize, client.archive))
 		}
-
-		client.sync(queue, modifiedPaths)
-
-		client.logger.Debug("queue after sync", queue)
-
-		if queue.IsEmpty() { client.syncing.Unlock() }
 	}
 
-	modificationReceived := func(modification Modification) {
-		client.logger.Debug("modification received", modification)
-		client.syncing.Lock()
-		queue.AtomicAdd(modification)
-		if cancelFirst == nil { cancelFirst = cancellableTimer(5 * time.Second, doSync) }
-		if cancelLast != nil { (*cancelLast)() }
-		cancelLast = cancellableTimer(500 * time.Millisecond, doSync)
-		for _, filename := range modification.AffectedPaths() { modifiedPaths.Put(filename) }
+	var running sync.WaitGroup
+	for i, target := range client.targets {
+		running.Add(1)
+		go func(target *Target, modifications <-chan Modification) {
+			defer running.Done()
+			target.Run(modifications, pending)
+		}(target, channels[i])
 	}
-
-	//select {
-	//	case modification, ok := <-client.watcher.Modifications():
-	//		if !ok { panic("modifications channel closed") }
-	//		modificationReceived(modification)
-	//	default:
-	//		client.onReady()
-	//}
-
-	for {
-		select {
-			case modification, ok := <-client.watcher.Modifications():
-				if !ok { return } // TODO: make sure previous (running) modifications are uploaded
-				modificationReceived(modification)
+	running.Wait()
+}
+func (client *SSHMirror) Listen() { // to control socket and terminal. Before anything can wait for confirmation
+	client.listening.Do(func() {
+		if client.control != "" {
+			if server, err := (ControlServer{}.Listen(client.control, client.handleControl, client.logger)); err == nil {
+				client.server = server
+				go server.Serve()
+			} else {
+				client.logger.Error("control socket is disabled: " + err.Error())
+			}
+		}
+		terminal := false
+		if info, err := os.Stdin.Stat(); err == nil && info.Mode() & os.ModeCharDevice != 0 {
+			terminal = true
+			go client.readConfirmations(os.Stdin)
+		}
+		if client.server == nil && !terminal {
+			for _, target := range client.targets { target.unattended = true }
+		}
+	})
+}
+func (client *SSHMirror) readConfirmations(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		var proceed bool
+		switch strings.ToLower(strings.TrimSpace(scanner.Text())) {
+			case ConfirmYes, "y": proceed = true
+			case ConfirmNo, "n":  proceed = false
+			default:              continue
 		}
+		if client.Confirm(proceed) == 0 { fmt.Println("nothing is waiting for confirmation") }
 	}
 }
-func (client *SSHMirror) sync(queue *TransactionalQueue, modifiedPaths *SwitchChannelPaths) { // THINK: limit of tries
-	client.logger.Debug("sync")
-
-	for {
-		client.logger.Debug("sync cycle")
-		client.logger.Debug("queue", queue)
-
-		queue.Begin()
-		if inPlace := queue.GetInPlace(true); len(inPlace) > 0 {
-			client.logger.Debug("inPlace", inPlace)
-			if err := client.remote.InPlace(inPlace); err == nil {
-				client.logger.Debug("success")
-				queue.Commit()
-			} else {
-				client.logger.Debug("fail")
-				client.logger.Error(err.Error())
-				queue.Rollback()
+func (client *SSHMirror) handleControl(command string, argument string, out io.Writer) error {
+	respond := func(message string) { _, _ = fmt.Fprintln(out, message) }
+	switch command {
+		case ControlStatus:
+			for _, target := range client.targets {
+				status := target.Status()
+				respond(status.String())
+				if status.lastError != nil && status.state != TargetFailing { respond("  last error: " + status.lastError.Error()) }
+				respond("  queue: " + jsonSerialize(target.queue.Serialize()))
 			}
-
-			continue // MAYBE: do not always sync all `InPlace` first; instead, prioritize them with `Updated`
-		}
-		queue.Commit()
-
-		queue.Begin()
-		if updated := queue.GetUpdated(true); len(updated) > 0 {
-			client.logger.Debug("updated", updated)
-			command := client.remote.Update(updated)
-			modifiedPaths.On()
-
-			uploading: for {
-				select {
-					case modifiedPath, ok := <-modifiedPaths.Get():
-						if !ok { panic("modifiedPaths channel closed") }
-						for _, _updated := range updated { // MAYBE: map
-							if modifiedPath.Relates(_updated.path) {
-								client.logger.Debug("cancelling upload. Modified path", modifiedPath)
-								command.Cancel()
-								queue.Rollback()
-								break uploading
-							}
-						}
-					case result := <-command.ResultChan:
-						if result == nil {
-							client.logger.Debug("success")
-							queue.Commit()
-						} else {
-							client.logger.Debug("fail")
-							client.logger.Error(result.Error())
-							queue.Rollback()
-						}
-						break uploading
-				}
+		case ControlPause:
+			client.Pause()
+			respond("paused")
+		case ControlResume:
+			client.Resume()
+			respond("resumed")
+		case ControlFlush:
+			client.Flush()
+			respond("flushing")
+		case ControlResync:
+			if argument == "" { return errors.New("path is required") }
+			relative := filepath.Clean(argument)
+			if filepath.IsAbs(relative) || relative == ".." || strings.HasPrefix(relative, ".." + string(os.PathSeparator)) {
+				return errors.New("path must be relative to SOURCE, and inside of it")
 			}
-			modifiedPaths.Off()
-
-			continue
-		}
-		queue.Commit()
-
-		break
+			if !client.running.Load() { return errors.New("initial sync is not finished yet") }
+			nrFiles, err := client.Resync(Path{}.New(Filename(relative)))
+			if err != nil { return err }
+			respond(fmt.Sprintf("resyncing %d files", nrFiles))
+		case ControlConfirm:
+			var proceed bool
+			switch strings.ToLower(argument) {
+				case ConfirmYes: proceed = true
+				case ConfirmNo:  proceed = false
+				default:         return errors.New("expected \"" + ConfirmYes + "\" or \"" + ConfirmNo + "\"")
+			}
+			if client.Confirm(proceed) == 0 { return errors.New("nothing is waiting for confirmation") }
+			respond("confirmed")
+		case ControlStop:
+			respond("syncing queued modifications...")
+			if !client.Drain(ControlStopTimeout) {
+				respond(fmt.Sprintf("not synced in %s. Stopping anyway:", ControlStopTimeout))
+				for _, status := range client.Status() { respond("  " + status.String()) }
+			}
+			respond("stopped")
+			Must(client.Close())
+			os.Exit(0)
+		default:
+			return errors.New("unknown command: " + command)
 	}
+	return nil
+}
+func (client *SSHMirror) withRescans(modifications <-chan Modification) <-chan Modification {
+	// when ignore file is modified, files under its directory can become not excluded
+	// MAYBE: upload only files, which were excluded before
+	out := make(chan Modification)
+	go func() {
+		defer close(out)
+		for modification := range modifications {
+			out <- modification
+			for _, path := range modification.AffectedPaths() {
+				if client.exclude == nil || !client.exclude.Reload(path) { continue }
+				for _, updated := range client.rescan(path.Parent()) { out <- updated }
+			}
+		}
+	}()
+	return out
+}
+func (client *SSHMirror) rescan(dir Path) []Modification { // all not excluded files
+	var updated []Modification
+	err := filepath.Walk(
+		filepath.Join(client.root, dir.original.Real()),
+		func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				if !os.IsNotExist(err) { client.logger.Error(err.Error()) }
+				return nil
+			}
+			relative, errRelative := filepath.Rel(client.root, path)
+			if errRelative != nil { return errRelative }
+			if relative == "." { return nil }
+			if isExcluded(client.exclude, Path{}.New(Filename(relative)), info.IsDir()) {
+				if info.IsDir() { return filepath.SkipDir }
+				return nil
+			}
+			if info.Mode().IsRegular() || info.Mode() & os.ModeSymlink != 0 {
+				updated = append(updated, Updated{Path{}.New(Filename(relative))})
+			}
+			return nil
+		},
+	)
+	if err != nil { client.logger.Error(err.Error()) }
+	return updated
+}
+func (client *SSHMirror) isExcluded(mapping Mapping, relative string, isDir bool) bool { // relative to mapping
+	if !mapping.IsRoot() { relative = mapping.local.original.Real() + string(os.PathSeparator) + relative }
+	return isExcluded(client.exclude, Path{}.New(Filename(relative)), isDir)
+}
+func (client *SSHMirror) progress(message string) {
+	if client.verbosity >= 2 { fmt.Println(message) }
 }
 
 func main() {
-	SSHMirror{}.New(Config{}.ParseArguments()).Run()
+	if len(os.Args) > 1 && os.Args[1] == CommandAgent { // on remote host
+		if err := RunAgent(os.Stdin, os.Stdout); err != nil {
+			WriteToStderr(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == CommandCtl { // to running sshmirror
+		if err := RunCtl(os.Args[2:], os.Stdout); err != nil {
+			WriteToStderr(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	config := Config{}.ParseArguments()
+	client := (&SSHMirror{}).New(config)
+	if err := client.Lock(); err != nil {
+		client.logger.Error(err.Error())
+		Must(client.Close())
+		os.Exit(1)
+	}
+	client.Listen()
+	if config.command == CommandRestore {
+		err := client.Restore(Path{}.New(Filename(filepath.Clean(config.restorePath))), config.restoreStamp)
+		Must(client.Close())
+		if err != nil {
+			client.logger.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if config.init || config.command == CommandInit {
+		if err := client.Init(config.batchSize); err != nil {
+			client.logger.Error(err.Error())
+			Must(client.Close())
+			os.Exit(1)
+		}
+	}
+	if config.command == CommandInit {
+		client.SyncPending()
+		Must(client.Close())
+		return
+	}
+	client.Run()
 }
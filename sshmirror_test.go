@@ -795,27 +795,37 @@ func TestIntegration(t *testing.T) {
 	sandbox := fmt.Sprintf("%s/sandbox", currentDir)
 	testConfig := TestConfig{}.New(fmt.Sprintf("%s/test-config.json", currentDir))
 
+	local := testConfig.RemoteAddress == LocalScheme // RemotePath is a local directory. No sshd needed
+	remoteHost := testConfig.RemoteAddress
+	if local { remoteHost = "" }
+
 	controlPathFile, err := ioutil.TempFile("", "sshmirror-test-")
 	PanicIf(err)
 	controlPath := controlPathFile.Name()
 	Must(os.Remove(controlPath))
-	defer func() { Must(os.Remove(controlPath)) }()
 	sshCmd := fmt.Sprintf("ssh -t -o ControlPath=%s -i %s", controlPath, testConfig.IdentityFile)
-	var masterConnectionReady sync.WaitGroup
-	masterConnectionReady.Add(1)
-	go func() {
-		my.RunCommand(
-			currentDir,
-			fmt.Sprintf("%s -M %s -t 'echo done && sleep 420'", sshCmd, testConfig.RemoteAddress),
-			func(string) { masterConnectionReady.Done() },
-			nil,
-		)
-		panic("master connection dead")
-	}()
-	masterConnectionReady.Wait()
+	if !local {
+		defer func() { Must(os.Remove(controlPath)) }()
+		var masterConnectionReady sync.WaitGroup
+		masterConnectionReady.Add(1)
+		go func() {
+			my.RunCommand(
+				currentDir,
+				fmt.Sprintf("%s -M %s -t 'echo done && sleep 420'", sshCmd, testConfig.RemoteAddress),
+				func(string) { masterConnectionReady.Done() },
+				nil,
+			)
+			panic("master connection dead")
+		}()
+		masterConnectionReady.Wait()
+	}
 
 	executeRemote := func(remotePath string, cmd string) []string {
 		result := make([]string, 0)
+		if local {
+			my.RunCommand(remotePath, cmd, func(out string) { result = append(result, out) }, nil)
+			return result
+		}
 		my.RunCommand(
 			"",
 			fmt.Sprintf(
@@ -919,13 +929,18 @@ func TestIntegration(t *testing.T) {
 			var syncing *Locker // MAYBE: only for non-IntegrationTest
 			SUTsDone.Add(1)
 			if testConfig.IntegrationTest {
+				destination := []string{testConfig.RemoteAddress, remoteTarget}
+				if local { destination = []string{LocalScheme + remoteTarget} }
 				command := exec.Command(
 					"./sshmirror",
-					"-i="+testConfig.IdentityFile,
-					"-v=0",
-					localTarget,
-					testConfig.RemoteAddress,
-					remoteTarget,
+					append(
+						[]string{
+							"-i="+testConfig.IdentityFile,
+							"-v=0",
+							localTarget,
+						},
+						destination...,
+					)...,
 				)
 				command.Dir = currentDir
 				defer func() {
@@ -934,21 +949,21 @@ func TestIntegration(t *testing.T) {
 				}()
 				Must(command.Start())
 			} else {
-				client := SSHMirror{}.New(Config{
+				client := (&SSHMirror{}).New(Config{
 					localDir:     localTarget,
-					remoteHost:   testConfig.RemoteAddress,
+					remoteHost:   remoteHost,
 					remoteDir:    remoteTarget,
 					identityFile: testConfig.IdentityFile,
 					connTimeout:  testConfig.TimeoutSeconds,
 					logger:       *logger,
 				})
-				syncing = client.syncing
+				syncing = client.targets[0].syncing
 				go client.Run()
 				defer func() {
 					Must(client.Close())
 					SUTsDone.Done()
 				}()
-				client.remote.Ready().Wait()
+				client.targets[0].remote.Ready().Wait()
 			}
 
 			awaitSync := func() {
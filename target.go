@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TargetState uint8
+const (
+	TargetConnecting TargetState = iota
+	TargetIdle
+	TargetSyncing
+	TargetFailing
+	TargetHeld // waiting for confirmation of guarded modifications
+)
+func (state TargetState) String() string {
+	switch state {
+		case TargetConnecting: return "connecting"
+		case TargetIdle:       return "idle"
+		case TargetSyncing:    return "syncing"
+		case TargetFailing:    return "failing"
+		case TargetHeld:       return "waiting for confirmation"
+		default:               panic("unknown target state")
+	}
+}
+
+type TargetStatus struct {
+	name      string
+	state     TargetState
+	lastError error
+	lastSync  time.Time // last successful sync operation
+	parked    int       // number of modifications, given up after too many failed attempts
+	held      string    // why confirmation is needed
+	paused    bool      // modifications are queued, but not synced
+}
+func (status TargetStatus) String() string {
+	str := fmt.Sprintf("%s: %s", status.name, status.state)
+	if !status.lastSync.IsZero() { str += ", last synced at " + status.lastSync.Format(time.TimeOnly) }
+	if status.parked > 0 { str += fmt.Sprintf(", %d parked", status.parked) }
+	if status.state == TargetFailing && status.lastError != nil { str += ": " + status.lastError.Error() }
+	if status.state == TargetHeld { str += ": " + status.held }
+	if status.paused { str += " (paused)" }
+	return str
+}
+
+type Target struct { // one of remote destinations, which are mirrored independently of each other
+	name    string // "HOST:DESTINATION"
+	prefix  string // of output messages. Empty, if there is only one target
+	root    string // local directory
+	mapping Mapping
+	windows BatchWindows
+	guard   DeletionGuard
+	listed  Manifest // remote, as listed last time and updated by synced batches. Deletions of files in it are counted without listing again
+	remote  RemoteManager
+	queue   *TransactionalQueue
+	journal *Journal // nil, if disabled
+	logger  Logger
+	status  TargetStatus
+	mx      sync.Mutex // accessing `status` or `parked`
+	syncing *Locker    // until queue is empty
+
+	parked   *ModificationsQueue // failed too many times. Retried after next successful sync, or on demand
+	attempts int                 // failed in a row
+	wake     chan struct{}       // interrupts waiting before next attempt
+	syncMx   sync.Mutex          // one sync at a time
+	confirm  chan bool           // answer on guarded modifications
+	injected chan Modification   // besides watched ones. Routed already
+	flush    chan struct{}       // sync without waiting for batch windows
+
+	unattended bool // nothing can confirm. Guarded modifications are skipped
+}
+func (*Target) New(name string, prefix string, remote RemoteManager, logger Logger) *Target {
+	return &Target{
+		name:     name,
+		prefix:   prefix,
+		windows:  DefaultBatchWindows,
+		remote:   remote,
+		queue:    TransactionalQueue{}.New(),
+		logger:   logger,
+		status:   TargetStatus{name: name, state: TargetConnecting},
+		syncing:  &Locker{},
+		parked:   ModificationsQueue{}.New(),
+		wake:     make(chan struct{}),
+		confirm:  make(chan bool),
+		injected: make(chan Modification),
+		flush:    make(chan struct{}, 1),
+	}
+}
+func (target *Target) Status() TargetStatus {
+	target.mx.Lock()
+	defer target.mx.Unlock()
+	status := target.status
+	status.parked = len(target.parked.GetInPlace(false)) + len(target.parked.GetUpdated(false))
+	return status
+}
+func (target *Target) Run(modifications <-chan Modification, pending []Modification) {
+	var cancelFirst *context.CancelFunc
+	var cancelLast *context.CancelFunc
+	var timersMx sync.Mutex // for `cancelFirst` and `cancelLast`, which are also reset by timers
+	modifiedPaths := (&SwitchChannelPaths{}).New()
+	queue := target.queue
+
+	target.remote.Ready().Wait()
+	target.logger.Debug("remote client initialized")
+	target.setStatus(TargetIdle, nil)
+
+	var pruning <-chan time.Time // never, if trash is disabled
+	if target.remote.trash.enabled {
+		ticker := time.NewTicker(TrashPruneInterval)
+		defer ticker.Stop()
+		pruning = ticker.C
+		go target.pruneTrash()
+	}
+
+	doSync := func() {
+		target.logger.Debug("doSync")
+		target.syncMx.Lock()
+		defer target.syncMx.Unlock()
+
+		target.logger.Debug("waiting for remote client")
+		target.remote.Ready().Wait()
+		target.logger.Debug("remote client ready")
+
+		timersMx.Lock()
+		if cancelFirst != nil {
+			(*cancelFirst)()
+			cancelFirst = nil
+		}
+		if cancelLast != nil {
+			(*cancelLast)()
+			cancelLast = nil
+		}
+		timersMx.Unlock()
+
+		if queue.IsEmpty() { // during upload, multiple syncs were produces, first sync synchronized everything
+			target.logger.Debug("queue empty")
+			target.syncing.Unlock() // for "empty" move - when file was moved outside and then into same location
+			return
+		}
+
+		target.sync(modifiedPaths)
+
+		target.logger.Debug("queue after sync", queue)
+
+		if queue.IsEmpty() { target.syncing.Unlock() }
+	}
+
+	modificationReceived := func(modification Modification) {
+		target.logger.Debug("modification received", modification)
+		target.syncing.Lock()
+		queue.AtomicAdd(modification)
+		windows := target.windows.Adapted(target.remote.meter)
+		timersMx.Lock()
+		if cancelFirst == nil { cancelFirst = cancellableTimer(windows.maxWait, doSync) }
+		if cancelLast != nil { (*cancelLast)() }
+		cancelLast = cancellableTimer(windows.wait, doSync)
+		timersMx.Unlock()
+		for _, filename := range modification.AffectedPaths() { modifiedPaths.Put(filename) }
+		target.journal.RecordLater(target.record) // otherwise, it is lost on crash during batch window
+	}
+
+	for _, modification := range target.journal.Unfinished() { modificationReceived(modification) }
+	for _, modification := range pending {
+		for _, routed := range target.mapping.Route(modification) { modificationReceived(routed) }
+	}
+
+	for { // TODO: make sure previous (running) modifications are uploaded
+		select {
+			case modification, ok := <-modifications:
+				if !ok { return }
+				for _, routed := range target.mapping.Route(modification) { modificationReceived(routed) }
+			case modification := <-target.injected: modificationReceived(modification)
+			case <-target.flush:                    go doSync()
+			case <-pruning:                         go target.pruneTrash()
+		}
+	}
+}
+func (target *Target) Sync(modifications []Modification) { // synchronously
+	target.remote.Ready().Wait()
+	for _, modification := range target.journal.Unfinished() { target.queue.AtomicAdd(modification) }
+	for _, modification := range modifications {
+		for _, routed := range target.mapping.Route(modification) { target.queue.AtomicAdd(routed) }
+	}
+	target.syncMx.Lock()
+	defer target.syncMx.Unlock()
+	target.sync((&SwitchChannelPaths{}).New())
+}
+func (target *Target) pruneTrash() { // between batches. Not while paused, f.e. when lock was lost
+	target.syncMx.Lock()
+	defer target.syncMx.Unlock()
+	if target.Status().paused { return }
+	if err := target.remote.PruneTrash(); err != nil { target.logger.Error("pruning trash: " + err.Error()) }
+}
+func (target *Target) RetryParked() { // on demand
+	if target.unpark() == 0 { return }
+	select {
+		case target.wake <- struct{}{}: // currently waiting before next attempt. Parked ones are included in it
+		default: go target.Sync(nil)
+	}
+}
+func (target *Target) Resync(modification Modification) { // uploaded or deleted again, as if it was modified
+	for _, routed := range target.mapping.Route(modification) { target.injected <- routed }
+}
+func (target *Target) Flush() {
+	select {
+		case target.flush <- struct{}{}:
+		default: // already requested
+	}
+}
+func (target *Target) Pause() { // after current batch
+	target.setPaused(true)
+}
+func (target *Target) Resume() {
+	target.setPaused(false)
+	target.Flush()
+}
+func (target *Target) Drain() { // until everything received so far is synced
+	target.Resume()
+	target.syncing.Wait()
+}
+func (target *Target) Confirm(proceed bool) bool { // false, if nothing is waiting for confirmation
+	select {
+		case target.confirm <- proceed: return true
+		default:                        return false
+	}
+}
+func (target *Target) sync(modifiedPaths *SwitchChannelPaths) {
+	target.logger.Debug("sync")
+	queue := target.queue
+	synced := false   // at least once, during this sync
+	unparked := false
+	if target.Status().state != TargetFailing { target.setStatus(TargetSyncing, nil) }
+	defer func() {
+		if target.Status().state == TargetSyncing { target.setStatus(TargetIdle, nil) }
+	}()
+
+	defer target.record()
+
+	for {
+		target.logger.Debug("sync cycle")
+		target.logger.Debug("queue", queue)
+		target.record()
+		if target.Status().paused { break }
+
+		queue.Begin()
+		if inPlace := queue.GetInPlace(true); len(inPlace) > 0 {
+			target.logger.Debug("inPlace", inPlace)
+			if inPlace = target.guarded(inPlace); len(inPlace) == 0 {
+				queue.Commit()
+				continue
+			}
+			if results, err := target.remote.InPlace(inPlace); err == nil {
+				target.logger.Debug("success")
+				queue.Commit()
+				target.succeeded()
+				synced = true
+				target.listInPlace(results)
+				target.downgrade(results)
+			} else {
+				target.logger.Debug("fail")
+				batch := make([]Modification, 0, len(inPlace))
+				for _, modification := range inPlace { batch = append(batch, modification) }
+				target.retryLater(err, batch)
+			}
+
+			continue // MAYBE: do not always sync all `InPlace` first; instead, prioritize them with `Updated`
+		}
+		queue.Commit()
+
+		queue.Begin()
+		if updated := queue.GetUpdated(true); len(updated) > 0 {
+			target.logger.Debug("updated", updated)
+			command := target.remote.Update(updated)
+			modifiedPaths.On()
+
+			uploading: for {
+				select {
+					case modifiedPath, ok := <-modifiedPaths.Get():
+						if !ok { panic("modifiedPaths channel closed") }
+						for _, _updated := range updated { // MAYBE: map
+							if modifiedPath.Relates(_updated.path) {
+								target.logger.Debug("cancelling upload. Modified path", modifiedPath)
+								command.Cancel()
+								queue.Rollback()
+								break uploading
+							}
+						}
+					case result := <-command.ResultChan:
+						if result == nil {
+							target.logger.Debug("success")
+							queue.Commit()
+							target.succeeded()
+							synced = true
+							target.listUpdated(updated)
+						} else {
+							target.logger.Debug("fail")
+							batch := make([]Modification, 0, len(updated))
+							for _, modification := range updated { batch = append(batch, modification) }
+							target.retryLater(result, batch)
+						}
+						break uploading
+				}
+			}
+			modifiedPaths.Off()
+
+			continue
+		}
+		queue.Commit()
+
+		if synced && !unparked && target.unpark() > 0 { // once per sync
+			unparked = true
+			target.attempts = max(target.remote.retry.maxAttempts - 1, 0) // parked again, if fail
+			continue
+		}
+
+		break
+	}
+}
+func (target *Target) guarded(batch []InPlaceModification) []InPlaceModification { // allowed ones. Within transaction
+	remote := func(checksums bool) (Manifest, error) {
+		manifest, err := target.remote.Manifest(checksums)
+		if err == nil { target.listed = manifest }
+		return manifest, err
+	}
+	guarded, reason := target.guard.Check(batch, target.mapping.Unroute, target.listed, remote)
+	if len(guarded) == 0 { return batch }
+
+	target.mx.Lock()
+	state := target.status.state
+	target.status.state = TargetHeld
+	target.status.held = reason
+	target.mx.Unlock()
+	proceed := false
+	if target.unattended {
+		target.logger.Error(reason + ". Skipping: nothing can confirm (no terminal, no control socket)")
+	} else {
+		target.logger.Error(fmt.Sprintf(
+			"%s. Waiting for confirmation: \"%s\" to proceed, \"%s\" to skip",
+			reason,
+			ConfirmYes,
+			ConfirmNo,
+		))
+		proceed = <-target.confirm // other targets are synced meanwhile
+	}
+	target.setStatus(state, nil)
+	if proceed { return batch }
+
+	allowed := make([]InPlaceModification, 0, len(batch))
+	skipping: for _, modification := range batch {
+		for _, _guarded := range guarded {
+			if !modification.Equals(_guarded) { continue }
+			if moved, ok := modification.(Moved); ok { target.queue.AtomicAdd(Updated{moved.to}) } // remote original is kept
+			continue skipping
+		}
+		allowed = append(allowed, modification)
+	}
+	if target.remote.verbosity > 0 { fmt.Printf("%sskipped %d modifications\n", target.prefix, len(guarded)) }
+	return allowed
+}
+func (target *Target) listUpdated(updated []Updated) { // uploaded ones are known without listing remote again
+	if target.listed == nil { return }
+	localDir := target.remote.localDir
+	for _, _updated := range updated {
+		root := filepath.Join(localDir, _updated.path.original.Real())
+		_ = filepath.Walk(root, func(localPath string, info fs.FileInfo, err error) error {
+			if err != nil { return nil } // removed meanwhile
+			relative, errRelative := filepath.Rel(localDir, localPath)
+			if errRelative != nil { return errRelative }
+			if localPath != root && target.remote.exclude != nil && target.remote.exclude(Filename(relative), info.IsDir()) {
+				if info.IsDir() { return filepath.SkipDir }
+				return nil
+			}
+			if info.Mode().IsRegular() || info.Mode() & os.ModeSymlink != 0 {
+				target.listed[Filename(relative)] = ManifestEntry{size: info.Size(), mtime: info.ModTime().Unix()}
+			}
+			return nil
+		})
+	}
+}
+func (target *Target) listInPlace(results []InPlaceResult) { // applied ones are known without listing remote again
+	if target.listed == nil { return }
+	for _, result := range results {
+		if result.Outcome == InPlaceFailed { continue }
+		switch modification := result.Modification.(type) {
+			case Deleted: target.listed.Take(modification.path.original)
+			case Moved:
+				for filename, entry := range target.listed.Take(modification.from.original) {
+					target.listed[modification.to.original + filename[len(modification.from.original):]] = entry
+				}
+		}
+	}
+}
+func (target *Target) retryLater(err error, batch []Modification) { // within transaction
+	target.failed(err)
+	target.attempts++
+	class := classifyError(err)
+	policy := target.remote.retry
+	if !policy.GivesUp(class, target.attempts) {
+		target.queue.Rollback()
+		target.wait(policy.Delay(class, target.attempts))
+		return
+	}
+	target.queue.Commit()
+	target.park(fmt.Sprintf("giving up after %d attempts (%s error)", target.attempts, class), batch)
+	target.attempts = 0
+}
+func (target *Target) wait(delay time.Duration) {
+	if delay <= 0 { return }
+	target.logger.Debug("retrying in", delay)
+	select {
+		case <-time.After(delay):
+		case <-target.wake:
+	}
+}
+func (target *Target) park(reason string, modifications []Modification) {
+	paths := make([]string, 0, len(modifications))
+	target.mx.Lock()
+	for _, modification := range modifications {
+		target.parked.Add(modification)
+		for _, path := range modification.AffectedPaths() { paths = append(paths, path.original.Real()) }
+	}
+	target.mx.Unlock()
+	target.logger.Error(fmt.Sprintf("%s. Parked: %s", reason, strings.Join(paths, " ")))
+}
+func (target *Target) unpark() int { // parked modifications are moved back to queue
+	target.mx.Lock()
+	modifications := make([]Modification, 0)
+	for _, modification := range target.parked.GetInPlace(true) { modifications = append(modifications, modification) }
+	for _, modification := range target.parked.GetUpdated(true) { modifications = append(modifications, modification) }
+	target.mx.Unlock()
+	for _, modification := range modifications { target.queue.AtomicAdd(modification) }
+	return len(modifications)
+}
+func (target *Target) downgrade(results []InPlaceResult) { // failed in-place modifications are re-uploaded instead
+	for _, result := range results {
+		if result.Outcome != InPlaceFailed { continue }
+		message := fmt.Sprintf("%s: %s", result.Modification.OldFilename().Real(), result.Err)
+		moved, ok := result.Modification.(Moved)
+		if !ok { // deletion would fail again
+			target.park(message, []Modification{result.Modification})
+			continue
+		}
+		target.logger.Error(message)
+		target.queue.AtomicAdd(Deleted{moved.from})
+		if _, err := os.Lstat(filepath.Join(target.remote.localDir, moved.to.original.Real())); err == nil {
+			target.queue.AtomicAdd(Updated{moved.to})
+		}
+	}
+}
+func (target *Target) record() { // current state of queues, to journal
+	if target.journal == nil { return }
+	target.mx.Lock()
+	parked := target.parked.Copy()
+	target.mx.Unlock()
+	target.journal.Record(target.queue, parked)
+}
+func (target *Target) setPaused(paused bool) {
+	target.mx.Lock()
+	defer target.mx.Unlock()
+	target.status.paused = paused
+}
+func (target *Target) setStatus(state TargetState, err error) {
+	target.mx.Lock()
+	defer target.mx.Unlock()
+	target.status.state = state
+	if err != nil { target.status.lastError = err }
+}
+func (target *Target) succeeded() {
+	target.mx.Lock()
+	wasFailing := target.status.state == TargetFailing
+	target.status.state = TargetSyncing
+	target.status.lastSync = time.Now()
+	target.mx.Unlock()
+	target.attempts = 0
+	if wasFailing && target.remote.verbosity > 0 { fmt.Println(target.prefix + "recovered") }
+}
+func (target *Target) failed(err error) {
+	target.logger.Error(err.Error())
+	target.setStatus(TargetFailing, err)
+}
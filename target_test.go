@@ -0,0 +1,408 @@
+package main
+
+import (
+	"errors"
+	"github.com/0leksandr/my.go"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+type TestWatcher struct {
+	Watcher
+	modifications chan Modification
+}
+func (watcher TestWatcher) Close() error {
+	close(watcher.modifications)
+	return nil
+}
+func (watcher TestWatcher) Modifications() <-chan Modification {
+	return watcher.modifications
+}
+
+type TestRemoteClient struct {
+	RemoteClient
+	updated chan []Updated
+	release chan error // result of next update. If nil, updates succeed immediately
+	inPlace func([]InPlaceModification) error // if nil, in-place modifications succeed
+	listed  *int                              // number of remote listings, if not nil
+}
+func (client TestRemoteClient) Close() error {
+	return nil
+}
+func (client TestRemoteClient) Update(updated []Updated) CancellableContext {
+	client.updated <- append([]Updated(nil), updated...) // receivers sort it, while manager still reads the original
+	result := make(chan error, 1)
+	go func() {
+		if client.release != nil {
+			result <- <-client.release
+		} else {
+			result <- nil
+		}
+	}()
+	return CancellableContext{
+		Result:     func() error { return <-result },
+		Cancel:     func() {},
+		ResultChan: result,
+	}
+}
+func (client TestRemoteClient) Manifest(bool) (Manifest, error) {
+	if client.listed == nil { return nil, errors.New("not listed") }
+	*client.listed++
+	return Manifest{}, nil
+}
+func (client TestRemoteClient) InPlace(modifications []InPlaceModification) CancellableContext {
+	return CancellableContext{}.Go(
+		func() error {
+			if client.inPlace == nil { return nil }
+			return client.inPlace(modifications)
+		},
+		func() {},
+	)
+}
+func (client TestRemoteClient) Ready() *Locker {
+	return &Locker{}
+}
+func (client TestRemoteClient) Lock(func(error)) error {
+	return nil
+}
+
+type TargetFixture struct { // `Target`, syncing into `TestRemoteClient`
+	*Target
+	t      *testing.T
+	remote TestRemoteClient
+}
+func (TargetFixture) New(t *testing.T, remote TestRemoteClient, manager RemoteManager) TargetFixture {
+	manager.RemoteClient = remote
+	logger := Logger{debug: NullLogger{}, error: &InMemoryErrorLogger{}}
+	return TargetFixture{Target: (&Target{}).New("test:/dir", "", manager, logger), t: t, remote: remote}
+}
+func (fixture TargetFixture) expectUpdate(filenames ...Filename) { // in any order
+	fixture.t.Helper()
+	expected := make([]Updated, 0, len(filenames))
+	for _, filename := range filenames { expected = append(expected, Updated{testPath(filename)}) }
+	select {
+		case updated := <-fixture.remote.updated:
+			sort.Slice(updated, func(i, j int) bool { return updated[i].path.original < updated[j].path.original })
+			my.AssertEquals(fixture.t, updated, expected)
+		case <-time.After(5 * time.Second): fixture.t.Fatalf("%v were not uploaded", filenames)
+	}
+}
+func (fixture TargetFixture) expectNoUpdate() {
+	fixture.t.Helper()
+	select {
+		case updated := <-fixture.remote.updated: fixture.t.Fatalf("unexpected upload: %v", updated)
+		case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func testPath(filename Filename) Path {
+	return Path{}.New(filename)
+}
+
+func TestSSHMirror_FanOut(t *testing.T) {
+	logger := Logger{debug: NullLogger{}, error: &InMemoryErrorLogger{}}
+	fast := TestRemoteClient{updated: make(chan []Updated, 10)}
+	slow := TestRemoteClient{updated: make(chan []Updated, 10), release: make(chan error)}
+	watcher := TestWatcher{modifications: make(chan Modification)}
+	client := &SSHMirror{
+		watcher: watcher,
+		targets: []*Target{
+			(&Target{}).New("fast:/dir", "fast: ", RemoteManager{RemoteClient: fast}, logger),
+			(&Target{}).New("slow:/dir", "slow: ", RemoteManager{RemoteClient: slow}, logger),
+		},
+		logger:  logger,
+	}
+	running := make(chan struct{})
+	go func() {
+		client.Run()
+		close(running)
+	}()
+
+	expectUpdate := func(remote TestRemoteClient, filenames ...Filename) {
+		expected := make([]Updated, 0, len(filenames))
+		for _, filename := range filenames { expected = append(expected, Updated{Path{}.New(filename)}) }
+		select {
+			case updated := <-remote.updated:
+				sort.Slice(updated, func(i, j int) bool { return updated[i].path.original < updated[j].path.original })
+				my.AssertEquals(t, updated, expected)
+			case <-time.After(5 * time.Second): t.Fatalf("%v were not uploaded", filenames)
+		}
+	}
+	expectNoUpdate := func(remote TestRemoteClient) {
+		select {
+			case updated := <-remote.updated: t.Fatalf("unexpected upload: %v", updated)
+			case <-time.After(700 * time.Millisecond):
+		}
+	}
+
+	watcher.modifications <- Updated{Path{}.New("a")}
+	expectUpdate(fast, "a")
+	expectUpdate(slow, "a") // and hangs
+	watcher.modifications <- Updated{Path{}.New("b")}
+	expectUpdate(fast, "b") // not held back by slow target
+	expectNoUpdate(slow)
+	my.AssertEquals(t, client.Status()[0].state, TargetIdle)
+	my.AssertEquals(t, client.Status()[1].state, TargetSyncing)
+
+	slow.release <- errors.New("connection lost")
+	expectUpdate(slow, "a", "b") // retried, along with queued ones
+	my.AssertEquals(t, client.Status()[1].state, TargetFailing)
+	slow.release <- nil
+	time.Sleep(100 * time.Millisecond)
+	my.AssertEquals(t, client.Status()[1].state, TargetIdle)
+	my.Assert(t, !client.Status()[1].lastSync.IsZero())
+
+	Must(client.Close())
+	select {
+		case <-running:
+		case <-time.After(5 * time.Second): t.Fatal("not stopped")
+	}
+}
+
+func TestTarget_InPlaceOutcomes(t *testing.T) {
+	localDir := t.TempDir()
+	PanicIf(os.WriteFile(filepath.Join(localDir, "b2"), []byte{}, 0644))
+	var applied [][]InPlaceModification
+	remote := TestRemoteClient{
+		updated: make(chan []Updated, 10),
+		inPlace: func(modifications []InPlaceModification) error {
+			applied = append(applied, modifications)
+			results := InPlaceResult{}.All(modifications, InPlaceApplied)
+			for i, modification := range modifications {
+				switch modification.OldFilename() {
+					case "a1": results[i].Outcome = InPlaceGone
+					case "b1", "c": results[i] = InPlaceResult{modification, InPlaceFailed, errors.New("permission denied")}
+				}
+			}
+			return InPlaceError{}.New(results)
+		},
+	}
+	target := TargetFixture{}.New(t, remote, RemoteManager{localDir: localDir})
+
+	target.Sync([]Modification{
+		Moved{from: testPath("a1"), to: testPath("a2")}, // gone. Not retried
+		Moved{from: testPath("b1"), to: testPath("b2")}, // failed. Re-uploaded
+		Deleted{testPath("c")},                      // failed. Not retried
+		Deleted{testPath("d")},
+	})
+	my.AssertEquals(t, len(applied), 3)
+	my.AssertEquals(t, applied[1], []InPlaceModification{Deleted{testPath("b1")}})
+	my.AssertEquals(t, len(applied[2]), 2) // parked ones are retried once after successful sync
+	target.expectUpdate("b2") // failed move
+	my.Assert(t, target.queue.IsEmpty())
+	my.AssertEquals(t, target.Status().state, TargetIdle)
+	my.AssertEquals(t, target.Status().parked, 2) // failed deletions
+}
+
+func TestTarget_Retry(t *testing.T) {
+	remote := TestRemoteClient{updated: make(chan []Updated, 10), release: make(chan error, 10)}
+	target := TargetFixture{}.New(t, remote, RemoteManager{retry: RetryPolicy{delay: time.Millisecond, maxAttempts: 2}})
+
+	remote.release <- errors.New("mkdir: Permission denied")
+	remote.release <- errors.New("mkdir: Permission denied")
+	target.Sync([]Modification{Updated{testPath("a")}})
+	target.expectUpdate("a")
+	target.expectUpdate("a") // given up
+	my.Assert(t, target.queue.IsEmpty())
+	my.AssertEquals(t, target.Status().parked, 1)
+	my.AssertEquals(t, target.Status().state, TargetFailing)
+
+	remote.release <- nil
+	remote.release <- errors.New("mkdir: Permission denied")
+	target.Sync([]Modification{Updated{testPath("b")}})
+	target.expectUpdate("b")
+	target.expectUpdate("a") // retried once after successful sync
+	my.AssertEquals(t, target.Status().parked, 1)
+
+	remote.release <- nil
+	target.RetryParked()
+	target.expectUpdate("a") // on demand
+	my.AssertEquals(t, target.Status().parked, 0)
+	target.syncMx.Lock() // retried asynchronously
+	my.AssertEquals(t, target.Status().state, TargetIdle)
+	target.syncMx.Unlock()
+}
+
+func TestTarget_Journal(t *testing.T) {
+	archive, err := Archive{}.Open(filepath.Join(t.TempDir(), "journal.db"))
+	PanicIf(err)
+	unfinished := func() []Modification { return (&Journal{}).New(archive, "/local", "test:/dir").Unfinished() }
+
+	previous := TestRemoteClient{ // session, which was killed
+		updated: make(chan []Updated, 10),
+		release: make(chan error),
+		inPlace: func([]InPlaceModification) error { return errors.New("permission denied") },
+	}
+	target := TargetFixture{}.New(t, previous, RemoteManager{retry: RetryPolicy{maxAttempts: 1}})
+	target.journal = (&Journal{}).New(archive, "/local", "test:/dir")
+	target.Sync([]Modification{Deleted{testPath("c")}})
+	my.AssertEquals(t, target.Status().parked, 1)
+	synced := make(chan struct{})
+	go func() {
+		target.Sync([]Modification{Updated{testPath("a")}})
+		close(synced)
+	}()
+	target.expectUpdate("a") // and hangs
+	my.AssertEquals(t, unfinished(), []Modification{Deleted{testPath("c")}, Updated{testPath("a")}})
+	previous.release <- errors.New("killed")
+	<-synced
+
+	var applied []InPlaceModification
+	current := TestRemoteClient{
+		updated: make(chan []Updated, 10),
+		inPlace: func(modifications []InPlaceModification) error {
+			applied = append(applied, modifications...)
+			return nil
+		},
+	}
+	target = TargetFixture{}.New(t, current, RemoteManager{})
+	target.journal = (&Journal{}).New(archive, "/local", "test:/dir")
+	target.Sync(nil)
+	my.AssertEquals(t, applied, []InPlaceModification{Deleted{testPath("c")}})
+	target.expectUpdate("a")
+	my.AssertEquals(t, len(target.journal.Unfinished()), 0) // replayed only once
+	my.AssertEquals(t, len(unfinished()), 0)
+
+	target.windows = BatchWindows{wait: time.Hour, maxWait: time.Hour}
+	modifications := make(chan Modification)
+	go target.Run(modifications, nil)
+	modifications <- Updated{testPath("b")}
+	for deadline := time.Now().Add(5 * time.Second); len(unfinished()) == 0; { // journaled on receipt
+		if time.Now().After(deadline) { t.Fatal("received modification was not journaled") }
+		time.Sleep(10 * time.Millisecond)
+	}
+	my.AssertEquals(t, unfinished(), []Modification{Updated{testPath("b")}})
+	close(modifications)
+}
+
+func TestTarget_Guard(t *testing.T) {
+	var applied []InPlaceModification
+	remote := TestRemoteClient{
+		updated: make(chan []Updated, 10),
+		inPlace: func(modifications []InPlaceModification) error {
+			applied = append(applied, modifications...)
+			return nil
+		},
+	}
+	target := TargetFixture{}.New(t, remote, RemoteManager{})
+	var err error
+	target.guard, err = DeletionGuard{}.New(1, FileSize{}, []string{`^\.env$`})
+	PanicIf(err)
+	sync := func(proceed bool, modifications ...Modification) {
+		t.Helper()
+		my.Assert(t, !target.Confirm(proceed)) // nothing is held yet
+		synced := make(chan struct{})
+		go func() {
+			target.Sync(modifications)
+			close(synced)
+		}()
+		for deadline := time.Now().Add(5 * time.Second); target.Status().state != TargetHeld; {
+			if time.Now().After(deadline) { t.Fatal("not held") }
+			time.Sleep(time.Millisecond)
+		}
+		my.Assert(t, target.Confirm(proceed))
+		<-synced
+	}
+
+	sync(
+		false,
+		Deleted{testPath("a")},
+		Deleted{testPath("b")},
+		Moved{from: testPath(".env"), to: testPath("env")},
+		Moved{from: testPath("c"), to: testPath("d")},
+	)
+	my.AssertEquals(t, applied, []InPlaceModification{Moved{from: testPath("c"), to: testPath("d")}})
+	target.expectUpdate("env") // instead of moving protected one
+	my.AssertEquals(t, target.Status().state, TargetIdle)
+
+	applied = nil
+	sync(true, Deleted{testPath("a")}, Deleted{testPath("b")})
+	my.AssertEquals(t, applied, []InPlaceModification{Deleted{testPath("a")}, Deleted{testPath("b")}})
+
+	applied = nil
+	target.unattended = true // f.e. `init` without terminal
+	target.Sync([]Modification{Deleted{testPath("a")}, Deleted{testPath("b")}})
+	my.AssertEquals(t, len(applied), 0)
+}
+
+func TestTarget_GuardListed(t *testing.T) {
+	localDir := t.TempDir()
+	PanicIf(os.MkdirAll(filepath.Join(localDir, "new/sub"), 0755))
+	PanicIf(os.WriteFile(filepath.Join(localDir, "new/sub/a"), []byte{}, 0644))
+	PanicIf(os.WriteFile(filepath.Join(localDir, "new/b"), []byte{}, 0644))
+	nrListings := 0
+	remote := TestRemoteClient{updated: make(chan []Updated, 10), listed: &nrListings}
+	target := TargetFixture{}.New(t, remote, RemoteManager{localDir: localDir})
+	var err error
+	target.guard, err = DeletionGuard{}.New(3, FileSize{}, nil)
+	PanicIf(err)
+	target.listed = Manifest{"old": {size: 1}}
+
+	target.Sync([]Modification{Updated{testPath("new")}})
+	target.expectUpdate("new")
+	my.AssertEquals(t, len(target.listed), 3)
+	target.Sync([]Modification{Moved{from: testPath("new"), to: testPath("moved")}, Deleted{testPath("old")}})
+	my.AssertEquals(t, len(target.listed), 2)
+	_, isMoved := target.listed["moved/sub/a"]
+	my.Assert(t, isMoved)
+	target.Sync([]Modification{Deleted{testPath("moved")}})
+	my.AssertEquals(t, len(target.listed), 0)
+	my.AssertEquals(t, nrListings, 0) // deleted ones were uploaded meanwhile
+
+	target.Sync([]Modification{Deleted{testPath("unknown")}})
+	my.AssertEquals(t, nrListings, 1)
+}
+
+func TestTarget_PruneTrash(t *testing.T) {
+	nrListings := 0
+	remote := TestRemoteClient{updated: make(chan []Updated, 10), listed: &nrListings}
+	target := TargetFixture{}.New(t, remote, RemoteManager{trash: Trash{enabled: true}})
+	pruned := func() int {
+		target.syncMx.Lock()
+		defer target.syncMx.Unlock()
+		return nrListings
+	}
+	modifications := make(chan Modification)
+	go target.Run(modifications, nil)
+	for deadline := time.Now().Add(5 * time.Second); pruned() == 0; { // on start
+		if time.Now().After(deadline) { t.Fatal("trash was not pruned") }
+		time.Sleep(time.Millisecond)
+	}
+	close(modifications)
+
+	target.Pause()
+	target.pruneTrash()
+	my.AssertEquals(t, pruned(), 1)
+	target.Resume()
+	target.pruneTrash()
+	my.AssertEquals(t, pruned(), 2)
+}
+
+func TestTarget_Control(t *testing.T) {
+	target := TargetFixture{}.New(t, TestRemoteClient{updated: make(chan []Updated, 10)}, RemoteManager{})
+	target.windows = BatchWindows{wait: time.Hour, maxWait: time.Hour}
+	modifications := make(chan Modification)
+	go target.Run(modifications, nil)
+
+	modifications <- Updated{testPath("a")}
+	target.expectNoUpdate() // waiting for batch window
+	target.Flush()
+	target.expectUpdate("a")
+
+	target.Pause()
+	modifications <- Updated{testPath("b")}
+	target.Flush()
+	target.expectNoUpdate()
+	my.Assert(t, target.Status().paused)
+	target.Resume()
+	target.expectUpdate("b")
+
+	target.Resync(Updated{testPath("c")})
+	target.Flush()
+	target.expectUpdate("c")
+	target.Drain() // nothing left
+	close(modifications)
+}
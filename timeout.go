@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+const SyncMinThroughput = 32 << 10 // bytes per second. Slower uploads are considered stalled
+const InPlaceOperationTimeout = 100 * time.Millisecond // per modification
+
+type SyncTimeouts struct {
+	min time.Duration // for smallest batches. Covers connection latency
+	max time.Duration // 0 means no timeout
+}
+func (timeouts SyncTimeouts) Upload(size int64) time.Duration {
+	seconds := size / SyncMinThroughput
+	if ceiling := int64(timeouts.max / time.Second); seconds > ceiling { seconds = ceiling } // would overflow
+	return timeouts.clamp(time.Duration(seconds) * time.Second)
+}
+func (timeouts SyncTimeouts) InPlace(count int) time.Duration {
+	return timeouts.clamp(time.Duration(count) * InPlaceOperationTimeout)
+}
+func (timeouts SyncTimeouts) clamp(timeout time.Duration) time.Duration {
+	if timeouts.max <= 0 { return 0 }
+	timeout += timeouts.min
+	if timeout > timeouts.max { timeout = timeouts.max }
+	return timeout
+}
+
+type TimeoutError struct { // operation stalled, and was cancelled
+	Operation string
+	Timeout   time.Duration
+}
+func (err *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", err.Operation, err.Timeout)
+}
+
+func withTimeout(
+	operation string,
+	timeout time.Duration,
+	result func() error,
+	cancel func(),
+	awaitCancelled bool, // f.e. late remote `rm` would race with retried batch. `cancel` must make operation stop
+) error {
+	if timeout <= 0 { return result() }
+	done := make(chan error, 1)
+	go func() { done <- result() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+		case err := <-done:
+			return err
+		case <-timer.C:
+			cancel()
+			if awaitCancelled { <-done } // otherwise, operation can hang on dead connection
+			return &TimeoutError{Operation: operation, Timeout: timeout}
+	}
+}
+
+func uploadSize(localDir string, updated []Updated) int64 { // total size of local files, including directories contents
+	var size int64
+	for _, modification := range updated {
+		root := filepath.Join(localDir, modification.path.original.Real())
+		_ = filepath.Walk(root, func(_ string, info fs.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() { size += info.Size() }
+			return nil // vanished or unreadable files are skipped
+		})
+	}
+	return size
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"github.com/0leksandr/my.go"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncTimeouts(t *testing.T) {
+	timeouts := SyncTimeouts{min: 10 * time.Second, max: time.Minute}
+	my.AssertEquals(t, timeouts.Upload(0), 10 * time.Second)
+	my.AssertEquals(t, timeouts.Upload(10 * SyncMinThroughput), 20 * time.Second)
+	my.AssertEquals(t, timeouts.Upload(1 << 40), time.Minute)
+	my.AssertEquals(t, timeouts.InPlace(100), 10 * time.Second + 100 * InPlaceOperationTimeout)
+	my.AssertEquals(t, SyncTimeouts{min: time.Second}.Upload(1 << 40), time.Duration(0)) // disabled
+
+	dir := t.TempDir()
+	PanicIf(os.MkdirAll(filepath.Join(dir, "a/b"), 0755))
+	PanicIf(os.WriteFile(filepath.Join(dir, "a/b/c"), make([]byte, 100), 0644))
+	PanicIf(os.WriteFile(filepath.Join(dir, "d"), make([]byte, 10), 0644))
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+	my.AssertEquals(t, uploadSize(dir, []Updated{{path("a")}, {path("d")}, {path("missing")}}), int64(110))
+}
+
+func TestRemoteManager_Timeout(t *testing.T) {
+	remote := TestRemoteClient{updated: make(chan []Updated, 1), release: make(chan error)}
+	cancelled := make(chan struct{}, 1)
+	manager := RemoteManager{
+		RemoteClient: TimeoutTestClient{TestRemoteClient: remote, cancelled: cancelled},
+		localDir:     t.TempDir(),
+		timeouts:     SyncTimeouts{min: 50 * time.Millisecond, max: time.Second},
+	}
+	err := manager.Update([]Updated{{Path{}.New("a")}}).Result() // never released
+	var timeoutError *TimeoutError
+	my.Assert(t, errors.As(err, &timeoutError), err)
+	my.AssertEquals(t, classifyError(err), ErrorConnection)
+	select {
+		case <-cancelled:
+		default: t.Fatal("stalled upload was not cancelled")
+	}
+
+	stopped := false
+	manager.RemoteClient = TimeoutTestClient{
+		TestRemoteClient: TestRemoteClient{inPlace: func([]InPlaceModification) error {
+			<-cancelled // until cancelled
+			time.Sleep(10 * time.Millisecond)
+			stopped = true
+			return errors.New("killed")
+		}},
+		cancelled: cancelled,
+	}
+	_, err = manager.InPlace([]InPlaceModification{Deleted{Path{}.New("a")}})
+	my.Assert(t, errors.As(err, &timeoutError), err)
+	my.Assert(t, stopped) // awaited, before rollback
+}
+
+type TimeoutTestClient struct {
+	TestRemoteClient
+	cancelled chan struct{}
+}
+func (client TimeoutTestClient) Update(updated []Updated) CancellableContext {
+	context := client.TestRemoteClient.Update(updated)
+	context.Cancel = func() { client.cancelled <- struct{}{} }
+	return context
+}
+func (client TimeoutTestClient) InPlace(modifications []InPlaceModification) CancellableContext {
+	context := client.TestRemoteClient.InPlace(modifications)
+	context.Cancel = func() { client.cancelled <- struct{}{} }
+	return context
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const TrashDir = ".sshmirror-trash" // in remote directory. Never listed as mirrored file
+const TrashStampFormat = "2006-01-02_15-04-05.000" // UTC. Sorted chronologically
+const TrashPruneInterval = time.Hour
+
+type Trash struct { // deleted and overwritten remote files are kept for a while, instead of being removed
+	enabled bool
+	maxAge  time.Duration // 0 means unlimited
+	maxSize FileSize      // 0 means unlimited
+}
+func (Trash) Stamp(now time.Time) string { // name of subdirectory for one batch
+	return now.UTC().Format(TrashStampFormat)
+}
+func (trash Trash) After(stamp string, now time.Time) string { // stamp of `now`, but sorted after `stamp`
+	next := trash.Stamp(now)
+	if next > stamp { return next }
+	if parsed, err := time.Parse(TrashStampFormat, stamp); err == nil { return trash.Stamp(parsed.Add(time.Millisecond)) }
+	return stamp + "_" // not made by sshmirror
+}
+func (trash Trash) Path(stamp string, path Path) Path {
+	return Path{}.New(Filename(TrashDir + "/" + stamp + "/") + path.original)
+}
+func (trash Trash) Deleting(modifications []InPlaceModification, now time.Time) []InPlaceModification {
+	// deletions are replaced with moving into trash
+	if !trash.enabled { return modifications }
+	stamp := trash.Stamp(now)
+	replaced := make([]InPlaceModification, 0, len(modifications))
+	for _, modification := range modifications {
+		if deleted, ok := modification.(Deleted); ok && !isTrashed(deleted.path.original) {
+			modification = Moved{from: deleted.path, to: trash.Path(stamp, deleted.path)}
+		}
+		replaced = append(replaced, modification)
+	}
+	return replaced
+}
+func (trash Trash) Expired(remote Manifest, now time.Time) []InPlaceModification { // oldest ones, to be deleted
+	sizes := trashSizes(remote)
+	stamps := make([]string, 0, len(sizes))
+	total := FileSize{}
+	for stamp, size := range sizes {
+		stamps = append(stamps, stamp)
+		total = total.Add(size)
+	}
+	sort.Strings(stamps)
+
+	var expired []InPlaceModification
+	for _, stamp := range stamps {
+		deleted, err := time.Parse(TrashStampFormat, stamp)
+		tooOld := err == nil && trash.maxAge > 0 && now.Sub(deleted) > trash.maxAge
+		tooBig := trash.maxSize.Bytes() > 0 && trash.maxSize.IsLess(total)
+		if !tooOld && !tooBig { break }
+		expired = append(expired, Deleted{Path{}.New(Filename(TrashDir + "/" + stamp))})
+		total = FileSize{bytes: total.Bytes() - sizes[stamp].Bytes()}
+	}
+	return expired
+}
+func (Trash) Versions(remote Manifest, path Path) []string { // stamps, which contain `path`. Oldest first
+	found := make(map[string]bool)
+	for filename := range remote {
+		stamp, trashed, ok := splitTrashed(filename)
+		if ok && (trashed == path.original || strings.HasPrefix(string(trashed), string(path.original) + "/")) {
+			found[stamp] = true
+		}
+	}
+	stamps := make([]string, 0, len(found))
+	for stamp := range found { stamps = append(stamps, stamp) }
+	sort.Strings(stamps)
+	return stamps
+}
+
+func isTrashed(filename Filename) bool {
+	return filename == TrashDir || strings.HasPrefix(string(filename), TrashDir + "/")
+}
+func splitTrashed(filename Filename) (stamp string, trashed Filename, ok bool) { // "<TrashDir>/<stamp>/<trashed>"
+	if !isTrashed(filename) { return "", "", false }
+	parts := strings.SplitN(string(filename), "/", 3)
+	if len(parts) < 3 { return "", "", false }
+	return parts[1], Filename(parts[2]), true
+}
+func trashSizes(remote Manifest) map[string]FileSize { // by stamps
+	sizes := make(map[string]FileSize)
+	for filename, entry := range remote {
+		if stamp, _, ok := splitTrashed(filename); ok {
+			sizes[stamp] = sizes[stamp].Add(FileSize{bytes: uint64(entry.size)})
+		}
+	}
+	return sizes
+}
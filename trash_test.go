@@ -0,0 +1,105 @@
+package main
+
+import (
+	"github.com/0leksandr/my.go"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	trash := Trash{enabled: true, maxAge: 7 * 24 * time.Hour}
+	my.AssertEquals(
+		t,
+		trash.Deleting([]InPlaceModification{Deleted{path("a")}, Moved{from: path("b"), to: path("c")}}, now),
+		[]InPlaceModification{
+			Moved{from: path("a"), to: path(TrashDir + "/2026-01-10_12-00-00.000/a")},
+			Moved{from: path("b"), to: path("c")},
+		},
+	)
+
+	remote := Manifest{
+		TrashDir + "/2026-01-01_00-00-00.000/dir/a": {size: 10},
+		TrashDir + "/2026-01-05_00-00-00.000/dir/a": {size: 20},
+		TrashDir + "/2026-01-09_00-00-00.000/b":     {size: 30},
+		"dir/a":                                     {size: 40},
+	}
+	my.AssertEquals(
+		t,
+		trash.Expired(remote, now),
+		[]InPlaceModification{Deleted{path(TrashDir + "/2026-01-01_00-00-00.000")}},
+	)
+	trash.maxSize = FileSize{bytes: 30}
+	my.AssertEquals(
+		t,
+		trash.Expired(remote, now),
+		[]InPlaceModification{
+			Deleted{path(TrashDir + "/2026-01-01_00-00-00.000")},
+			Deleted{path(TrashDir + "/2026-01-05_00-00-00.000")},
+		},
+	)
+	my.AssertEquals(t, trash.Versions(remote, path("dir")), []string{"2026-01-01_00-00-00.000", "2026-01-05_00-00-00.000"})
+	my.AssertEquals(t, len(trash.Versions(remote, path("di"))), 0)
+
+	my.AssertEquals(t, trash.After("2026-01-09_00-00-00.000", now), "2026-01-10_12-00-00.000")
+	my.AssertEquals(t, trash.After("2026-01-10_12-00-00.000", now), "2026-01-10_12-00-00.001")
+	my.AssertEquals(t, trash.After("2026-01-11_00-00-00.000", now), "2026-01-11_00-00-00.001") // clock went back
+	my.AssertEquals(t, trash.After("manual", now), "manual_")
+}
+
+func TestRemoteManager_Trash(t *testing.T) {
+	remoteDir := t.TempDir()
+	write := func(relative, contents string) {
+		PanicIf(os.MkdirAll(filepath.Dir(filepath.Join(remoteDir, relative)), 0755))
+		PanicIf(os.WriteFile(filepath.Join(remoteDir, relative), []byte(contents), 0644))
+	}
+	remoteContents := func(relative string) string {
+		contents, err := os.ReadFile(filepath.Join(remoteDir, relative))
+		if err != nil { return "" }
+		return string(contents)
+	}
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+	write("a.txt", "a")
+	write("dir/b", "bb")
+	config := Config{localDir: t.TempDir(), remoteDir: remoteDir, trash: Trash{enabled: true}}
+	manager := RemoteManager{}.New(config, LocalDirClient{}.New(config))
+
+	results, err := manager.InPlace([]InPlaceModification{Deleted{path("a.txt")}, Deleted{path("dir")}})
+	PanicIf(err)
+	my.AssertEquals(t, len(results), 2)
+	my.AssertEquals(t, results[1], InPlaceResult{Modification: Deleted{path("dir")}, Outcome: InPlaceApplied})
+	manifest, err := manager.Manifest(false)
+	PanicIf(err)
+	my.AssertEquals(t, len(manifest), 0) // trash is not listed
+
+	write("a.txt", "new")
+	stamp, err := manager.Restore(path("a.txt"), "")
+	PanicIf(err)
+	my.AssertEquals(t, remoteContents("a.txt"), "a")
+	trashed, err := manager.RemoteClient.Manifest(false)
+	PanicIf(err)
+	versions := manager.trash.Versions(trashed, path("a.txt"))
+	my.AssertEquals(t, len(versions), 1)
+	my.Assert(t, versions[0] > stamp)
+	my.AssertEquals(t, remoteContents(TrashDir + "/" + versions[0] + "/a.txt"), "new") // replaced one
+	_, err = manager.Restore(path("missing"), "")
+	my.Assert(t, err != nil)
+
+	manager.trash.maxSize = FileSize{bytes: 1}
+	PanicIf(manager.PruneTrash())
+	manifest, err = manager.RemoteClient.Manifest(false)
+	PanicIf(err)
+	my.AssertEquals(t, manifest, Manifest{"a.txt": manifest["a.txt"]})
+
+	PanicIf(os.WriteFile(filepath.Join(config.localDir, "a.txt"), []byte("local"), 0644))
+	PanicIf(manager.RemoteClient.Update([]Updated{{path("a.txt")}}).Result())
+	my.AssertEquals(t, remoteContents("a.txt"), "local")
+	trashed, err = manager.RemoteClient.Manifest(false)
+	PanicIf(err)
+	versions = manager.trash.Versions(trashed, path("a.txt"))
+	my.AssertEquals(t, len(versions), 1)
+	my.AssertEquals(t, remoteContents(TrashDir + "/" + versions[0] + "/a.txt"), "a") // overwritten one
+}
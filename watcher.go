@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"context"
 	"errors"
 	"fmt"
 	"github.com/0leksandr/my.go"
@@ -14,6 +13,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -24,44 +24,133 @@ type Watcher interface {
 	Name() string
 }
 
-type FsnotifyWatcher struct { // PRIORITY: watch new subdirectories
+type FsnotifyWatcher struct {
 	Watcher
 	modifications chan Modification
 	stopWatching  func()
 }
-func (FsnotifyWatcher) New(root string, exclude *regexp.Regexp) Watcher {
+func (FsnotifyWatcher) New(root string, exclude Excluder, logger Logger) Watcher {
 	watcher := FsnotifyWatcher{
 		modifications: make(chan Modification),
 	}
-	var events <-chan fsnotify.Event
-	events, watcher.stopWatching = FsnotifyWatcher{}.watchDirRecursive(root, exclude)
+	fsWatcher, err := fsnotify.NewWatcher()
+	PanicIf(err)
+	watcher.stopWatching = func() { Must(fsWatcher.Close()) }
+	events := fsWatcher.Events
+
+	getPath := func(name string) Path {
+		return Path{}.New(Filename(name[len(root)+1:]))
+	}
+	watched := make(map[string]bool) // directories
+	isDir := func(name string) bool {
+		fi, err := os.Lstat(name)
+		return (err == nil && fi.IsDir()) || watched[name]
+	}
+	isIgnored := func(name string) bool {
+		if exclude == nil { return false }
+		if name[:len(root)] != root {
+			panic(fmt.Sprintf("Unexpected local path: %s", name))
+		}
+		name = name[len(root):]
+		if name != "" {
+			// TODO: platform-specific directory separators
+			if name[0] != '/' { panic(fmt.Sprintf("Unexpected local path: %s", name)) }
+			name = name[1:]
+		}
+		return isExcluded(exclude, Path{}.New(Filename(name)), isDir(root + string(os.PathSeparator) + name))
+	}
 
-	getPath := func(event fsnotify.Event) Path {
-		return Path{}.New(Filename(event.Name[len(root)+1:]))
+	watchDirRecursive := func(dir string, onFile func(name string), onError func(err error) error) error {
+		return filepath.Walk(
+			dir,
+			func(name string, fi os.FileInfo, err error) error {
+				if err != nil {
+					if os.IsNotExist(err) { return nil } // removed meanwhile
+					return onError(err)
+				}
+				if isIgnored(name) {
+					if fi.IsDir() { return filepath.SkipDir }
+					return nil
+				}
+				if fi.Mode().IsDir() {
+					if errAdd := fsWatcher.Add(name); errAdd != nil {
+						if errors.Is(errAdd, os.ErrNotExist) { return filepath.SkipDir } // removed meanwhile
+						if errSkip := onError(errAdd); errSkip != nil { return errSkip }
+						return filepath.SkipDir
+					}
+					watched[name] = true
+				} else if onFile != nil {
+					onFile(name)
+				}
+				return nil
+			},
+		)
+	}
+	watchCreatedDir := func(dir string, onFile func(name string)) { // errors are not fatal after start
+		_ = watchDirRecursive(dir, onFile, func(err error) error {
+			logger.Error(fmt.Sprintf("watching %s: %s", dir, err.Error()))
+			return nil
+		})
+	}
+	unwatchDirRecursive := func(dir string) {
+		for name := range watched {
+			if name == dir || strings.HasPrefix(name, dir + string(os.PathSeparator)) {
+				_ = fsWatcher.Remove(name) // removed directories are unwatched automatically
+				delete(watched, name)
+			}
+		}
+	}
+	PanicIf(watchDirRecursive(root, nil, func(err error) error { return err }))
+
+	var lastRemoved *Path
+	put := func(modification Modification) {
+		lastRemoved = nil
+		switch removed := modification.(type) {
+			case Deleted: lastRemoved = &removed.path
+			case Moved:   lastRemoved = &removed.from
+		}
+		reloaded := reloadExclusions(exclude, modification)
+		watcher.put(modification)
+		for _, dir := range reloaded { // directories, that are not excluded anymore
+			watchCreatedDir(filepath.Join(root, dir.original.Real()), nil)
+		}
 	}
 
 	var processEvent func(event fsnotify.Event)
 	processEvent = func(event fsnotify.Event) {
 		if event.Op == 0 { return } // MAYBE: report? This is weird
 		if event.Op == fsnotify.Chmod { return }
-		path := getPath(event)
-		if exclude != nil && exclude.MatchString(path.original.Real()) { return }
+		if isIgnored(event.Name) { return }
+		path := getPath(event.Name)
+		if event.Op == fsnotify.Remove || event.Op == fsnotify.Rename {
+			if lastRemoved != nil && lastRemoved.Equals(path) { // same event, reported by directory itself
+				lastRemoved = nil
+				return
+			}
+		}
 
 		switch event.Op {
 			case fsnotify.Create, fsnotify.Write:
-				watcher.put(Updated{path})
+				put(Updated{path})
+				if event.Op == fsnotify.Create && isDir(event.Name) {
+					// files, created before the directory started being watched
+					watchCreatedDir(event.Name, func(name string) { put(Updated{getPath(name)}) })
+				}
 			case fsnotify.Remove:
-				watcher.put(Deleted{path})
+				unwatchDirRecursive(event.Name)
+				put(Deleted{path})
 			case fsnotify.Rename:
-				putDefault := func() { watcher.put(Deleted{path}) }
+				unwatchDirRecursive(event.Name)
+				putDefault := func() { put(Deleted{path}) }
 				select {
 					case nextEvent, ok := <-events:
 						if ok {
-							if nextEvent.Op == fsnotify.Create { // MAYBE: check contents (checksums, modification times)
-								watcher.put(Moved{
+							if nextEvent.Op == fsnotify.Create && !isIgnored(nextEvent.Name) { // MAYBE: check contents (checksums, modification times)
+								put(Moved{
 									from: path,
-									to:   getPath(nextEvent),
+									to:   getPath(nextEvent.Name),
 								})
+								if isDir(nextEvent.Name) { watchCreatedDir(nextEvent.Name, nil) }
 							} else {
 								putDefault()
 								processEvent(nextEvent)
@@ -78,6 +167,9 @@ func (FsnotifyWatcher) New(root string, exclude *regexp.Regexp) Watcher {
 		}
 	}
 
+	go func() {
+		PanicIf(<-fsWatcher.Errors) // MAYBE: return errors channel
+	}()
 	go func() {
 		for event := range events {
 			processEvent(event)
@@ -97,54 +189,26 @@ func (watcher *FsnotifyWatcher) Close() error {
 func (watcher *FsnotifyWatcher) Modifications() <-chan Modification {
 	return watcher.modifications
 }
-func (FsnotifyWatcher) watchDirRecursive(
-	path string,
-	ignored *regexp.Regexp,
-) (<-chan fsnotify.Event, context.CancelFunc) {
-	watcher, err := fsnotify.NewWatcher()
-	PanicIf(err)
-
-	isIgnored := func(path2 string) bool {
-		if ignored == nil { return false }
-		if path2[:len(path)] != path {
-			panic(fmt.Sprintf("Unexpected local path: %s", path2))
-		}
-		path2 = path2[len(path):]
-		if path2 != "" {
-			// TODO: platform-specific directory separators
-			if path2[0] != '/' { panic(fmt.Sprintf("Unexpected local path: %s", path2)) }
-			path2 = path2[1:]
-		}
-		return ignored.MatchString(path2)
-	}
-
-	Must(filepath.Walk(
-		path,
-		func(path string, fi os.FileInfo, err error) error {
-			if isIgnored(path) { return nil }
-			PanicIf(err)
-			if fi.Mode().IsDir() { return watcher.Add(path) }
-			return nil
-		},
-	))
-
-	go func() {
-		PanicIf(<-watcher.Errors) // MAYBE: return errors channel
-	}()
-
-	return watcher.Events, func() { Must(watcher.Close()) }
-}
 func (watcher *FsnotifyWatcher) put(modification Modification) { // MAYBE: remove
 	watcher.modifications <- modification
 }
 
+func reloadExclusions(exclude Excluder, modification Modification) []Path { // dirs, where ignore files were modified
+	var dirs []Path
+	if exclude == nil { return dirs }
+	for _, path := range modification.AffectedPaths() {
+		if exclude.Reload(path) { dirs = append(dirs, path.Parent()) }
+	}
+	return dirs
+}
+
 type InotifyWatcher struct {
 	Watcher
 	modifications chan Modification
 	logger        Logger
 	onClose       func() error
 }
-func (InotifyWatcher) New(root string, exclude *regexp.Regexp, logger Logger) (Watcher, error) {
+func (InotifyWatcher) New(root string, exclude Excluder, logger Logger) (Watcher, error) {
 	modifications := make(chan Modification) // MAYBE: reserve size
 	watcher := &InotifyWatcher{
 		modifications: modifications,
@@ -166,6 +230,8 @@ func (InotifyWatcher) New(root string, exclude *regexp.Regexp, logger Logger) (W
 
 	const UpdatedMergeTimeout = 5 * time.Millisecond
 	const MvTimeout = 2 * time.Millisecond // MAYBE: tweak
+	const RestartDelay = 1 * time.Second
+	const MaxRestartDelay = 1 * time.Minute
 
 	const CreateStr     = "CREATE"
 	const CloseWriteStr = "CLOSE_WRITE"
@@ -175,6 +241,8 @@ func (InotifyWatcher) New(root string, exclude *regexp.Regexp, logger Logger) (W
 
 	const IsDir = "ISDIR"
 
+	const WatchesEstablished = "Watches established"
+
 	type EventType uint8
 	const (
 		CreateCode EventType = 1 << iota
@@ -182,6 +250,7 @@ func (InotifyWatcher) New(root string, exclude *regexp.Regexp, logger Logger) (W
 		DeleteCode
 		MovedFromCode
 		MovedToCode
+		ReconciledCode // not an inotify event. Modification, which was missed while `inotifywait` was not running
 	)
 
 	// something that never can be a part of a path/filename
@@ -192,7 +261,6 @@ func (InotifyWatcher) New(root string, exclude *regexp.Regexp, logger Logger) (W
 	args := []string{
 		"--monitor",
 		"--recursive",
-		"--quiet",
 		"--format", strings.Join([]string{
 			"%w%f",
 			Delimiter,
@@ -204,26 +272,19 @@ func (InotifyWatcher) New(root string, exclude *regexp.Regexp, logger Logger) (W
 		"--event", MovedFromStr,
 		"--event", MovedToStr,
 	}
-	if exclude != nil {
-		args = append(args, "--exclude", exclude.String())
+	if static, ok := exclude.(StaticExcluder); ok && len(static.Patterns()) > 0 { // not watched at all
+		args = append(args, "--exclude", strings.Join(static.Patterns(), "|"))
 	}
-	command := exec.Command("inotifywait", append(args, "--", root)...)
+	// rest are filtered here, because ignore files can change (and `--exclude` can not be changed later)
 
 	type Event struct {
-		eventType EventType
-		path      Path
-		isDir     bool
+		eventType    EventType
+		path         Path
+		isDir        bool
+		modification Modification // for `ReconciledCode`
 	}
 	events := make(chan Event) // MAYBE: reserve size
-	watcher.onClose = func() error {
-		close(events)
-		close(modifications)
-		return nil
-	}
 
-	stdout, err1 := command.StdoutPipe()
-	PanicIf(err1)
-	stdoutScanner := bufio.NewScanner(stdout)
 	reg := regexp.MustCompile(fmt.Sprintf(
 		"(?s)^%s(.+)%s([A-Z_,]+)$",
 		stripTrailSlash(root) + string(os.PathSeparator),
@@ -239,7 +300,8 @@ func (InotifyWatcher) New(root string, exclude *regexp.Regexp, logger Logger) (W
 		{MovedFromStr,  MovedFromCode },
 		{MovedToStr,    MovedToCode   },
 	}
-	go func() { // stdout to events
+	readEvents := func(stdout io.Reader) { // stdout to events
+		stdoutScanner := bufio.NewScanner(stdout)
 		for {
 			line := func() string {
 				var lines []string
@@ -275,6 +337,7 @@ func (InotifyWatcher) New(root string, exclude *regexp.Regexp, logger Logger) (W
 						break
 					}
 				}
+				if isExcluded(exclude, path, isDir) { continue }
 				events <- Event{
 					eventType: knownType,
 					path:      path,
@@ -284,13 +347,128 @@ func (InotifyWatcher) New(root string, exclude *regexp.Regexp, logger Logger) (W
 				watcher.logger.Error(errReadEvent.Error())
 			}
 		}
+	}
 
-		close(events)
-	}()
+	var mx sync.Mutex // accessing `command` or `closed`
+	var command *exec.Cmd
+	closed := false
+	var baselineMx sync.Mutex
+	var baseline Snapshot // reported state of `root`. Changes, missed during restart, are detected against it
+	onError := func(err error) { watcher.logger.Error(err.Error()) }
+	stop := make(chan struct{})
+	var exited chan struct{} // outputs of current `inotifywait` process are read
+	start := func() error { // starts `inotifywait`, and waits until watches are established
+		_command := exec.Command("inotifywait", append(args, "--", root)...)
+		stdout, errStdout := _command.StdoutPipe()
+		if errStdout != nil { return errStdout }
+		stderr, errStderr := _command.StderrPipe()
+		if errStderr != nil { return errStderr }
+		mx.Lock()
+		if closed {
+			mx.Unlock()
+			return errors.New("watcher is closed")
+		}
+		if errStart := _command.Start(); errStart != nil {
+			mx.Unlock()
+			return errStart
+		}
+		command = _command
+		mx.Unlock()
+
+		established := make(chan struct{})
+		stderrDone := make(chan struct{})
+		stdoutDone := make(chan struct{})
+		var lastError string
+		go func() {
+			defer close(stderrDone)
+			stderrScanner := bufio.NewScanner(stderr)
+			isEstablished := false
+			for stderrScanner.Scan() {
+				line := stderrScanner.Text()
+				switch {
+					case strings.HasPrefix(line, WatchesEstablished):
+						if !isEstablished {
+							isEstablished = true
+							close(established)
+						}
+					case strings.HasPrefix(line, "Setting up watches"):
+						watcher.logger.Debug("inotify.stderr", line)
+					default:
+						lastError = line
+						watcher.logger.Error("inotifywait: " + line)
+				}
+			}
+		}()
+		go func() {
+			defer close(stdoutDone)
+			readEvents(stdout)
+		}()
+		exited = make(chan struct{})
+		go func(exited chan struct{}) {
+			<-stdoutDone
+			<-stderrDone
+			close(exited)
+		}(exited)
+
+		select {
+			case <-established:
+				return nil
+			case <-exited:
+				errWait := _command.Wait()
+				if lastError != "" { return errors.New("inotifywait: " + lastError) }
+				if errWait != nil { return errWait }
+				return errors.New("inotifywait exited before watches were established")
+		}
+	}
+	supervise := func() { // restarts `inotifywait`, if it exits
+		defer close(events)
+		for {
+			<-exited
+			mx.Lock()
+			_command := command
+			mx.Unlock()
+			errWait := _command.Wait()
+			mx.Lock()
+			isClosed := closed
+			mx.Unlock()
+			if isClosed { return }
+
+			watcher.logger.Error(fmt.Sprintf("inotifywait exited unexpectedly (%v). Restarting", errWait))
+			restartDelay := RestartDelay
+			for {
+				select {
+					case <-time.After(restartDelay):
+					case <-stop: return
+				}
+				errStart := start()
+				if errStart == nil { break }
+				watcher.logger.Error("could not restart inotifywait: " + errStart.Error())
+				if restartDelay *= 2; restartDelay > MaxRestartDelay { restartDelay = MaxRestartDelay }
+			}
+			watcher.logger.Error("inotifywait restarted")
+
+			baselineMx.Lock()
+			missed := baseline.Diff(Snapshot{}.Take(root, exclude, onError)) // changes during gap
+			baselineMx.Unlock()
+			for _, modification := range missed {
+				events <- Event{
+					eventType:    ReconciledCode,
+					modification: modification,
+				}
+			}
+		}
+	}
 
 	var lastUpdatedPath Path
 	var lastUpdatedTime time.Time
 	put := func(modification Modification) {
+		baselineMx.Lock()
+		switch modification := modification.(type) {
+			case Updated: baseline.Refresh(root, modification.path, exclude, onError)
+			case Deleted: baseline.Delete(modification.path)
+			case Moved:   baseline.Move(modification.from, modification.to)
+		}
+		baselineMx.Unlock()
 		if updated, ok := modification.(Updated); ok { // MAYBE: refactor
 			if updated.path.Equals(lastUpdatedPath) && (time.Now().Sub(lastUpdatedTime) < UpdatedMergeTimeout) {
 				return
@@ -299,6 +477,7 @@ func (InotifyWatcher) New(root string, exclude *regexp.Regexp, logger Logger) (W
 				lastUpdatedTime = time.Now()
 			}
 		}
+		reloadExclusions(exclude, modification) // all directories are watched anyway
 		watcher.modifications <- modification
 	}
 
@@ -330,28 +509,36 @@ func (InotifyWatcher) New(root string, exclude *regexp.Regexp, logger Logger) (W
 						putDefault()
 					// MAYBE: listen for exit
 				}
-			case MovedToCode: put(Updated{path})
+			case MovedToCode:    put(Updated{path})
+			case ReconciledCode: put(event.modification)
 			default: panic("unknown event type")
 		}
 	}
+
+	if errStart := start(); errStart != nil { return nil, errStart }
+	baselineMx.Lock()
+	go func() {
+		defer baselineMx.Unlock() // events, arriving meanwhile, wait and are applied on top
+		baseline = Snapshot{}.Take(root, exclude, onError)
+	}()
+	go supervise()
 	go func() { // events to modifications
 		for event := range events { processEvent(event) }
 		close(watcher.modifications)
 		return
 	}()
 
-	if errCommandStart := command.Start(); errCommandStart != nil {
-		return nil, errCommandStart
-	}
 	watcher.onClose = func() error {
-		return command.Process.Signal(syscall.SIGTERM) // MAYBE: `SIGKILL`
+		mx.Lock()
+		defer mx.Unlock()
+		if closed { return nil }
+		closed = true
+		close(stop)
+		err := command.Process.Signal(syscall.SIGTERM) // MAYBE: `SIGKILL`
+		if errors.Is(err, os.ErrProcessDone) { return nil } // crashed, and was not restarted
+		return err
 	}
 
-	// TODO: read error/info stream, await for "Watches established" (remove `--quiet`)
-	//go func() {
-	//	_ = command.Wait() // THINK: restart?
-	//}()
-
 	return watcher, nil
 }
 func (InotifyWatcher) Name() string {
@@ -425,3 +612,21 @@ func (watcher *InotifyWatcher) setMaxUserWatchers(nrWatchers uint64) error {
 
 	return command.Run()
 }
+
+type NativeInotifyWatcher struct { // inotify syscalls, without `inotifywait`
+	Watcher
+	modifications chan Modification
+	onClose       func() error
+}
+func (NativeInotifyWatcher) New(root string, exclude Excluder, logger Logger) (Watcher, error) {
+	return newNativeInotifyWatcher(root, exclude, logger) // platform-specific
+}
+func (NativeInotifyWatcher) Name() string {
+	return "native"
+}
+func (watcher *NativeInotifyWatcher) Close() error {
+	return watcher.onClose()
+}
+func (watcher *NativeInotifyWatcher) Modifications() <-chan Modification {
+	return watcher.modifications
+}
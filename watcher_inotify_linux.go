@@ -0,0 +1,238 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+func newNativeInotifyWatcher(root string, exclude Excluder, logger Logger) (Watcher, error) {
+	const Mask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+	const UpdatedMergeTimeout = 5 * time.Millisecond
+
+	root = stripTrailSlash(root)
+	modifications := make(chan Modification) // MAYBE: reserve size
+
+	fd, errInit := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if errInit != nil { return nil, os.NewSyscallError("inotify_init1", errInit) }
+	closing := make([]int, 2) // pipe, which wakes up reading on close
+	if errPipe := unix.Pipe2(closing, unix.O_CLOEXEC); errPipe != nil {
+		_ = unix.Close(fd)
+		return nil, os.NewSyscallError("pipe2", errPipe)
+	}
+	closeAll := func() {
+		for _, _fd := range []int{fd, closing[0], closing[1]} { _ = unix.Close(_fd) }
+	}
+	var closeOnce sync.Once
+
+	dirs := make(map[int]Path) // watch descriptor => watched directory
+	getPath := func(dir Path, name string) Path {
+		if len(dir.parts) == 0 { return Path{}.New(Filename(name)) }
+		return Path{}.New(dir.original + Filename(os.PathSeparator) + Filename(name))
+	}
+	excluded := func(path Path, isDir bool) bool {
+		return isExcluded(exclude, path, isDir)
+	}
+	addWatches := func(dir Path) error {
+		absolute := root
+		if len(dir.parts) > 0 { absolute += string(os.PathSeparator) + dir.original.Real() }
+		return filepath.Walk(
+			absolute,
+			func(path string, info fs.FileInfo, err error) error {
+				if err != nil {
+					if os.IsNotExist(err) { return nil } // removed meanwhile
+					return err
+				}
+				if !info.IsDir() { return nil }
+				relative, errRelative := filepath.Rel(root, path)
+				if errRelative != nil { return errRelative }
+				if relative == "." { relative = "" }
+				dirPath := Path{}.New(Filename(relative))
+				if excluded(dirPath, true) { return filepath.SkipDir }
+				wd, errWatch := unix.InotifyAddWatch(fd, path, Mask | unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW)
+				switch {
+					case errWatch == nil:
+						dirs[wd] = dirPath
+						return nil
+					case errors.Is(errWatch, unix.ENOENT), errors.Is(errWatch, unix.ENOTDIR):
+						return nil
+					case errors.Is(errWatch, unix.ENOSPC):
+						return errors.New("inotify watches limit reached. Increase fs.inotify.max_user_watches")
+					default:
+						return os.NewSyscallError("inotify_add_watch", errWatch)
+				}
+			},
+		)
+	}
+	removeWatches := func(dir Path) {
+		for wd, path := range dirs {
+			if dir.IsParentOf(path) {
+				_, _ = unix.InotifyRmWatch(fd, uint32(wd))
+				delete(dirs, wd)
+			}
+		}
+	}
+	moveWatches := func(from, to Path) {
+		for wd, path := range dirs {
+			if from.IsParentOf(path) {
+				Must(path.Move(from, to))
+				dirs[wd] = path
+			}
+		}
+	}
+
+	if err := addWatches(Path{}.New("")); err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	addNewWatches := func(dir Path) {
+		if err := addWatches(dir); err != nil { logger.Error(err.Error()) }
+	}
+
+	var lastUpdatedPath Path
+	var lastUpdatedTime time.Time
+	put := func(modification Modification) {
+		if updated, ok := modification.(Updated); ok { // contents of new directories are uploaded along with them
+			if lastUpdatedPath.IsParentOf(updated.path) && time.Now().Sub(lastUpdatedTime) < UpdatedMergeTimeout {
+				return
+			}
+			lastUpdatedPath = updated.path
+			lastUpdatedTime = time.Now()
+		} else {
+			lastUpdatedTime = time.Time{}
+		}
+		reloaded := reloadExclusions(exclude, modification)
+		modifications <- modification
+		for _, dir := range reloaded { addNewWatches(dir) } // directories, that are not excluded anymore
+	}
+
+	type Event struct {
+		mask   uint32
+		cookie uint32
+		path   Path
+	}
+	var movedFrom *Event // waiting for a pair
+	flushMovedFrom := func() {
+		if movedFrom == nil { return }
+		event := *movedFrom
+		movedFrom = nil
+		isDir := event.mask & unix.IN_ISDIR != 0
+		if isDir { removeWatches(event.path) } // moved outside
+		if !excluded(event.path, isDir) { put(Deleted{event.path}) }
+	}
+	processEvent := func(event Event) {
+		isDir := event.mask & unix.IN_ISDIR != 0
+		path := event.path
+		if movedFrom != nil {
+			if event.mask & unix.IN_MOVED_TO != 0 && event.cookie == movedFrom.cookie {
+				from := movedFrom.path
+				movedFrom = nil
+				switch excludedFrom, excludedTo := excluded(from, isDir), excluded(path, isDir); {
+					case !excludedFrom && !excludedTo:
+						if isDir { moveWatches(from, path) }
+						put(Moved{from: from, to: path})
+					case excludedFrom && !excludedTo:
+						if isDir { addNewWatches(path) }
+						put(Updated{path})
+					case !excludedFrom && excludedTo:
+						if isDir { removeWatches(from) }
+						put(Deleted{from})
+				}
+				return
+			}
+			flushMovedFrom()
+		}
+
+		switch {
+			case event.mask & unix.IN_MOVED_FROM != 0:
+				movedFrom = &event
+				return
+			case event.mask & unix.IN_CREATE != 0, event.mask & unix.IN_MOVED_TO != 0:
+				if excluded(path, isDir) { return }
+				if isDir { addNewWatches(path) }
+				put(Updated{path})
+			case event.mask & unix.IN_CLOSE_WRITE != 0:
+				if !excluded(path, isDir) { put(Updated{path}) }
+			case event.mask & unix.IN_DELETE != 0:
+				if !excluded(path, isDir) { put(Deleted{path}) }
+		}
+	}
+
+	go func() {
+		defer func() {
+			_ = unix.Close(fd)
+			_ = unix.Close(closing[0])
+			close(modifications)
+		}()
+
+		buffer := make([]byte, 4096 * (unix.SizeofInotifyEvent + unix.NAME_MAX + 1))
+		for {
+			timeout := -1
+			if movedFrom != nil { timeout = 0 } // a pair (if any) is queued together with MOVED_FROM
+			pollFds := []unix.PollFd{
+				{Fd: int32(fd),         Events: unix.POLLIN},
+				{Fd: int32(closing[0]), Events: unix.POLLIN},
+			}
+			nrReady, errPoll := unix.Poll(pollFds, timeout)
+			if errors.Is(errPoll, unix.EINTR) { continue }
+			if errPoll != nil {
+				logger.Error(os.NewSyscallError("poll", errPoll).Error())
+				return
+			}
+			if pollFds[1].Revents != 0 { return } // closed
+			if nrReady == 0 {
+				flushMovedFrom()
+				continue
+			}
+
+			nrBytes, errRead := unix.Read(fd, buffer)
+			if errors.Is(errRead, unix.EAGAIN) || errors.Is(errRead, unix.EINTR) { continue }
+			if errRead != nil {
+				logger.Error(os.NewSyscallError("read", errRead).Error())
+				return
+			}
+			for offset := 0; offset + unix.SizeofInotifyEvent <= nrBytes; {
+				raw := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				nameStart := offset + unix.SizeofInotifyEvent
+				offset = nameStart + int(raw.Len)
+				name := string(bytes.TrimRight(buffer[nameStart:offset], "\x00"))
+
+				if raw.Mask & unix.IN_Q_OVERFLOW != 0 {
+					logger.Error("inotify events queue overflow. Some modifications are lost")
+					continue
+				}
+				dir, watched := dirs[int(raw.Wd)]
+				if raw.Mask & unix.IN_IGNORED != 0 {
+					delete(dirs, int(raw.Wd))
+					continue
+				}
+				if !watched { continue }
+				processEvent(Event{
+					mask:   raw.Mask,
+					cookie: raw.Cookie,
+					path:   getPath(dir, name),
+				})
+			}
+		}
+	}()
+
+	return &NativeInotifyWatcher{
+		modifications: modifications,
+		onClose: func() error {
+			closeOnce.Do(func() {
+				_, _ = unix.Write(closing[1], []byte{0})
+				_ = unix.Close(closing[1])
+			})
+			return nil
+		},
+	}, nil
+}
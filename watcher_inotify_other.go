@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func newNativeInotifyWatcher(string, Excluder, Logger) (Watcher, error) {
+	return nil, errors.New("native inotify watcher is only supported on Linux")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type FileState struct {
+	size   int64
+	mtime  int64 // nanoseconds
+	device uint64
+	inode  uint64 // 0, if unknown
+	isDir  bool
+}
+func (state FileState) SameFile(other FileState) bool {
+	return state.inode != 0 && state.inode == other.inode && state.device == other.device && state.isDir == other.isDir
+}
+func (state FileState) SameContents(other FileState) bool {
+	return state.isDir || (state.size == other.size && state.mtime == other.mtime)
+}
+func (state FileState) key() FileKey {
+	return FileKey{state.device, state.inode}
+}
+
+type FileKey struct {
+	device uint64
+	inode  uint64
+}
+
+type Snapshot map[Filename]FileState
+func (Snapshot) Take(root string, exclude Excluder, onError func(error)) Snapshot {
+	snapshot := Snapshot{}
+	snapshot.walk(root, root, exclude, onError)
+	return snapshot
+}
+func (snapshot Snapshot) Refresh(root string, path Path, exclude Excluder, onError func(error)) { // after `path` was modified
+	snapshot.Delete(path)
+	snapshot.walk(root, filepath.Join(root, path.original.Real()), exclude, onError)
+}
+func (snapshot Snapshot) walk(root string, dir string, exclude Excluder, onError func(error)) {
+	err := filepath.Walk(
+		dir,
+		func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				if !os.IsNotExist(err) { onError(err) } // removed meanwhile
+				return nil
+			}
+			relative, errRelative := filepath.Rel(root, path)
+			if errRelative != nil { return errRelative }
+			if relative == "." { return nil }
+			if isExcluded(exclude, Path{}.New(Filename(relative)), info.IsDir()) {
+				if info.IsDir() { return filepath.SkipDir }
+				return nil
+			}
+			device, inode := fileIdentity(info)
+			snapshot[Filename(relative)] = FileState{
+				size:   info.Size(),
+				mtime:  info.ModTime().UnixNano(),
+				device: device,
+				inode:  inode,
+				isDir:  info.IsDir(),
+			}
+			return nil
+		},
+	)
+	if err != nil { onError(err) }
+}
+func (snapshot Snapshot) Diff(newer Snapshot) []Modification {
+	older := snapshot.Copy() // rewritten with every detected move, along with its index
+	olderIndex := older.index()
+	newerIndex := newer.index()
+	newerPaths := newer.sortedPaths()
+	modifications := make([]Modification, 0)
+
+	for moved := true; moved; { // until chains of moves are resolved
+		moved = false
+		for _, to := range newerPaths {
+			newState := newer[to]
+			if oldState, ok := older[to]; ok && oldState.SameFile(newState) { continue }
+			if newState.inode == 0 { continue }
+			from, found := olderIndex[newState.key()]
+			if !found || !older[from].SameContents(newState) { continue }
+			if current, exists := newer[from]; exists && current.SameFile(newState) { continue } // hard link
+			if replaced, exists := older[to]; exists {
+				if _, stillExists := newerIndex[replaced.key()]; stillExists && replaced.inode != 0 {
+					continue // will be moved first, or f.e. files were swapped
+				}
+				modifications = append(modifications, Deleted{Path{}.New(to)})
+				older.delete(Path{}.New(to), olderIndex)
+			}
+			modifications = append(modifications, Moved{Path{}.New(from), Path{}.New(to)})
+			older.move(Path{}.New(from), Path{}.New(to), olderIndex)
+			moved = true
+		}
+	}
+
+	var deleted []Path
+	for _, filename := range older.sortedPaths() {
+		path := Path{}.New(filename)
+		if newState, exists := newer[filename]; exists && newState.isDir == older[filename].isDir { continue }
+		if len(deleted) > 0 && deleted[len(deleted) - 1].IsParentOf(path) { continue }
+		deleted = append(deleted, path)
+		modifications = append(modifications, Deleted{path})
+	}
+
+	var updated []Path
+	for _, filename := range newerPaths {
+		path := Path{}.New(filename)
+		newState := newer[filename]
+		if oldState, existed := older[filename]; existed && oldState.isDir == newState.isDir {
+			if newState.isDir { continue } // changes of contents are tracked separately
+			if oldState.SameContents(newState) && (oldState.inode == 0 || oldState.SameFile(newState)) { continue }
+		}
+		if len(updated) > 0 && updated[len(updated) - 1].IsParentOf(path) { continue } // uploaded with parent
+		updated = append(updated, path)
+		modifications = append(modifications, Updated{path})
+	}
+
+	return modifications
+}
+func (snapshot Snapshot) Copy() Snapshot {
+	_copy := make(Snapshot, len(snapshot))
+	for filename, state := range snapshot { _copy[filename] = state }
+	return _copy
+}
+func (snapshot Snapshot) Delete(path Path) {
+	snapshot.delete(path, nil)
+}
+func (snapshot Snapshot) Move(from, to Path) {
+	snapshot.move(from, to, nil)
+}
+func (snapshot Snapshot) delete(path Path, index map[FileKey]Filename) { // keeps `index` up to date, if given
+	for _, filename := range snapshot.affected(path) {
+		state := snapshot[filename]
+		delete(snapshot, filename)
+		if index != nil && state.inode != 0 && index[state.key()] == filename { delete(index, state.key()) }
+	}
+}
+func (snapshot Snapshot) move(from, to Path, index map[FileKey]Filename) { // keeps `index` up to date, if given
+	filenames := snapshot.affected(from)
+	states := make([]FileState, len(filenames))
+	for i, filename := range filenames { // all are removed first: new names can collide with old ones
+		states[i] = snapshot[filename]
+		delete(snapshot, filename)
+	}
+	for i, filename := range filenames {
+		path := Path{}.New(filename)
+		Must(path.Move(from, to))
+		snapshot[path.original] = states[i]
+		if index != nil && states[i].inode != 0 { index[states[i].key()] = path.original }
+	}
+}
+func (snapshot Snapshot) affected(path Path) []Filename { // `path` itself, and its contents
+	if state, exists := snapshot[path.original]; exists && !state.isDir { return []Filename{path.original} }
+	var filenames []Filename
+	for filename := range snapshot {
+		if path.IsParentOf(Path{}.New(filename)) { filenames = append(filenames, filename) }
+	}
+	return filenames
+}
+func (snapshot Snapshot) index() map[FileKey]Filename {
+	index := make(map[FileKey]Filename, len(snapshot))
+	for filename, state := range snapshot {
+		if state.inode != 0 { index[state.key()] = filename }
+	}
+	return index
+}
+func (snapshot Snapshot) sortedPaths() []Filename { // parents go before children
+	paths := make([]Filename, 0, len(snapshot))
+	for filename := range snapshot { paths = append(paths, filename) }
+	sort.Slice(paths, func(i, j int) bool {
+		return comparePaths(Path{}.New(paths[i]), Path{}.New(paths[j])) < 0
+	})
+	return paths
+}
+
+type PollingWatcher struct { // for filesystems, where inotify is not supported (NFS, sshfs etc.)
+	Watcher
+	modifications chan Modification
+	stop          chan struct{}
+}
+func (PollingWatcher) New(root string, exclude Excluder, interval time.Duration, logger Logger) Watcher {
+	watcher := &PollingWatcher{
+		modifications: make(chan Modification),
+		stop:          make(chan struct{}),
+	}
+	if interval <= 0 { interval = time.Second }
+	onError := func(err error) { logger.Error(err.Error()) }
+	snapshot := Snapshot{}.Take(root, exclude, onError)
+
+	go func() {
+		defer close(watcher.modifications)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+				case <-ticker.C:
+					newSnapshot := Snapshot{}.Take(root, exclude, onError)
+					for _, modification := range snapshot.Diff(newSnapshot) {
+						reloadExclusions(exclude, modification) // newly included files are found on next scan
+						select {
+							case watcher.modifications <- modification:
+							case <-watcher.stop: return
+						}
+					}
+					snapshot = newSnapshot
+				case <-watcher.stop:
+					return
+			}
+		}
+	}()
+
+	return watcher
+}
+func (PollingWatcher) Name() string {
+	return "poll"
+}
+func (watcher *PollingWatcher) Close() error {
+	close(watcher.stop)
+	return nil
+}
+func (watcher *PollingWatcher) Modifications() <-chan Modification {
+	return watcher.modifications
+}
+
+func comparePaths(a, b Path) int {
+	for i := 0; i < len(a.parts) && i < len(b.parts); i++ {
+		if a.parts[i] < b.parts[i] { return -1 }
+		if a.parts[i] > b.parts[i] { return 1 }
+	}
+	return len(a.parts) - len(b.parts)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"github.com/0leksandr/my.go"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSnapshot_Diff(t *testing.T) {
+	file := func(inode uint64, size int64) FileState {
+		return FileState{size: size, mtime: 100, device: 1, inode: inode}
+	}
+	dir := func(inode uint64) FileState {
+		return FileState{mtime: 100, device: 1, inode: inode, isDir: true}
+	}
+	path := func(filename Filename) Path { return Path{}.New(filename) }
+
+	testCases := map[string]struct {
+		older    Snapshot
+		newer    Snapshot
+		expected []Modification
+	}{
+		"nothing": {
+			Snapshot{"a": file(1, 1), "b": dir(2)},
+			Snapshot{"a": file(1, 1), "b": dir(2)},
+			[]Modification{},
+		},
+		"updated": {
+			Snapshot{"a": file(1, 1)},
+			Snapshot{"a": file(1, 2), "b": file(2, 1)},
+			[]Modification{Updated{path("a")}, Updated{path("b")}},
+		},
+		"replaced": {
+			Snapshot{"a": file(1, 1)},
+			Snapshot{"a": file(2, 1)},
+			[]Modification{Updated{path("a")}},
+		},
+		"created directory": {
+			Snapshot{},
+			Snapshot{"a": dir(1), "a/b": dir(2), "a/b/c": file(3, 1)},
+			[]Modification{Updated{path("a")}},
+		},
+		"deleted directory": {
+			Snapshot{"a": dir(1), "a/b": dir(2), "a/b/c": file(3, 1), "d": file(4, 1)},
+			Snapshot{"d": file(4, 1)},
+			[]Modification{Deleted{path("a")}},
+		},
+		"moved": {
+			Snapshot{"a": file(1, 1)},
+			Snapshot{"b": file(1, 1)},
+			[]Modification{Moved{path("a"), path("b")}},
+		},
+		"moved and modified": {
+			Snapshot{"a": file(1, 1)},
+			Snapshot{"b": file(1, 2)},
+			[]Modification{Deleted{path("a")}, Updated{path("b")}},
+		},
+		"moved directory": {
+			Snapshot{"a": dir(1), "a/b": file(2, 1), "a/c": file(3, 1)},
+			Snapshot{"d": dir(1), "d/b": file(2, 1), "d/e": file(4, 1)},
+			[]Modification{Moved{path("a"), path("d")}, Deleted{path("d/c")}, Updated{path("d/e")}},
+		},
+		"moved over existing": {
+			Snapshot{"a": file(1, 1), "b": file(2, 1)},
+			Snapshot{"b": file(1, 1)},
+			[]Modification{Deleted{path("b")}, Moved{path("a"), path("b")}},
+		},
+		"chain of moves": {
+			Snapshot{"a": file(1, 1), "b": file(2, 1)},
+			Snapshot{"b": file(1, 1), "c": file(2, 1)},
+			[]Modification{Moved{path("b"), path("c")}, Moved{path("a"), path("b")}},
+		},
+		"swapped": {
+			Snapshot{"a": file(1, 1), "b": file(2, 1)},
+			Snapshot{"a": file(2, 1), "b": file(1, 1)},
+			[]Modification{Updated{path("a")}, Updated{path("b")}},
+		},
+		"moved and recreated": {
+			Snapshot{"a": file(1, 1)},
+			Snapshot{"a": file(2, 1), "b": file(1, 1)},
+			[]Modification{Moved{path("a"), path("b")}, Updated{path("a")}},
+		},
+	}
+	for name, testCase := range testCases {
+		my.AssertEquals(t, testCase.older.Diff(testCase.newer), testCase.expected, name)
+	}
+}
+func TestSnapshot_Refresh(t *testing.T) {
+	root := t.TempDir()
+	PanicIf(os.MkdirAll(filepath.Join(root, "a/b"), 0755))
+	PanicIf(os.WriteFile(filepath.Join(root, "a/b/c"), []byte("c"), 0644))
+	PanicIf(os.WriteFile(filepath.Join(root, "d"), []byte("d"), 0644))
+	take := func() Snapshot { return Snapshot{}.Take(root, nil, func(err error) { PanicIf(err) }) }
+	snapshot := take()
+
+	PanicIf(os.RemoveAll(filepath.Join(root, "a/b")))
+	PanicIf(os.WriteFile(filepath.Join(root, "a/e"), []byte("e"), 0644))
+	PanicIf(os.WriteFile(filepath.Join(root, "d"), []byte("dd"), 0644))
+	snapshot.Refresh(root, Path{}.New("a"), nil, func(err error) { PanicIf(err) })
+	snapshot.Refresh(root, Path{}.New("d"), nil, func(err error) { PanicIf(err) })
+	my.AssertEquals(t, snapshot.Diff(take()), []Modification{})
+}
+func TestPollingWatcher(t *testing.T) {
+	clearSandbox := func() { clearDir(getSandbox()) }
+	clearSandbox()
+	defer clearSandbox()
+
+	targetDir := getTargetDir()
+	watcher := PollingWatcher{}.New(
+		targetDir,
+		nil,
+		10 * time.Millisecond,
+		Logger{
+			debug: NullLogger{},
+			error: StdErrLogger{LogFormatter{false}},
+		},
+	)
+	defer func() { Must(watcher.Close()) }()
+
+	assertModification := func(command string, expected ...Modification) {
+		my.RunCommand(targetDir, command, nil, func(err string) { panic(err) })
+		var modifications []Modification
+		timeout := time.After(5 * time.Second)
+		readModifications: for len(modifications) < len(expected) { // polled until all arrive
+			select {
+				case modification := <-watcher.Modifications():
+					modifications = append(modifications, modification)
+				case <-timeout:
+					break readModifications
+			}
+		}
+		select {
+			case modification := <-watcher.Modifications(): // nothing extra, within a few scans
+				modifications = append(modifications, modification)
+			case <-time.After(50 * time.Millisecond):
+		}
+		sortModifications := func(modifications []Modification) { // a scan can happen in the middle of command
+			sort.Slice(modifications, func(i, j int) bool {
+				return fmt.Sprint(modifications[i]) < fmt.Sprint(modifications[j])
+			})
+		}
+		sortModifications(modifications)
+		sortModifications(expected)
+		my.AssertEquals(t, modifications, expected, command)
+	}
+
+	assertModification(write("a"), Updated{Path{}.New("a")})
+	assertModification(move("a", "b"), Moved{Path{}.New("a"), Path{}.New("b")})
+	assertModification(
+		mkdir("c") + " && " + move("b", "c/b"),
+		Moved{Path{}.New("b"), Path{}.New("c/b")},
+		Updated{Path{}.New("c")},
+	)
+	assertModification(move("c", "d"), Moved{Path{}.New("c"), Path{}.New("d")})
+	assertModification(remove("d"), Deleted{Path{}.New("d")})
+}
@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"github.com/0leksandr/my.go"
 	"os"
-	"regexp"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -15,24 +15,22 @@ func TestWatchers(t *testing.T) {
 	defer clearSandbox()
 
 	targetDir := getTargetDir()
-	exclude := regexp.MustCompile("excluded[12]|. --exclude 3")
-	for _, watcher := range []Watcher{
-		//FsnotifyWatcher{}.New(targetDir, exclude),
-		(func() Watcher {
-			watcher, err := InotifyWatcher{}.New(
-				targetDir,
-				exclude,
-				Logger{
-					debug: NullLogger{},
-					error: StdErrLogger{LogFormatter{false}},
-				},
-			)
-			PanicIf(err)
-			return watcher
-		})(),
+	exclude, errExclude := RegexpExcluder{}.New([]string{"excluded[12]|. --exclude 3"})
+	PanicIf(errExclude)
+	logger := Logger{
+		debug: NullLogger{},
+		error: StdErrLogger{LogFormatter{false}},
+	}
+	for _, newWatcher := range []func() (Watcher, error){
+		//func() (Watcher, error) { return FsnotifyWatcher{}.New(targetDir, exclude, logger), nil },
+		func() (Watcher, error) { return InotifyWatcher{}.New(targetDir, exclude, logger) },
+		func() (Watcher, error) { return NativeInotifyWatcher{}.New(targetDir, exclude, logger) },
 	} {
+		watcher, err := newWatcher()
+		PanicIf(err)
 		(func() {
 			defer clearDir(targetDir)
+			defer func() { Must(watcher.Close()) }()
 
 			assertModification := func(command string, expected ...Modification) {
 				my.RunCommand(
@@ -88,6 +86,48 @@ func TestWatchers(t *testing.T) {
 		})()
 	}
 }
+func TestFsnotifyWatcher_NewSubdirectories(t *testing.T) {
+	clearSandbox := func() { clearDir(getSandbox()) }
+	clearSandbox()
+	defer clearSandbox()
+
+	targetDir := getTargetDir()
+	watcher := FsnotifyWatcher{}.New(targetDir, nil, Logger{debug: NullLogger{}, error: &InMemoryErrorLogger{}})
+	defer func() { Must(watcher.Close()) }()
+
+	readModifications := func(command string) []Modification {
+		my.RunCommand(targetDir, command, nil, func(err string) { panic(err) })
+		var modifications []Modification
+		for {
+			select {
+				case modification := <-watcher.Modifications():
+					modifications = append(modifications, modification)
+				case <-time.After(50 * time.Millisecond):
+					return modifications
+			}
+		}
+	}
+	contains := func(modifications []Modification, expected Modification) bool {
+		for _, modification := range modifications {
+			if reflect.DeepEqual(modification, expected) { return true }
+		}
+		return false
+	}
+
+	modifications := readModifications(write("aaa/bbb/c"))
+	my.Assert(t, contains(modifications, Updated{Path{}.New("aaa")}), modifications)
+	my.Assert(t, contains(modifications, Updated{Path{}.New("aaa/bbb/c")}), modifications)
+
+	modifications = readModifications(write("aaa/bbb/d"))
+	my.Assert(t, contains(modifications, Updated{Path{}.New("aaa/bbb/d")}), modifications)
+
+	modifications = readModifications(move("aaa", "../aaa"))
+	my.AssertEquals(t, modifications, []Modification{Deleted{Path{}.New("aaa")}})
+
+	modifications = readModifications(write("../aaa/bbb/e"))
+	my.AssertEquals(t, modifications, []Modification(nil))
+	my.RunCommand(targetDir, remove("../aaa"), nil, func(err string) { panic(err) })
+}
 
 func getSandbox() string {
 	currentDir, err := os.Getwd()